@@ -2,11 +2,18 @@ package hystrix
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lesha888/hystrix-go/hystrix/callback"
+	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
+	"github.com/lesha888/hystrix-go/hystrix/rolling"
+	"golang.org/x/time/rate"
 )
 
 // CircuitBreaker is created for each ExecutorPool to track whether requests
@@ -17,41 +24,128 @@ type CircuitBreaker struct {
 	forceOpen              bool
 	mutex                  *sync.RWMutex
 	openedOrLastTestedTime int64
+	consecutiveFailures    int64
+	sleepWindowJitter      float64
+	// closedHealthy caches whether the circuit was closed with healthy metrics when last
+	// checked, letting AllowRequest skip the rolling metrics. It is 1 when set.
+	closedHealthy int32
+	// decisionOpen caches IsOpen for AllowRequest, when it is 1, until decisionExpires, in Unix
+	// nanoseconds. Both are used only with a DecisionCacheTTL.
+	decisionOpen    int32
+	decisionExpires int64
 
 	executorPool *executorPool
 	metrics      *metricExchange
+	limiter      *rate.Limiter
+	// lite stands in for metrics while the command's settings DisableMetrics.
+	lite liteMetrics
+	// opened is closed when the circuit opens, and replaced when it closes again.
+	opened chan struct{}
+	// flushed is closed when the circuit is removed by Flush or CloseCommand.
+	flushed chan struct{}
+	// executing counts the command's executions from when goC takes the circuit until the last of
+	// their goroutines finishes, whether they wait for a ticket, run, or are rejected.
+	executing int64
+	// closing is commandClosing while CloseCommand looks for executions in flight, and
+	// commandClosed once it has closed the command. New executions aren't counted on the circuit
+	// meanwhile, and once it is closed reports to it are dropped.
+	closing int32
+	// fallbacks counts the command's fallbacks running.
+	fallbacks int64
+	// droppedUpdates counts the executions whose metrics didn't fit in the metric exchange.
+	droppedUpdates uint64
+	// failedProbes counts the failed probes in a row, each growing the sleep window towards its
+	// MaxSleepWindow.
+	failedProbes int32
+	// probing is 1 from allowSingleTest letting a probe through until its outcome is reported.
+	probing int32
+	// probeSuccesses counts the successful probes in a row while the circuit is open, towards its
+	// RequiredSuccessesToClose.
+	probeSuccesses int32
+	lifetime       LifetimeCounts
+	// created is when the circuit was created, from which its WarmupDuration runs.
+	created time.Time
+	// openedAt is when the circuit last opened, and openDuration the total time it was open
+	// before that. Both are guarded by mutex.
+	openedAt     time.Time
+	openDuration time.Duration
+	// transitions counts the circuit opening and closing within the rolling window, to tell when it
+	// flaps between the two.
+	transitions *rolling.Number
 }
 
 var (
 	circuitBreakersMutex *sync.RWMutex
 	circuitBreakers      map[string]*CircuitBreaker
+	// circuitCache mirrors circuitBreakers for GetCircuit to look circuits up without locking. It
+	// is only changed with circuitBreakersMutex held for writing, alongside circuitBreakers.
+	circuitCache sync.Map
+	// groupPools holds the executor pools shared by the commands of each group. It is guarded by circuitBreakersMutex.
+	groupPools map[string]*executorPool
 )
 
 func init() {
 	circuitBreakersMutex = &sync.RWMutex{}
 	circuitBreakers = make(map[string]*CircuitBreaker)
+	groupPools = make(map[string]*executorPool)
 }
 
-// GetCircuit returns the circuit for the given command and whether this call created it.
+// GetCircuit returns the circuit for the given command and whether this call created it. Circuits
+// which exist are found without locking; only their creation is serialized.
 func GetCircuit(name string) (*CircuitBreaker, bool, error) {
+	name = normalizeCommandName(name)
+	if cb, ok := circuitCache.Load(name); ok {
+		return cb.(*CircuitBreaker), false, nil
+	}
+
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+	// another goroutine may have created the circuit while we waited for the lock
+	if cb, ok := circuitBreakers[name]; ok {
+		return cb, false, nil
+	}
+	cb := newCircuitBreaker(name)
+	circuitBreakers[name] = cb
+	circuitCache.Store(name, cb)
+
+	return cb, true, nil
+}
+
+// CommandNames returns the sorted names of every circuit created so far, whether
+// explicitly configured or created on the command's first execution.
+func CommandNames() []string {
 	circuitBreakersMutex.RLock()
-	_, ok := circuitBreakers[name]
-	if !ok {
-		circuitBreakersMutex.RUnlock()
-		circuitBreakersMutex.Lock()
-		defer circuitBreakersMutex.Unlock()
-		// because we released the rlock before we obtained the exclusive lock,
-		// we need to double check that some other thread didn't beat us to
-		// creation.
-		if cb, ok := circuitBreakers[name]; ok {
-			return cb, false, nil
-		}
-		circuitBreakers[name] = newCircuitBreaker(name)
-	} else {
-		defer circuitBreakersMutex.RUnlock()
+	names := make([]string, 0, len(circuitBreakers))
+	for name := range circuitBreakers {
+		names = append(names, name)
+	}
+	circuitBreakersMutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// PrewarmCommands creates the circuits, executor pools and metric collectors of the named
+// commands ahead of their first execution, so that it doesn't pay for creating them. Commands
+// are created with their settings at the time, so configure them first. Circuits which already
+// exist are left as they are.
+func PrewarmCommands(names ...string) {
+	for _, name := range names {
+		GetCircuit(name)
 	}
+}
 
-	return circuitBreakers[name], !ok, nil
+// ForEachCircuit calls fn with each circuit created so far, in no particular order. The
+// circuits are visited under a read lock, so fn sees a consistent set of them, but it must
+// not block or call back into functions such as GetCircuit, Flush or CloseCommand, which
+// would deadlock.
+func ForEachCircuit(fn func(name string, c *CircuitBreaker)) {
+	circuitBreakersMutex.RLock()
+	defer circuitBreakersMutex.RUnlock()
+
+	for name, cb := range circuitBreakers {
+		fn(name, cb)
+	}
 }
 
 // Flush purges all circuit and metric information from memory.
@@ -60,9 +154,90 @@ func Flush() {
 	defer circuitBreakersMutex.Unlock()
 
 	for name, cb := range circuitBreakers {
+		close(cb.flushed)
 		cb.metrics.Reset()
 		cb.executorPool.Metrics.Reset()
 		delete(circuitBreakers, name)
+		circuitCache.Delete(name)
+	}
+	for group := range groupPools {
+		delete(groupPools, group)
+	}
+}
+
+// CloseCommand removes a single command, stopping the goroutines behind its metrics and
+// its executor pool, and forgetting its settings. It fails without removing anything while
+// executions of the command are in flight, including those waiting for a ticket. A pool shared
+// through Group is left to the group's other commands. Events reported to the closed circuit,
+// such as through a CircuitBreaker kept from before, are dropped.
+func CloseCommand(name string) error {
+	name = normalizeCommandName(name)
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+
+	cb, ok := circuitBreakers[name]
+	if ok {
+		atomic.StoreInt32(&cb.closing, commandClosing)
+		if n := atomic.LoadInt64(&cb.executing); n > 0 {
+			atomic.StoreInt32(&cb.closing, commandActive)
+			return fmt.Errorf("hystrix: command %v has %d executions in flight", name, n)
+		}
+		atomic.StoreInt32(&cb.closing, commandClosed)
+
+		delete(circuitBreakers, name)
+		circuitCache.Delete(name)
+		close(cb.flushed)
+		cb.metrics.Close()
+		if getSettings(name).Group == "" {
+			cb.executorPool.Metrics.Close()
+		}
+	}
+
+	settingsMutex.Lock()
+	delete(circuitSettings, name)
+	settingsMutex.Unlock()
+
+	return nil
+}
+
+// CloseCircuit closes the named command's circuit at once and discards its rolling metrics, for
+// operators who know its backend has recovered, such as after deploying a fix, and don't want to
+// wait out the sleep window and probes. Unlike forcing the circuit's state, it leaves the circuit
+// to open and close by itself afterwards, judged only by executions from then on. Commands which
+// haven't been used are left alone.
+func CloseCircuit(name string) {
+	name = normalizeCommandName(name)
+	cb, ok := circuitCache.Load(name)
+	if !ok {
+		return
+	}
+
+	log.Printf("hystrix-go: closing circuit %v on request", name)
+	cb.(*CircuitBreaker).Reset()
+}
+
+// The values of a circuit's closing.
+const (
+	commandActive int32 = iota
+	commandClosing
+	commandClosed
+)
+
+// enterCircuit returns the named command's circuit with an execution counted in flight on it. An
+// execution which finds the circuit being closed by CloseCommand looks it up again, to count
+// itself on the same circuit if closing it failed, or on a new one.
+func enterCircuit(name string) (*CircuitBreaker, error) {
+	for {
+		circuit, _, err := GetCircuit(name)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&circuit.executing, 1)
+		if atomic.LoadInt32(&circuit.closing) == commandActive {
+			return circuit, nil
+		}
+		atomic.AddInt64(&circuit.executing, -1)
+		runtime.Gosched()
 	}
 }
 
@@ -70,13 +245,121 @@ func Flush() {
 func newCircuitBreaker(name string) *CircuitBreaker {
 	c := &CircuitBreaker{}
 	c.Name = name
-	c.metrics = newMetricExchange(name)
-	c.executorPool = newExecutorPool(name)
 	c.mutex = &sync.RWMutex{}
+	c.metrics = newMetricExchange(name, c.refreshClosedHealthy)
+	c.executorPool = executorPoolFor(name)
+	c.opened = make(chan struct{})
+	c.flushed = make(chan struct{})
+	c.created = clockNow()
+	c.transitions = rolling.NewNumber()
+
+	if interval := getSettings(name).MetricsResetInterval; interval > 0 {
+		go c.resetMetricsEvery(interval)
+	}
 
 	return c
 }
 
+// executorPoolFor returns the pool a new circuit takes tickets from: its group's, shared with
+// the group's other commands, or else one of its own. It must be called with circuitBreakersMutex held for writing.
+func executorPoolFor(name string) *executorPool {
+	group := getSettings(name).Group
+	if group == "" {
+		return newExecutorPool(name)
+	}
+
+	pool, ok := groupPools[group]
+	if !ok {
+		pool = newExecutorPool(group)
+		groupPools[group] = pool
+	}
+	return pool
+}
+
+// resizeExecutorPool resizes the executor pool named after the command, which is its own or that
+// of the group named after it, if it has been created.
+func resizeExecutorPool(name string, max int) {
+	circuitBreakersMutex.RLock()
+	pool, ok := groupPools[name]
+	if !ok {
+		if cb, exists := circuitBreakers[name]; exists && cb.executorPool.Name == name {
+			pool, ok = cb.executorPool, true
+		}
+	}
+	circuitBreakersMutex.RUnlock()
+
+	if ok {
+		pool.resize(max)
+	}
+}
+
+// forgetHealth discards the cached health which AllowRequest's fast path relies on for the named
+// command's circuit, if it has one, as it was judged by the command's previous settings. Whether
+// metrics are disabled, for one, changes what the health is judged by.
+func forgetHealth(name string) {
+	circuitBreakersMutex.RLock()
+	circuit, ok := circuitBreakers[name]
+	circuitBreakersMutex.RUnlock()
+
+	if ok {
+		atomic.StoreInt32(&circuit.closedHealthy, 0)
+	}
+}
+
+// resetMetricsEvery discards the circuit's rolling metrics each interval until the circuit is flushed.
+// The circuit's open or closed state is left alone.
+func (circuit *CircuitBreaker) resetMetricsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			circuit.resetMetrics()
+		case <-circuit.flushed:
+			return
+		}
+	}
+}
+
+// Metrics returns the collector which holds the rolling statistics used to judge this circuit's health.
+// It is safe to query while commands are executing.
+func (circuit *CircuitBreaker) Metrics() *metricCollector.DefaultMetricCollector {
+	return circuit.metrics.DefaultCollector()
+}
+
+// DebugMetrics returns the one second buckets of the circuit's rolling metrics, by event type, to
+// show how the counts behind its error percentage were spread over the window, such as when it
+// tripped unexpectedly. Metrics kept in a RollingStat without buckets are left out.
+func (circuit *CircuitBreaker) DebugMetrics() map[string][]rolling.Bucket {
+	m := circuit.Metrics()
+	stats := map[string]metricCollector.RollingStat{
+		"attempts":                  m.NumRequestsStat(),
+		"errors":                    m.ErrorsStat(),
+		"success":                   m.SuccessesStat(),
+		"failure":                   m.FailuresStat(),
+		"rejected":                  m.RejectsStat(),
+		"short-circuit":             m.ShortCircuitsStat(),
+		"timeout":                   m.TimeoutsStat(),
+		"context_canceled":          m.ContextCanceledStat(),
+		"context_deadline_exceeded": m.ContextDeadlineExceededStat(),
+		"draining":                  m.DrainingStat(),
+		"fallback-success":          m.FallbackSuccessesStat(),
+		"fallback-failure":          m.FallbackFailuresStat(),
+	}
+
+	now := clockNow()
+	buckets := make(map[string][]rolling.Bucket, len(stats))
+	for eventType, stat := range stats {
+		if n, ok := stat.(interface {
+			WindowBuckets(time.Time) []rolling.Bucket
+		}); ok {
+			buckets[eventType] = n.WindowBuckets(now)
+		}
+	}
+	return buckets
+}
+
 // toggleForceOpen allows manually causing the fallback logic for all instances
 // of a given command.
 func (circuit *CircuitBreaker) toggleForceOpen(toggle bool) error {
@@ -85,7 +368,13 @@ func (circuit *CircuitBreaker) toggleForceOpen(toggle bool) error {
 		return err
 	}
 
+	circuit.mutex.Lock()
 	circuit.forceOpen = toggle
+	if toggle {
+		atomic.StoreInt32(&circuit.closedHealthy, 0)
+	}
+	atomic.StoreInt64(&circuit.decisionExpires, 0)
+	circuit.mutex.Unlock()
 	return nil
 }
 
@@ -100,11 +389,15 @@ func (circuit *CircuitBreaker) IsOpen() bool {
 		return true
 	}
 
-	if uint64(circuit.metrics.Requests().Sum(time.Now())) < getSettings(circuit.Name).RequestVolumeThreshold {
+	if circuit.warmingUp() {
+		return false
+	}
+
+	if uint64(circuit.requestCount(clockNow())) < getSettings(circuit.Name).VolumeThreshold() {
 		return false
 	}
 
-	if !circuit.metrics.IsHealthy(time.Now()) {
+	if !circuit.healthy(clockNow()) {
 		// too many failures, open the circuit
 		circuit.setOpen()
 		return true
@@ -113,23 +406,159 @@ func (circuit *CircuitBreaker) IsOpen() bool {
 	return false
 }
 
+// CircuitState is whether a circuit lets executions through, as returned by State.
+type CircuitState int
+
+const (
+	// CircuitClosed lets executions through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen short-circuits executions until its sleep window has passed.
+	CircuitOpen
+	// CircuitHalfOpen is open, but has a probe in flight, or will let one through, to test whether it may close.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// State returns whether the circuit is closed, open, or half-open and probing whether it has
+// recovered. Unlike IsOpen it never opens the circuit itself, so a circuit whose metrics have turned
+// unhealthy stays closed until an execution checks them. A circuit forced open is always open.
+func (circuit *CircuitBreaker) State() CircuitState {
+	circuit.mutex.RLock()
+	open, forceOpen := circuit.open, circuit.forceOpen
+	circuit.mutex.RUnlock()
+
+	switch {
+	case forceOpen:
+		return CircuitOpen
+	case !open:
+		return CircuitClosed
+	case atomic.LoadInt32(&circuit.probing) == 1 || circuit.wouldAllowSingleTest():
+		return CircuitHalfOpen
+	}
+	return CircuitOpen
+}
+
+// requestCount returns the number of requests the circuit's health is judged by, within the
+// metricsWindow ending at now.
+func (circuit *CircuitBreaker) requestCount(now time.Time) float64 {
+	if getSettings(circuit.Name).DisableMetrics {
+		requests, _ := circuit.lite.counts(now)
+		return requests
+	}
+	return circuit.metrics.Requests().Sum(now)
+}
+
+// healthy reports whether the circuit's recent requests are healthy enough for it to stay closed.
+// Without metrics, only the error percentage is judged.
+func (circuit *CircuitBreaker) healthy(now time.Time) bool {
+	if getSettings(circuit.Name).DisableMetrics {
+		return circuit.lite.errorPercent(now) < getSettings(circuit.Name).ErrorPercentThreshold
+	}
+	return circuit.metrics.IsHealthy(now)
+}
+
 // AllowRequest is checked before a command executes, ensuring that circuit state and metric health allow it.
 // When the circuit is open, this call will occasionally return true to measure whether the external service
 // has recovered.
+//
+// While the circuit is closed and its metrics were healthy when last processed, this is a single atomic load.
 func (circuit *CircuitBreaker) AllowRequest() bool {
-	return !circuit.IsOpen() || circuit.allowSingleTest()
+	allowed, _ := circuit.allowRequest()
+	return allowed
+}
+
+// allowRequest is AllowRequest, also reporting whether the request was let through as the probe
+// of an open circuit.
+func (circuit *CircuitBreaker) allowRequest() (allowed, probe bool) {
+	if atomic.LoadInt32(&circuit.closedHealthy) == 1 {
+		return true, false
+	}
+	if !circuit.isOpenCached() {
+		return true, false
+	}
+	probe = circuit.allowSingleTest()
+	return probe, probe
+}
+
+// isOpenCached returns IsOpen, reusing its last answer for up to the command's DecisionCacheTTL.
+// Opening or closing the circuit discards the cached answer.
+func (circuit *CircuitBreaker) isOpenCached() bool {
+	ttl := getSettings(circuit.Name).DecisionCacheTTL
+	if ttl <= 0 {
+		return circuit.IsOpen()
+	}
+
+	now := clockNow().UnixNano()
+	if now < atomic.LoadInt64(&circuit.decisionExpires) {
+		return atomic.LoadInt32(&circuit.decisionOpen) == 1
+	}
+
+	open := circuit.IsOpen()
+	var v int32
+	if open {
+		v = 1
+	}
+	atomic.StoreInt32(&circuit.decisionOpen, v)
+	atomic.StoreInt64(&circuit.decisionExpires, now+ttl.Nanoseconds())
+	return open
+}
+
+// refreshClosedHealthy recomputes the cached state used by AllowRequest's fast path. It runs
+// after each batch of metric updates, so the cache never lags the metrics by more than one batch.
+func (circuit *CircuitBreaker) refreshClosedHealthy() {
+	// holding the lock stops the circuit opening between the check and the store.
+	circuit.mutex.RLock()
+	defer circuit.mutex.RUnlock()
+
+	healthy := !circuit.open && !circuit.forceOpen
+	if healthy && !circuit.warmingUp() && uint64(circuit.requestCount(clockNow())) >= getSettings(circuit.Name).VolumeThreshold() {
+		healthy = circuit.healthy(clockNow())
+	}
+
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&circuit.closedHealthy, v)
+}
+
+// warmingUp reports whether the circuit is still within the WarmupDuration following its creation,
+// during which its metrics can't trip it.
+func (circuit *CircuitBreaker) warmingUp() bool {
+	warmup := getSettings(circuit.Name).WarmupDuration
+	return warmup > 0 && clockNow().Before(circuit.created.Add(warmup))
 }
 
 func (circuit *CircuitBreaker) allowSingleTest() bool {
 	circuit.mutex.RLock()
 	defer circuit.mutex.RUnlock()
 
-	now := time.Now().UnixNano()
+	now := clockNow().UnixNano()
+	if circuit.open && atomic.LoadInt32(&circuit.probeSuccesses) > 0 && atomic.CompareAndSwapInt32(&circuit.probing, 0, 1) {
+		// half-open after a successful probe, the next needn't wait out a sleep window
+		atomic.StoreInt64(&circuit.openedOrLastTestedTime, now)
+		log.Printf("hystrix-go: allowing another test to possibly close circuit %v", circuit.Name)
+		callback.Invoke(circuit.Name, callback.AllowSingle)
+		return true
+	}
+
 	openedOrLastTestedTime := atomic.LoadInt64(&circuit.openedOrLastTestedTime)
-	if circuit.open && now > openedOrLastTestedTime+getSettings(circuit.Name).SleepWindow.Nanoseconds() {
+	if circuit.open && now > openedOrLastTestedTime+circuit.sleepWindow().Nanoseconds() {
 		swapped := atomic.CompareAndSwapInt64(&circuit.openedOrLastTestedTime, openedOrLastTestedTime, now)
 		if swapped {
 			log.Printf("hystrix-go: allowing single test to possibly close circuit %v", circuit.Name)
+			atomic.StoreInt32(&circuit.probing, 1)
 
 			callback.Invoke(circuit.Name, callback.AllowSingle)
 		}
@@ -139,6 +568,57 @@ func (circuit *CircuitBreaker) allowSingleTest() bool {
 	return false
 }
 
+// wouldAllowSingleTest reports whether allowSingleTest would currently let a test through, without claiming it.
+func (circuit *CircuitBreaker) wouldAllowSingleTest() bool {
+	circuit.mutex.RLock()
+	defer circuit.mutex.RUnlock()
+
+	if circuit.open && atomic.LoadInt32(&circuit.probeSuccesses) > 0 && atomic.LoadInt32(&circuit.probing) == 0 {
+		return true
+	}
+	openedOrLastTestedTime := atomic.LoadInt64(&circuit.openedOrLastTestedTime)
+	return circuit.open && clockNow().UnixNano() > openedOrLastTestedTime+circuit.sleepWindow().Nanoseconds()
+}
+
+// wouldAllowRate reports whether allowRate would currently succeed, without consuming a token.
+func (circuit *CircuitBreaker) wouldAllowRate() bool {
+	if getSettings(circuit.Name).MaxRequestsPerSecond <= 0 {
+		return true
+	}
+
+	circuit.mutex.RLock()
+	limiter := circuit.limiter
+	circuit.mutex.RUnlock()
+
+	return limiter == nil || limiter.Tokens() >= 1
+}
+
+// allowRate consumes a token from the command's rate limiter, reporting whether the
+// execution fits within MaxRequestsPerSecond. The limiter is rebuilt whenever that setting changes.
+func (circuit *CircuitBreaker) allowRate() bool {
+	rps := getSettings(circuit.Name).MaxRequestsPerSecond
+	if rps <= 0 {
+		return true
+	}
+	limit := rate.Limit(rps)
+
+	circuit.mutex.RLock()
+	limiter := circuit.limiter
+	circuit.mutex.RUnlock()
+
+	if limiter == nil || limiter.Limit() != limit {
+		circuit.mutex.Lock()
+		if circuit.limiter == nil || circuit.limiter.Limit() != limit {
+			burst := int(math.Ceil(rps))
+			circuit.limiter = rate.NewLimiter(limit, burst)
+		}
+		limiter = circuit.limiter
+		circuit.mutex.Unlock()
+	}
+
+	return limiter.Allow()
+}
+
 func (circuit *CircuitBreaker) setOpen() {
 	circuit.mutex.Lock()
 	defer circuit.mutex.Unlock()
@@ -148,11 +628,74 @@ func (circuit *CircuitBreaker) setOpen() {
 	}
 
 	log.Printf("hystrix-go: opening circuit %v", circuit.Name)
-	circuit.openedOrLastTestedTime = time.Now().UnixNano()
+	now := clockNow()
+	circuit.openedOrLastTestedTime = now.UnixNano()
+	circuit.openedAt = now
+	circuit.open = true
+	atomic.StoreInt32(&circuit.closedHealthy, 0)
+	atomic.StoreInt32(&circuit.probeSuccesses, 0)
+	atomic.StoreInt64(&circuit.decisionExpires, 0)
+	circuit.rollSleepWindowJitter()
+	close(circuit.opened)
+	circuit.countTransition()
+
+	callback.Invoke(circuit.Name, callback.Open)
+
+}
+
+// restoreOpen opens the circuit as of an earlier open or test time, such as one recorded by ExportState.
+func (circuit *CircuitBreaker) restoreOpen(openedOrLastTestedTime int64) {
+	circuit.mutex.Lock()
+	defer circuit.mutex.Unlock()
+
+	log.Printf("hystrix-go: restoring open circuit %v", circuit.Name)
+	atomic.StoreInt64(&circuit.openedOrLastTestedTime, openedOrLastTestedTime)
+	if circuit.open {
+		return
+	}
+	// time spent open before the state was exported was spent by another process
+	circuit.openedAt = clockNow()
 	circuit.open = true
+	atomic.StoreInt32(&circuit.closedHealthy, 0)
+	atomic.StoreInt32(&circuit.probeSuccesses, 0)
+	atomic.StoreInt64(&circuit.decisionExpires, 0)
+	circuit.rollSleepWindowJitter()
+	close(circuit.opened)
+	circuit.countTransition()
 
 	callback.Invoke(circuit.Name, callback.Open)
+}
+
+// openSignal returns a channel which is closed when the circuit next opens. While the circuit
+// is already open, such as during a test request, it returns nil.
+func (circuit *CircuitBreaker) openSignal() <-chan struct{} {
+	circuit.mutex.RLock()
+	defer circuit.mutex.RUnlock()
+
+	if circuit.open {
+		return nil
+	}
+	return circuit.opened
+}
+
+// rollSleepWindowJitter picks how far this opening's sleep window strays from the
+// configured one. It must be called with the circuit's mutex held for writing.
+func (circuit *CircuitBreaker) rollSleepWindowJitter() {
+	jitter := getSettings(circuit.Name).SleepWindowJitter
+	circuit.sleepWindowJitter = jitter * (2*rand.Float64() - 1)
+}
 
+// sleepWindow is how long the circuit waits after opening, or after a failed test,
+// before allowing another test. Each failed test in a row multiplies it by the
+// SleepWindowGrowth, up to the MaxSleepWindow. It must be called with the circuit's mutex held.
+func (circuit *CircuitBreaker) sleepWindow() time.Duration {
+	settings := getSettings(circuit.Name)
+	window := settings.SleepWindow
+	if failed := atomic.LoadInt32(&circuit.failedProbes); failed > 0 && settings.MaxSleepWindow > window {
+		grown := float64(window) * math.Pow(settings.SleepWindowGrowth, float64(failed))
+		window = time.Duration(math.Min(grown, float64(settings.MaxSleepWindow)))
+	}
+	return window + time.Duration(float64(window)*circuit.sleepWindowJitter)
 }
 
 func (circuit *CircuitBreaker) setClose() {
@@ -165,41 +708,315 @@ func (circuit *CircuitBreaker) setClose() {
 
 	log.Printf("hystrix-go: closing circuit %v", circuit.Name)
 
+	circuit.openDuration += clockNow().Sub(circuit.openedAt)
 	circuit.open = false
-	circuit.metrics.Reset()
+	atomic.StoreInt32(&circuit.probing, 0)
+	atomic.StoreInt32(&circuit.probeSuccesses, 0)
+	atomic.StoreInt32(&circuit.failedProbes, 0)
+	atomic.StoreInt64(&circuit.decisionExpires, 0)
+	circuit.opened = make(chan struct{})
+	atomic.StoreInt64(&circuit.consecutiveFailures, 0)
+	circuit.resetMetrics()
+	circuit.countTransition()
 
 	callback.Invoke(circuit.Name, callback.Close)
 
 }
 
+// countTransition counts the circuit opening or closing.
+func (circuit *CircuitBreaker) countTransition() {
+	circuit.transitions.Increment(1)
+	atomic.AddUint64(&circuit.lifetime.Transitions, 1)
+}
+
+// TransitionRate returns how many times a minute the circuit has opened or closed, judged by its
+// transitions within the rolling window. A circuit which flaps between the two, rather than staying
+// open while its backend is down, is a sign of settings which need tuning, such as too short a
+// SleepWindow. Transitions since the circuit was created are in its LifetimeCounts.
+func (circuit *CircuitBreaker) TransitionRate() float64 {
+	return circuit.transitions.Sum(clockNow()) * float64(time.Minute) / float64(metricsWindow)
+}
+
+// ActiveCount returns how many of the command's executions are in flight: started and not yet
+// finished, whether they are waiting for a ticket, running, or timed out with their run function
+// yet to return. CloseCommand fails while it is above zero, so it tells when a draining command's
+// executions have all finished.
+func (circuit *CircuitBreaker) ActiveCount() int {
+	return int(atomic.LoadInt64(&circuit.executing))
+}
+
+// MaxActive returns the most executions which held a ticket from the command's executor pool at
+// once within the rolling window, for sizing MaxConcurrentRequests by recent peaks. Commands
+// sharing a pool through Group report the peak of the whole group.
+func (circuit *CircuitBreaker) MaxActive() int {
+	return circuit.executorPool.MaxActive()
+}
+
+// DroppedMetricUpdates returns how many executions' metrics have been dropped, rather than holding
+// up the command, because the metric exchange couldn't keep up with them. While it grows, the
+// rolling metrics and metric collectors undercount the command's executions.
+func (circuit *CircuitBreaker) DroppedMetricUpdates() uint64 {
+	return atomic.LoadUint64(&circuit.droppedUpdates)
+}
+
+// OpenDuration returns the total time the circuit has spent open since it was created, including
+// the time since it last opened if it is open now.
+func (circuit *CircuitBreaker) OpenDuration() time.Duration {
+	circuit.mutex.RLock()
+	defer circuit.mutex.RUnlock()
+
+	d := circuit.openDuration
+	if circuit.open {
+		d += clockNow().Sub(circuit.openedAt)
+	}
+	return d
+}
+
+// Reset closes the circuit and discards its rolling metrics, as if it had just been created.
+func (circuit *CircuitBreaker) Reset() {
+	circuit.setClose()
+	atomic.StoreInt64(&circuit.consecutiveFailures, 0)
+	circuit.resetMetrics()
+}
+
+// resetMetrics discards the circuit's rolling metrics, and the counts standing in for them.
+func (circuit *CircuitBreaker) resetMetrics() {
+	circuit.metrics.Reset()
+	circuit.lite.reset()
+}
+
+// acquireFallback counts a fallback as running, unless MaxConcurrentFallbacks are running already,
+// in which case it returns false. A true result must be paired with releaseFallback.
+func (circuit *CircuitBreaker) acquireFallback() bool {
+	n := atomic.AddInt64(&circuit.fallbacks, 1)
+	if max := getSettings(circuit.Name).MaxConcurrentFallbacks; max > 0 && n > int64(max) {
+		atomic.AddInt64(&circuit.fallbacks, -1)
+		return false
+	}
+	return true
+}
+
+func (circuit *CircuitBreaker) releaseFallback() {
+	atomic.AddInt64(&circuit.fallbacks, -1)
+}
+
 // ReportEvent records command metrics for tracking recent error rates and exposing data to the dashboard.
 func (circuit *CircuitBreaker) ReportEvent(eventTypes []string, start time.Time, runDuration time.Duration) error {
+	return circuit.ReportWeightedEvent(eventTypes, start, runDuration, 1)
+}
+
+// ReportWeightedEvent records command metrics like ReportEvent, counting an error outcome as errorWeight
+// errors towards the error percentage. Weights of zero or less count as 1.
+func (circuit *CircuitBreaker) ReportWeightedEvent(eventTypes []string, start time.Time, runDuration time.Duration, errorWeight float64) error {
+	return circuit.reportExecution(&commandExecution{
+		Types:       eventTypes,
+		Start:       start,
+		RunDuration: runDuration,
+		ErrorWeight: errorWeight,
+	})
+}
+
+// reportExecution records the metrics of update, filling in its ConcurrencyInUse.
+func (circuit *CircuitBreaker) reportExecution(update *commandExecution) error {
+	eventTypes := update.Types
 	if len(eventTypes) == 0 {
 		return fmt.Errorf("no event types sent for metrics")
 	}
+	if atomic.LoadInt32(&circuit.closing) == commandClosed {
+		return nil
+	}
 
 	circuit.mutex.RLock()
 	o := circuit.open
 	circuit.mutex.RUnlock()
-	if eventTypes[0] == "success" && o {
+	if o {
+		eventTypes = circuit.reportProbe(eventTypes, update.probe, update.command)
+	}
+	if eventTypes[0] == "success" && o && circuit.recovered(eventTypes) {
 		circuit.setClose()
 	}
-
-	var concurrencyInUse float64
-	if circuit.executorPool.Max > 0 {
-		concurrencyInUse = float64(circuit.executorPool.ActiveCount()) / float64(circuit.executorPool.Max)
+	circuit.trackConsecutiveFailures(eventTypes[0])
+	circuit.countLifetime(eventTypes)
+
+	update.Types = eventTypes
+	update.ErrorWeight = math.Max(0, update.ErrorWeight)
+	if getSettings(circuit.Name).DisableMetrics {
+		// only what the circuit's health is judged by is counted
+		r := circuit.metrics.metricResult(update)
+		circuit.lite.record(clockNow(), r.Attempts, r.Errors)
+		circuit.refreshClosedHealthy()
+		return nil
+	}
+	if size := circuit.executorPool.size(); size > 0 {
+		update.ConcurrencyInUse = float64(circuit.executorPool.ActiveCount()) / float64(size)
+	}
+	if getSettings(circuit.Name).SyncMetrics {
+		circuit.metrics.apply(update)
+		return nil
 	}
 
 	select {
-	case circuit.metrics.Updates <- &commandExecution{
-		Types:            eventTypes,
-		Start:            start,
-		RunDuration:      runDuration,
-		ConcurrencyInUse: concurrencyInUse,
-	}:
+	case circuit.metrics.Updates <- update:
 	default:
+		atomic.AddUint64(&circuit.droppedUpdates, 1)
 		return CircuitError{Message: fmt.Sprintf("metrics channel (%v) is at capacity", circuit.Name)}
 	}
 
 	return nil
 }
+
+// reportProbe adds "probe-success" or "probe-failure" to the events of the execution which settles
+// the probe let through by allowSingleTest, so that probes can be told apart from other traffic.
+// probe is set when the execution is known to be the probe, in which case any other outcome, such
+// as a rejection or cancellation, ends the probe without settling it. A command's own execution
+// says whether it was the probe, so only events reported with ReportEvent, which don't, settle
+// the probe by whichever outcome is reported first; a command which started before the circuit
+// opened and finishes during the probe leaves it alone.
+func (circuit *CircuitBreaker) reportProbe(eventTypes []string, probe, command bool) []string {
+	var probeEvent string
+	switch eventTypes[0] {
+	case "success":
+		probeEvent = "probe-success"
+	case "failure", "timeout", "context_deadline_exceeded":
+		probeEvent = "probe-failure"
+	default:
+		if probe {
+			circuit.endProbe()
+		}
+		return eventTypes
+	}
+	if command && !probe {
+		return eventTypes
+	}
+	if !atomic.CompareAndSwapInt32(&circuit.probing, 1, 0) {
+		return eventTypes
+	}
+	if probeEvent == "probe-failure" {
+		atomic.StoreInt32(&circuit.probeSuccesses, 0)
+		atomic.AddInt32(&circuit.failedProbes, 1)
+	} else {
+		atomic.StoreInt32(&circuit.failedProbes, 0)
+	}
+	return append(eventTypes[:len(eventTypes):len(eventTypes)], probeEvent)
+}
+
+// endProbe lets allowSingleTest let another probe through once the sleep window allows, after the
+// probe in flight ended without settling whether the circuit has recovered.
+func (circuit *CircuitBreaker) endProbe() {
+	atomic.StoreInt32(&circuit.probing, 0)
+}
+
+// recovered reports whether a success while the circuit is open closes it. With the default
+// RequiredSuccessesToClose any success does; otherwise only the last of that many successful
+// probes in a row.
+func (circuit *CircuitBreaker) recovered(eventTypes []string) bool {
+	required := getSettings(circuit.Name).RequiredSuccessesToClose
+	if required <= 1 {
+		return true
+	}
+	for _, eventType := range eventTypes {
+		if eventType == "probe-success" {
+			return atomic.AddInt32(&circuit.probeSuccesses, 1) >= int32(required)
+		}
+	}
+	return false
+}
+
+// WouldCountAsFailure reports whether a command failing with err would count towards the
+// circuit's error percentage, classified as GoC classifies the errors which stop commands
+// succeeding: ErrTimeout counts unless the command's TimeoutsCountAsErrors is off, a canceled or
+// expired context doesn't count, and circuit errors such as ErrCircuitOpen count like any other
+// error. A nil err is a success. It helps to check, or debug, which errors trip the circuit.
+func (circuit *CircuitBreaker) WouldCountAsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return countsAsError(circuit.Name, errorEventType(err))
+}
+
+// ReportResult records the outcome of an execution which the caller ran itself, after AllowRequest
+// let it through. Together with AllowRequest it gives the circuit breaking of GoC to callers which
+// can't use its execution model; concurrency limits, timeouts and fallbacks are then up to the caller.
+//
+// Results are recorded like those of GoC, so misuse, such as reporting without asking AllowRequest
+// first, can't corrupt the rolling metrics. Each report is counted, though: a result reported more
+// than once is counted again each time, so callers which may repeat a report should dedupe it.
+func (circuit *CircuitBreaker) ReportResult(success bool, runDuration time.Duration) {
+	eventType := "failure"
+	if success {
+		eventType = "success"
+	}
+
+	err := circuit.ReportEvent([]string{eventType}, clockNow().Add(-runDuration), runDuration)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// LifetimeCounts are totals of a command's outcomes since its circuit was created. Unlike the
+// rolling metrics, they only ever grow, until the circuit is removed by Flush.
+type LifetimeCounts struct {
+	Successes         uint64
+	Failures          uint64
+	Timeouts          uint64
+	Rejects           uint64
+	ShortCircuits     uint64
+	FallbackSuccesses uint64
+	FallbackFailures  uint64
+	// Transitions counts the circuit opening and closing.
+	Transitions uint64
+}
+
+// LifetimeCounts returns the command's totals since its circuit was created.
+func (circuit *CircuitBreaker) LifetimeCounts() LifetimeCounts {
+	return LifetimeCounts{
+		Successes:         atomic.LoadUint64(&circuit.lifetime.Successes),
+		Failures:          atomic.LoadUint64(&circuit.lifetime.Failures),
+		Timeouts:          atomic.LoadUint64(&circuit.lifetime.Timeouts),
+		Rejects:           atomic.LoadUint64(&circuit.lifetime.Rejects),
+		ShortCircuits:     atomic.LoadUint64(&circuit.lifetime.ShortCircuits),
+		FallbackSuccesses: atomic.LoadUint64(&circuit.lifetime.FallbackSuccesses),
+		FallbackFailures:  atomic.LoadUint64(&circuit.lifetime.FallbackFailures),
+		Transitions:       atomic.LoadUint64(&circuit.lifetime.Transitions),
+	}
+}
+
+func (circuit *CircuitBreaker) countLifetime(eventTypes []string) {
+	for _, eventType := range eventTypes {
+		var counter *uint64
+		switch eventType {
+		case "success":
+			counter = &circuit.lifetime.Successes
+		case "failure":
+			counter = &circuit.lifetime.Failures
+		case "timeout":
+			counter = &circuit.lifetime.Timeouts
+		case "rejected":
+			counter = &circuit.lifetime.Rejects
+		case "short-circuit":
+			counter = &circuit.lifetime.ShortCircuits
+		case "fallback-success":
+			counter = &circuit.lifetime.FallbackSuccesses
+		case "fallback-failure":
+			counter = &circuit.lifetime.FallbackFailures
+		default:
+			continue
+		}
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// trackConsecutiveFailures counts executions in a row which count as errors, opening the circuit
+// once the configured ConsecutiveFailureThreshold is reached. Any success resets the count.
+func (circuit *CircuitBreaker) trackConsecutiveFailures(eventType string) {
+	switch {
+	case eventType == "success":
+		atomic.StoreInt64(&circuit.consecutiveFailures, 0)
+	case countsAsError(circuit.Name, eventType):
+		failures := atomic.AddInt64(&circuit.consecutiveFailures, 1)
+		threshold := getSettings(circuit.Name).ConsecutiveFailureThreshold
+		if threshold > 0 && failures >= int64(threshold) && !circuit.warmingUp() {
+			circuit.setOpen()
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package hystrix
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,6 +15,24 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestGetCircuit(t *testing.T) {
 	defer Flush()
 
@@ -33,6 +54,121 @@ func TestGetCircuit(t *testing.T) {
 	})
 }
 
+func TestCommandNames(t *testing.T) {
+	Convey("when commands have been used", t, func() {
+		Flush()
+		defer Flush()
+
+		ConfigureCommand("configured", CommandConfig{})
+		Do("zeta", func() error { return nil }, nil)
+		Do("alpha", func() error { return nil }, nil)
+
+		Convey("CommandNames lists them in order", func() {
+			So(CommandNames(), ShouldResemble, []string{"alpha", "zeta"})
+		})
+
+		Convey("ForEachCircuit visits each of them", func() {
+			visited := make(map[string]*CircuitBreaker)
+			ForEachCircuit(func(name string, c *CircuitBreaker) {
+				visited[name] = c
+			})
+
+			So(len(visited), ShouldEqual, 2)
+			So(visited["alpha"].Name, ShouldEqual, "alpha")
+			So(visited["zeta"].Name, ShouldEqual, "zeta")
+		})
+	})
+}
+
+func TestPrewarmCommands(t *testing.T) {
+	Convey("when commands are prewarmed", t, func() {
+		defer Flush()
+
+		ConfigureCommand("prewarmed", CommandConfig{MaxConcurrentRequests: 3})
+		PrewarmCommands("prewarmed", "other")
+
+		Convey("their circuits exist before any execution, with their configured pools", func() {
+			So(CommandNames(), ShouldResemble, []string{"other", "prewarmed"})
+
+			cb, created, _ := GetCircuit("prewarmed")
+			So(created, ShouldBeFalse)
+			So(cb.executorPool.Max, ShouldEqual, 3)
+		})
+
+		Convey("prewarming them again keeps the same circuits", func() {
+			cb, _, _ := GetCircuit("prewarmed")
+			PrewarmCommands("prewarmed")
+
+			again, _, _ := GetCircuit("prewarmed")
+			So(again, ShouldEqual, cb)
+		})
+	})
+}
+
+func TestCloseCommand(t *testing.T) {
+	Convey("when a command is closed", t, func() {
+		defer Flush()
+
+		ConfigureCommand("closing", CommandConfig{Timeout: 5000})
+		cb, _, _ := GetCircuit("closing")
+
+		Convey("while an execution is in flight, it fails", func() {
+			release := make(chan struct{})
+			Go("closing", func() error {
+				<-release
+				return nil
+			}, nil)
+			time.Sleep(10 * time.Millisecond)
+
+			So(CloseCommand("closing"), ShouldNotBeNil)
+			So(CommandNames(), ShouldContain, "closing")
+			close(release)
+
+			Convey("and succeeds once it is done", func() {
+				time.Sleep(10 * time.Millisecond)
+				So(CloseCommand("closing"), ShouldBeNil)
+			})
+		})
+
+		Convey("while an execution is waiting for a ticket, it fails", func() {
+			ConfigureCommand("closing", CommandConfig{Timeout: 5000, MaxConcurrentRequests: 1, MaxQueueWait: 5000})
+			ticket := cb.executorPool.tryAcquire()
+			done := make(chan error, 1)
+			go func() {
+				done <- Do("closing", func() error { return nil }, nil)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			So(CloseCommand("closing"), ShouldNotBeNil)
+			cb.executorPool.put(ticket)
+			So(<-done, ShouldBeNil)
+
+			Convey("and succeeds once it has run", func() {
+				time.Sleep(10 * time.Millisecond)
+				So(CloseCommand("closing"), ShouldBeNil)
+			})
+		})
+
+		Convey("when idle, it is forgotten and its goroutines stop", func() {
+			So(CloseCommand("closing"), ShouldBeNil)
+			So(CommandNames(), ShouldNotContain, "closing")
+			So(GetCircuitSettings()["closing"], ShouldBeNil)
+
+			select {
+			case <-cb.metrics.done:
+			default:
+				t.Fatal("metric exchange was not closed")
+			}
+
+			Convey("and a late report doesn't block, and is dropped", func() {
+				So(cb.ReportEvent([]string{"success"}, time.Now(), 0), ShouldBeNil)
+				So(len(cb.metrics.Updates), ShouldEqual, 0)
+				cb.executorPool.Return(<-cb.executorPool.Tickets)
+			})
+		})
+	})
+}
+
 func TestMultithreadedGetCircuit(t *testing.T) {
 	defer Flush()
 
@@ -71,6 +207,41 @@ func TestMultithreadedGetCircuit(t *testing.T) {
 	})
 }
 
+func TestGetCircuitThunderingHerd(t *testing.T) {
+	Convey("when 1000 goroutines get a new circuit at once", t, func() {
+		defer Flush()
+		numGoroutines := 1000
+		circuits := make([]*CircuitBreaker, numGoroutines)
+		var numCreates int32
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(numGoroutines)
+		for i := 0; i < numGoroutines; i++ {
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				cb, created, _ := GetCircuit("herd")
+				if created {
+					atomic.AddInt32(&numCreates, 1)
+				}
+				circuits[i] = cb
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		Convey("exactly one circuit is created, and all of them get it", func() {
+			So(numCreates, ShouldEqual, 1)
+			same := true
+			for _, cb := range circuits {
+				same = same && cb == circuits[0]
+			}
+			So(same, ShouldBeTrue)
+			So(CommandNames(), ShouldResemble, []string{"herd"})
+		})
+	})
+}
+
 func TestReportEventOpenThenClose(t *testing.T) {
 	Convey("when a circuit is closed", t, func() {
 		defer Flush()
@@ -98,6 +269,792 @@ func TestReportEventOpenThenClose(t *testing.T) {
 	})
 }
 
+func TestConsecutiveFailures(t *testing.T) {
+	Convey("when a circuit opens after 3 consecutive failures", t, func() {
+		defer Flush()
+
+		ConfigureCommand("consecutive", CommandConfig{ConsecutiveFailureThreshold: 3})
+		cb, _, err := GetCircuit("consecutive")
+		So(err, ShouldBeNil)
+
+		Convey("and 2 failures are reported", func() {
+			cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+			cb.ReportEvent([]string{"timeout"}, time.Now(), 0)
+
+			Convey("the circuit stays closed", func() {
+				So(cb.IsOpen(), ShouldBeFalse)
+			})
+
+			Convey("a success resets the count", func() {
+				cb.ReportEvent([]string{"success"}, time.Now(), 0)
+				cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+				cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+				So(cb.IsOpen(), ShouldBeFalse)
+			})
+
+			Convey("a third failure opens the circuit even below the volume threshold", func() {
+				cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+				So(cb.IsOpen(), ShouldBeTrue)
+
+				Convey("and closing the circuit resets the count", func() {
+					cb.setClose()
+					cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+					So(cb.IsOpen(), ShouldBeFalse)
+				})
+			})
+		})
+
+		Convey("timeouts don't count when they aren't errors", func() {
+			countTimeouts := false
+			ConfigureCommand("consecutive", CommandConfig{ConsecutiveFailureThreshold: 3, TimeoutsCountAsErrors: &countTimeouts})
+			for i := 0; i < 3; i++ {
+				cb.ReportEvent([]string{"timeout"}, time.Now(), 0)
+			}
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestAllowRequestFastPath(t *testing.T) {
+	Convey("when a healthy circuit has processed its metrics", t, func() {
+		defer Flush()
+
+		ConfigureCommand("fast_path", CommandConfig{RequestVolumeThreshold: 10, ErrorPercentThreshold: 50})
+		cb, _, _ := GetCircuit("fast_path")
+		cb.ReportEvent([]string{"success"}, time.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("AllowRequest takes the fast path", func() {
+			So(atomic.LoadInt32(&cb.closedHealthy), ShouldEqual, int32(1))
+			So(cb.AllowRequest(), ShouldBeTrue)
+		})
+
+		Convey("failures clear the fast path once processed", func() {
+			for i := 0; i < 20; i++ {
+				cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			So(atomic.LoadInt32(&cb.closedHealthy), ShouldEqual, int32(0))
+			So(cb.AllowRequest(), ShouldBeFalse)
+		})
+
+		Convey("forcing the circuit open clears the fast path immediately", func() {
+			cb.toggleForceOpen(true)
+			So(cb.AllowRequest(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestDecisionCacheTTL(t *testing.T) {
+	Convey("with a circuit caching its decisions for 10 seconds", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		ConfigureCommand("decision_cache", CommandConfig{DecisionCacheTTL: 10000, SleepWindow: 1000, RequestVolumeThreshold: 10})
+		defer ConfigureCommand("decision_cache", CommandConfig{})
+		cb, _, _ := GetCircuit("decision_cache")
+		So(cb.AllowRequest(), ShouldBeTrue)
+
+		Convey("unhealthy metrics aren't noticed until the decision expires", func() {
+			cb.Metrics().NumRequests().Increment(20)
+			cb.Metrics().Errors().Increment(20)
+			So(cb.AllowRequest(), ShouldBeTrue)
+
+			clock.advance(11 * time.Second)
+			cb.Metrics().NumRequests().Increment(20)
+			cb.Metrics().Errors().Increment(20)
+			So(cb.AllowRequest(), ShouldBeFalse)
+
+			Convey("but a recovery test is let through after the sleep window", func() {
+				clock.advance(2 * time.Second)
+				So(cb.AllowRequest(), ShouldBeTrue)
+			})
+		})
+
+		Convey("opening the circuit takes effect at once", func() {
+			cb.setOpen()
+			So(cb.AllowRequest(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestLatencyThreshold(t *testing.T) {
+	Convey("with a command tripped by a p90 run duration over 100ms", t, func() {
+		defer Flush()
+		ConfigureCommand("latency", CommandConfig{LatencyThreshold: 100, LatencyPercentile: 90, RequestVolumeThreshold: 10})
+		defer ConfigureCommand("latency", CommandConfig{})
+		cb, _, _ := GetCircuit("latency")
+
+		Convey("slow successes open the circuit", func() {
+			for i := 0; i < 10; i++ {
+				cb.ReportEvent([]string{"success"}, time.Now(), 200*time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+
+		Convey("fast successes don't", func() {
+			for i := 0; i < 10; i++ {
+				cb.ReportEvent([]string{"success"}, time.Now(), 10*time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+
+		Convey("fast failures still open it by their error percentage", func() {
+			for i := 0; i < 10; i++ {
+				cb.ReportEvent([]string{"failure"}, time.Now(), 10*time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+	})
+
+	Convey("without a latency threshold, slow successes don't open the circuit", t, func() {
+		defer Flush()
+		ConfigureCommand("latency", CommandConfig{RequestVolumeThreshold: 10})
+		defer ConfigureCommand("latency", CommandConfig{})
+		cb, _, _ := GetCircuit("latency")
+
+		for i := 0; i < 10; i++ {
+			cb.ReportEvent([]string{"success"}, time.Now(), 10*time.Second)
+		}
+		time.Sleep(50 * time.Millisecond)
+		So(cb.IsOpen(), ShouldBeFalse)
+	})
+}
+
+func TestMetricsResetInterval(t *testing.T) {
+	Convey("when a command resets its metrics every 100ms", t, func() {
+		defer Flush()
+
+		ConfigureCommand("metrics_reset", CommandConfig{MetricsResetInterval: 100})
+		cb, _, _ := GetCircuit("metrics_reset")
+
+		for i := 0; i < 5; i++ {
+			cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+		}
+		time.Sleep(20 * time.Millisecond)
+		So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 5)
+
+		Convey("the metrics are discarded without changing the circuit's state", func() {
+			time.Sleep(150 * time.Millisecond)
+			So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 0)
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+
+		Convey("flushing stops the resets", func() {
+			Flush()
+			select {
+			case <-cb.flushed:
+			default:
+				t.Fatal("circuit was not flushed")
+			}
+		})
+	})
+}
+
+func TestReportResult(t *testing.T) {
+	Convey("when a caller gates and reports its own executions", t, func() {
+		defer Flush()
+
+		ConfigureCommand("manual", CommandConfig{RequestVolumeThreshold: 2, ErrorPercentThreshold: 50})
+		cb, _, _ := GetCircuit("manual")
+
+		So(cb.AllowRequest(), ShouldBeTrue)
+		cb.ReportResult(true, 10*time.Millisecond)
+		cb.ReportResult(false, 10*time.Millisecond)
+		cb.ReportResult(false, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("the results are counted", func() {
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 2)
+		})
+
+		Convey("and failures open the circuit", func() {
+			So(cb.AllowRequest(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestWarmupDuration(t *testing.T) {
+	Convey("when a circuit has a 1 minute warmup", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		ConfigureCommand("warmup", CommandConfig{WarmupDuration: 60000, RequestVolumeThreshold: 1, ConsecutiveFailureThreshold: 1})
+		cb, _, _ := GetCircuit("warmup")
+		cb.Metrics().NumRequests().Increment(10)
+		cb.Metrics().Errors().Increment(10)
+		cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+
+		Convey("errors don't open it while warming up", func() {
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+
+		Convey("errors open it once the warmup is over", func() {
+			clock.advance(61 * time.Second)
+			cb.Metrics().NumRequests().Increment(10)
+			cb.Metrics().Errors().Increment(10)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLifetimeCounts(t *testing.T) {
+	Convey("when a circuit's metrics are reset", t, func() {
+		defer Flush()
+
+		cb, _, _ := GetCircuit("lifetime")
+		cb.ReportEvent([]string{"success"}, time.Now(), 0)
+		cb.ReportEvent([]string{"failure", "fallback-success"}, time.Now(), 0)
+		cb.ReportEvent([]string{"timeout", "fallback-failure"}, time.Now(), 0)
+		cb.Reset()
+
+		Convey("its lifetime counts remain", func() {
+			So(cb.LifetimeCounts(), ShouldResemble, LifetimeCounts{
+				Successes:         1,
+				Failures:          1,
+				Timeouts:          1,
+				FallbackSuccesses: 1,
+				FallbackFailures:  1,
+			})
+		})
+	})
+}
+
+func TestDebugMetrics(t *testing.T) {
+	Convey("when failures are spread over two seconds", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Unix(1000000, 0)}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("debug_metrics")
+		cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+		cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+		clock.advance(time.Second)
+		cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("each second's failures are in its own bucket", func() {
+			buckets := cb.DebugMetrics()["failure"]
+			So(len(buckets), ShouldEqual, 2)
+			So(buckets[0].Value, ShouldEqual, 2)
+			So(buckets[1].Value, ShouldEqual, 1)
+			So(buckets[1].Time, ShouldEqual, clock.Now())
+		})
+	})
+}
+
+func TestCloseCircuit(t *testing.T) {
+	Convey("with a circuit opened by failures", t, func() {
+		defer Flush()
+		ConfigureCommand("close_circuit", CommandConfig{RequestVolumeThreshold: 10})
+		defer ConfigureCommand("close_circuit", CommandConfig{})
+		cb, _, _ := GetCircuit("close_circuit")
+		fail := func() {
+			for i := 0; i < 20; i++ {
+				cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		fail()
+		So(cb.IsOpen(), ShouldBeTrue)
+
+		Convey("closing it forgets the failures", func() {
+			CloseCircuit("close_circuit")
+			So(cb.IsOpen(), ShouldBeFalse)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			So(cb.Metrics().ErrorCount(time.Now()), ShouldEqual, 0)
+
+			Convey("and leaves it to open again by itself", func() {
+				fail()
+				So(cb.IsOpen(), ShouldBeTrue)
+			})
+		})
+
+		Convey("closing an unknown command does nothing", func() {
+			CloseCircuit("unknown")
+			So(CommandNames(), ShouldNotContain, "unknown")
+		})
+	})
+}
+
+func TestDisableMetrics(t *testing.T) {
+	Convey("with a command without metrics", t, func() {
+		defer Flush()
+		ConfigureCommand("no_metrics", CommandConfig{DisableMetrics: true, RequestVolumeThreshold: 10})
+		defer ConfigureCommand("no_metrics", CommandConfig{})
+		cb, _, _ := GetCircuit("no_metrics")
+
+		Convey("successes keep its circuit closed and aren't counted in its metrics", func() {
+			for i := 0; i < 20; i++ {
+				Do("no_metrics", func() error { return nil }, nil)
+			}
+			time.Sleep(50 * time.Millisecond)
+			So(cb.IsOpen(), ShouldBeFalse)
+			So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 0)
+
+			Convey("while enough failures still open it", func() {
+				for i := 0; i < 19; i++ {
+					Do("no_metrics", func() error { return fmt.Errorf("failed") }, nil)
+				}
+				So(cb.IsOpen(), ShouldBeFalse)
+				for i := 0; i < 2; i++ {
+					Do("no_metrics", func() error { return fmt.Errorf("failed") }, nil)
+				}
+				So(cb.IsOpen(), ShouldBeTrue)
+				So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("with a healthy command whose metrics are then disabled", t, func() {
+		defer Flush()
+		ConfigureCommand("lite_healthy", CommandConfig{RequestVolumeThreshold: 10})
+		defer ConfigureCommand("lite_healthy", CommandConfig{})
+		cb, _, _ := GetCircuit("lite_healthy")
+		for i := 0; i < 20; i++ {
+			Do("lite_healthy", func() error { return nil }, nil)
+		}
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&cb.closedHealthy), ShouldEqual, 1)
+
+		ConfigureCommand("lite_healthy", CommandConfig{DisableMetrics: true, RequestVolumeThreshold: 10})
+
+		Convey("enough failures stop it allowing requests", func() {
+			for i := 0; i < 20; i++ {
+				Do("lite_healthy", func() error { return fmt.Errorf("failed") }, nil)
+			}
+			So(cb.AllowRequest(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestOpenDuration(t *testing.T) {
+	Convey("when a circuit opens for 3 seconds and closes", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("open_duration")
+		cb.setOpen()
+		clock.advance(3 * time.Second)
+		cb.setClose()
+		clock.advance(10 * time.Second)
+
+		Convey("its open duration is 3 seconds", func() {
+			So(cb.OpenDuration(), ShouldEqual, 3*time.Second)
+		})
+
+		Convey("while it is open again, the time since it opened is included", func() {
+			cb.setOpen()
+			clock.advance(2 * time.Second)
+			So(cb.OpenDuration(), ShouldEqual, 5*time.Second)
+		})
+	})
+}
+
+func TestDroppedMetricUpdates(t *testing.T) {
+	Convey("when the metric exchange can't keep up", t, func() {
+		defer Flush()
+		cb, _, _ := GetCircuit("dropped")
+		// holding the lock stalls the exchange's collectors, so updates pile up
+		cb.metrics.Mutex.Lock()
+		var reportErr error
+		for i := 0; i < 10000 && reportErr == nil; i++ {
+			reportErr = cb.ReportEvent([]string{"success"}, time.Now(), 0)
+		}
+		cb.metrics.Mutex.Unlock()
+
+		Convey("the updates which don't fit are dropped and counted", func() {
+			So(reportErr, ShouldNotBeNil)
+			So(cb.DroppedMetricUpdates(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestSleepWindowJitter(t *testing.T) {
+	Convey("when a circuit has a 1 second sleep window", t, func() {
+		defer Flush()
+
+		Convey("without jitter, every opening waits exactly the sleep window", func() {
+			ConfigureCommand("jitter", CommandConfig{SleepWindow: 1000})
+			cb, _, _ := GetCircuit("jitter")
+			cb.setOpen()
+			So(cb.sleepWindow(), ShouldEqual, time.Second)
+		})
+
+		Convey("with 20% jitter, openings wait between 0.8 and 1.2 seconds and vary", func() {
+			ConfigureCommand("jitter", CommandConfig{SleepWindow: 1000, SleepWindowJitter: 0.2})
+			cb, _, _ := GetCircuit("jitter")
+
+			windows := make(map[time.Duration]bool)
+			for i := 0; i < 20; i++ {
+				cb.setOpen()
+				window := cb.sleepWindow()
+				So(window, ShouldBeBetweenOrEqual, 800*time.Millisecond, 1200*time.Millisecond)
+				windows[window] = true
+				cb.setClose()
+			}
+			So(len(windows), ShouldBeGreaterThan, 1)
+		})
+	})
+}
+
+func TestProbeMetrics(t *testing.T) {
+	Convey("with an open circuit", t, func() {
+		defer Flush()
+		ConfigureCommand("probe", CommandConfig{SleepWindow: 1000})
+		defer ConfigureCommand("probe", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("probe")
+		cb.setOpen()
+		probes := func() (float64, float64) {
+			time.Sleep(50 * time.Millisecond)
+			return cb.Metrics().ProbeSuccessCount(clock.Now()), cb.Metrics().ProbeFailureCount(clock.Now())
+		}
+
+		Convey("a failed probe is counted as one", func() {
+			clock.advance(2 * time.Second)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+
+			successes, failures := probes()
+			So(successes, ShouldEqual, 0)
+			So(failures, ShouldEqual, 1)
+
+			Convey("and the next successful probe closes the circuit", func() {
+				clock.advance(2 * time.Second)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+
+				successes, _ := probes()
+				So(successes, ShouldEqual, 1)
+				So(cb.IsOpen(), ShouldBeFalse)
+			})
+		})
+
+		Convey("a probe which is rejected ends without being counted", func() {
+			ConfigureCommand("probe", CommandConfig{SleepWindow: 1000, MaxConcurrentRequests: 1})
+			ticket := cb.executorPool.tryAcquire()
+			defer cb.executorPool.put(ticket)
+			clock.advance(2 * time.Second)
+			err := Do("probe", func() error { return nil }, nil)
+			So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+
+			successes, failures := probes()
+			So(successes, ShouldEqual, 0)
+			So(failures, ShouldEqual, 0)
+			So(atomic.LoadInt32(&cb.probing), ShouldEqual, 0)
+			So(cb.State(), ShouldEqual, CircuitOpen)
+		})
+
+		Convey("a probe which is canceled ends without being counted", func() {
+			clock.advance(2 * time.Second)
+			ctx, cancel := context.WithCancel(context.Background())
+			err := DoC(ctx, "probe", func(ctx context.Context) error {
+				cancel()
+				return ctx.Err()
+			}, nil)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+			probes()
+			So(atomic.LoadInt32(&cb.probing), ShouldEqual, 0)
+			So(cb.State(), ShouldEqual, CircuitOpen)
+		})
+
+		Convey("an execution which wasn't let through as a probe isn't counted", func() {
+			cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+
+			successes, failures := probes()
+			So(successes, ShouldEqual, 0)
+			So(failures, ShouldEqual, 0)
+		})
+	})
+
+	Convey("with an execution in flight when the circuit opens", t, func() {
+		defer Flush()
+		ConfigureCommand("straggler", CommandConfig{Timeout: 10000, SleepWindow: 1000, RequiredSuccessesToClose: 2})
+		defer ConfigureCommand("straggler", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		execute := func(release chan struct{}, err error) chan struct{} {
+			finished := make(chan struct{})
+			go func() {
+				Do("straggler", func() error {
+					<-release
+					return err
+				}, nil)
+				close(finished)
+			}()
+			time.Sleep(20 * time.Millisecond)
+			return finished
+		}
+		releaseStraggler := make(chan struct{})
+		straggler := execute(releaseStraggler, nil)
+		cb, _, _ := GetCircuit("straggler")
+		cb.setOpen()
+		clock.advance(2 * time.Second)
+		releaseProbe := make(chan struct{})
+		probe := execute(releaseProbe, fmt.Errorf("still failing"))
+
+		Convey("its success during the probe doesn't settle the probe", func() {
+			close(releaseStraggler)
+			<-straggler
+			time.Sleep(50 * time.Millisecond)
+			So(cb.Metrics().ProbeSuccessCount(clock.Now()), ShouldEqual, 0)
+			So(atomic.LoadInt32(&cb.probing), ShouldEqual, 1)
+			So(atomic.LoadInt32(&cb.probeSuccesses), ShouldEqual, 0)
+
+			Convey("while the probe's failure does", func() {
+				close(releaseProbe)
+				<-probe
+				time.Sleep(50 * time.Millisecond)
+				So(cb.Metrics().ProbeFailureCount(clock.Now()), ShouldEqual, 1)
+				So(atomic.LoadInt32(&cb.failedProbes), ShouldEqual, 1)
+				So(atomic.LoadInt32(&cb.probing), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("executions of a closed circuit aren't probes", t, func() {
+		defer Flush()
+		cb, _, _ := GetCircuit("probe")
+		cb.ReportEvent([]string{"success"}, time.Now(), 0)
+		cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+
+		So(cb.Metrics().ProbeSuccessCount(time.Now()), ShouldEqual, 0)
+		So(cb.Metrics().ProbeFailureCount(time.Now()), ShouldEqual, 0)
+	})
+}
+
+func TestRequiredSuccessesToClose(t *testing.T) {
+	Convey("with an open circuit which needs 3 successful probes to close", t, func() {
+		defer Flush()
+		ConfigureCommand("probes_to_close", CommandConfig{SleepWindow: 1000, RequiredSuccessesToClose: 3})
+		defer ConfigureCommand("probes_to_close", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("probes_to_close")
+		cb.setOpen()
+		clock.advance(2 * time.Second)
+		So(cb.AllowRequest(), ShouldBeTrue)
+		cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+
+		Convey("a successful probe leaves it half-open, letting the next probe through at once", func() {
+			So(cb.IsOpen(), ShouldBeTrue)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			So(cb.AllowRequest(), ShouldBeFalse)
+
+			Convey("and the third successful probe closes it", func() {
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+				So(cb.IsOpen(), ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+				So(cb.IsOpen(), ShouldBeFalse)
+			})
+
+			Convey("while a failed probe waits out another sleep window and starts the count again", func() {
+				cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+				So(cb.IsOpen(), ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeFalse)
+
+				clock.advance(2 * time.Second)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+				So(cb.IsOpen(), ShouldBeTrue)
+			})
+		})
+
+		Convey("a success which wasn't a probe doesn't count", func() {
+			cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestMaxSleepWindow(t *testing.T) {
+	Convey("with an open circuit whose sleep window may grow from 1s to 3s", t, func() {
+		defer Flush()
+		ConfigureCommand("growing_sleep", CommandConfig{SleepWindow: 1000, MaxSleepWindow: 3000})
+		defer ConfigureCommand("growing_sleep", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("growing_sleep")
+		cb.setOpen()
+		failProbe := func(wait time.Duration) {
+			clock.advance(wait - time.Millisecond)
+			So(cb.AllowRequest(), ShouldBeFalse)
+			clock.advance(2 * time.Millisecond)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+		}
+
+		Convey("each failed probe doubles the wait for the next, up to the cap", func() {
+			failProbe(time.Second)
+			failProbe(2 * time.Second)
+			failProbe(3 * time.Second)
+			failProbe(3 * time.Second)
+
+			Convey("and a successful probe brings it back to the sleep window", func() {
+				clock.advance(4 * time.Second)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+				So(cb.IsOpen(), ShouldBeFalse)
+
+				cb.setOpen()
+				failProbe(time.Second)
+			})
+		})
+	})
+
+	Convey("by default the sleep window stays the same after failed probes", t, func() {
+		defer Flush()
+		ConfigureCommand("constant_sleep", CommandConfig{SleepWindow: 1000, SleepWindowGrowth: 3})
+		defer ConfigureCommand("constant_sleep", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+
+		cb, _, _ := GetCircuit("constant_sleep")
+		cb.setOpen()
+		for i := 0; i < 3; i++ {
+			clock.advance(1001 * time.Millisecond)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+		}
+	})
+}
+
+func TestCircuitState(t *testing.T) {
+	Convey("with a circuit whose sleep window is a second", t, func() {
+		defer Flush()
+		ConfigureCommand("state", CommandConfig{SleepWindow: 1000})
+		defer ConfigureCommand("state", CommandConfig{})
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+		cb, _, _ := GetCircuit("state")
+
+		Convey("it starts closed", func() {
+			So(cb.State(), ShouldEqual, CircuitClosed)
+		})
+
+		Convey("once opened it is open within the sleep window", func() {
+			cb.setOpen()
+			So(cb.State(), ShouldEqual, CircuitOpen)
+
+			Convey("and half-open after it, while its probe is in flight", func() {
+				clock.advance(2 * time.Second)
+				So(cb.State(), ShouldEqual, CircuitHalfOpen)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.State(), ShouldEqual, CircuitHalfOpen)
+
+				Convey("open again if the probe fails", func() {
+					cb.ReportEvent([]string{"failure"}, clock.Now(), 0)
+					So(cb.State(), ShouldEqual, CircuitOpen)
+				})
+
+				Convey("and closed if it succeeds", func() {
+					cb.ReportEvent([]string{"success"}, clock.Now(), 0)
+					So(cb.State(), ShouldEqual, CircuitClosed)
+				})
+			})
+		})
+
+		Convey("forced open it is open whatever its sleep window", func() {
+			cb.toggleForceOpen(true)
+			clock.advance(2 * time.Second)
+			So(cb.State(), ShouldEqual, CircuitOpen)
+		})
+	})
+
+	Convey("states are named for metrics and logs", t, func() {
+		So(CircuitClosed.String(), ShouldEqual, "closed")
+		So(CircuitOpen.String(), ShouldEqual, "open")
+		So(CircuitHalfOpen.String(), ShouldEqual, "half-open")
+	})
+}
+
+func TestTransitionRate(t *testing.T) {
+	Convey("when a circuit opens, closes and opens again", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+		cb, _, _ := GetCircuit("flapping")
+		cb.setOpen()
+		cb.setOpen()
+		clock.advance(time.Second)
+		cb.setClose()
+		cb.setOpen()
+
+		Convey("each transition is counted once", func() {
+			So(cb.LifetimeCounts().Transitions, ShouldEqual, 3)
+		})
+
+		Convey("its rate is 3 in the 10 second window, or 18 a minute", func() {
+			So(cb.TransitionRate(), ShouldEqual, 18)
+		})
+
+		Convey("it falls to zero once they leave the window, while the total stays", func() {
+			clock.advance(11 * time.Second)
+			So(cb.TransitionRate(), ShouldEqual, 0)
+			So(cb.LifetimeCounts().Transitions, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestWouldCountAsFailure(t *testing.T) {
+	Convey("with a circuit", t, func() {
+		defer Flush()
+		cb, _, _ := GetCircuit("would_count")
+
+		Convey("errors from run and circuit errors count", func() {
+			So(cb.WouldCountAsFailure(fmt.Errorf("failed")), ShouldBeTrue)
+			So(cb.WouldCountAsFailure(ErrCircuitOpen), ShouldBeTrue)
+			So(cb.WouldCountAsFailure(ErrMaxConcurrency), ShouldBeTrue)
+			So(cb.WouldCountAsFailure(ErrTimeout), ShouldBeTrue)
+		})
+
+		Convey("successes and the caller giving up don't", func() {
+			So(cb.WouldCountAsFailure(nil), ShouldBeFalse)
+			So(cb.WouldCountAsFailure(context.Canceled), ShouldBeFalse)
+			So(cb.WouldCountAsFailure(fmt.Errorf("request: %w", context.Canceled)), ShouldBeFalse)
+			So(cb.WouldCountAsFailure(context.DeadlineExceeded), ShouldBeFalse)
+		})
+
+		Convey("timeouts don't when the command leaves them out", func() {
+			leaveOut := false
+			ConfigureCommand("would_count", CommandConfig{TimeoutsCountAsErrors: &leaveOut})
+			defer ConfigureCommand("would_count", CommandConfig{})
+			So(cb.WouldCountAsFailure(ErrTimeout), ShouldBeFalse)
+		})
+	})
+}
+
 func TestReportEventMultiThreaded(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 	run := func() bool {
@@ -0,0 +1,21 @@
+package hystrix
+
+import (
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix/rolling"
+)
+
+// Clock tells the time used for circuit sleep windows and rolling metrics.
+type Clock = rolling.Clock
+
+// SetClock replaces the clock behind circuit sleep windows and rolling metrics, so that tests
+// can advance time without sleeping. Command timeouts still follow the real time.
+// A nil Clock restores the real time.
+func SetClock(c Clock) {
+	rolling.SetClock(c)
+}
+
+func clockNow() time.Time {
+	return rolling.Now()
+}
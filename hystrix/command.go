@@ -0,0 +1,45 @@
+package hystrix
+
+import "context"
+
+// CommandExecutor executes a single command, such as a *Command. Depend on it rather than on
+// *Command to replace the command with a fake in tests.
+type CommandExecutor interface {
+	// Execute runs the command like DoC, returning once it has finished.
+	Execute(ctx context.Context, run func(context.Context) error, fallback func(context.Context, error) error) error
+	// Go runs the command like GoC, returning a channel of errors.
+	Go(ctx context.Context, run func(context.Context) error, fallback func(context.Context, error) error) chan error
+}
+
+// Command is a handle on a configured command, for passing around in place of its name and
+// settings.
+//
+//	payments := hystrix.NewCommand("payments", hystrix.CommandConfig{Timeout: 500})
+//	err := payments.Execute(ctx, charge, nil)
+type Command struct {
+	name string
+}
+
+var _ CommandExecutor = (*Command)(nil)
+
+// NewCommand configures the named command with config, like ConfigureCommand, and returns a
+// handle for executing it.
+func NewCommand(name string, config CommandConfig) *Command {
+	ConfigureCommand(name, config)
+	return &Command{name: name}
+}
+
+// Name returns the command's name.
+func (c *Command) Name() string {
+	return c.name
+}
+
+// Execute runs the command like DoC.
+func (c *Command) Execute(ctx context.Context, run func(context.Context) error, fallback func(context.Context, error) error) error {
+	return DoC(ctx, c.name, run, fallback)
+}
+
+// Go runs the command like GoC.
+func (c *Command) Go(ctx context.Context, run func(context.Context) error, fallback func(context.Context, error) error) chan error {
+	return GoC(ctx, c.name, run, fallback)
+}
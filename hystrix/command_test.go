@@ -0,0 +1,41 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCommand(t *testing.T) {
+	Convey("given a command", t, func() {
+		defer Flush()
+		cmd := NewCommand("command", CommandConfig{Timeout: 20})
+		defer ConfigureCommand("command", CommandConfig{})
+
+		Convey("it is configured", func() {
+			So(cmd.Name(), ShouldEqual, "command")
+			So(getSettings("command").Timeout, ShouldEqual, 20*time.Millisecond)
+		})
+
+		Convey("Execute runs it synchronously", func() {
+			err := cmd.Execute(context.Background(), func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				return nil
+			})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Go runs it asynchronously, with its settings", func() {
+			errChan := cmd.Go(context.Background(), func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, nil)
+			So(errors.Is(<-errChan, ErrTimeout), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package hystrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// debugCommand is the snapshot of a command served by the handler from NewDebugHandler.
+type debugCommand struct {
+	Name     string      `json:"name"`
+	Settings *Settings   `json:"settings"`
+	Open     bool        `json:"open"`
+	Health   debugHealth `json:"health"`
+	Pool     debugPool   `json:"pool"`
+}
+
+// debugHealth is a command's rolling health, over the last 10 seconds.
+type debugHealth struct {
+	Requests        float64 `json:"requests"`
+	Errors          float64 `json:"errors"`
+	ErrorPercentage int     `json:"error_percentage"`
+	Successes       float64 `json:"successes"`
+	Failures        float64 `json:"failures"`
+	Timeouts        float64 `json:"timeouts"`
+	Rejects         float64 `json:"rejects"`
+	ShortCircuits   float64 `json:"short_circuits"`
+	// RunDurationMean and RunDurationP99 are in milliseconds, over the last 60 seconds.
+	RunDurationMean uint32 `json:"run_duration_mean_ms"`
+	RunDurationP99  uint32 `json:"run_duration_p99_ms"`
+}
+
+// debugPool is the saturation of a command's executor pool.
+type debugPool struct {
+	Name       string  `json:"name"`
+	Active     int     `json:"active"`
+	Size       int     `json:"size"`
+	Saturation float64 `json:"saturation"`
+}
+
+// NewDebugHandler returns a handler serving a one-off JSON snapshot of every command: its
+// settings, whether its circuit is open, its rolling health and how saturated its executor pool
+// is, for attaching to support tickets. Unlike the StreamHandler it isn't meant for dashboards.
+// It may be served while commands are executing.
+func NewDebugHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var circuits []*CircuitBreaker
+		ForEachCircuit(func(name string, cb *CircuitBreaker) {
+			circuits = append(circuits, cb)
+		})
+		sort.Slice(circuits, func(i, j int) bool {
+			return circuits[i].Name < circuits[j].Name
+		})
+
+		commands := make([]debugCommand, 0, len(circuits))
+		for _, cb := range circuits {
+			commands = append(commands, snapshotCommand(cb))
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(rw).Encode(struct {
+			Commands []debugCommand `json:"commands"`
+		}{commands})
+	})
+}
+
+func snapshotCommand(cb *CircuitBreaker) debugCommand {
+	now := clockNow()
+	m := cb.Metrics()
+
+	pool := debugPool{
+		Name:   cb.executorPool.Name,
+		Active: cb.executorPool.ActiveCount(),
+		Size:   cb.executorPool.size(),
+	}
+	if pool.Size > 0 {
+		pool.Saturation = float64(pool.Active) / float64(pool.Size)
+	}
+
+	return debugCommand{
+		Name:     cb.Name,
+		Settings: getSettings(cb.Name),
+		Open:     cb.IsOpen(),
+		Health: debugHealth{
+			Requests:        m.RequestCount(now),
+			Errors:          m.ErrorCount(now),
+			ErrorPercentage: m.ErrorPercentage(now),
+			Successes:       m.SuccessCount(now),
+			Failures:        m.FailuresStat().Sum(now),
+			Timeouts:        m.TimeoutCount(now),
+			Rejects:         m.RejectsStat().Sum(now),
+			ShortCircuits:   m.ShortCircuitsStat().Sum(now),
+			RunDurationMean: m.RunDuration().Mean(),
+			RunDurationP99:  m.RunDuration().Percentile(99),
+		},
+		Pool: pool,
+	}
+}
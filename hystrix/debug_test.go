@@ -0,0 +1,45 @@
+package hystrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDebugHandler(t *testing.T) {
+	Convey("with a command which has failed once and one whose circuit is open", t, func() {
+		defer Flush()
+		ConfigureCommand("debug_failing", CommandConfig{Timeout: 500, ErrorWeight: func(error) float64 { return 1 }})
+		defer ConfigureCommand("debug_failing", CommandConfig{})
+		Do("debug_failing", func() error { return fmt.Errorf("failed") }, nil)
+		Do("debug_failing", func() error { return nil }, nil)
+		cb, _, _ := GetCircuit("debug_open")
+		cb.setOpen()
+		time.Sleep(50 * time.Millisecond)
+
+		rec := httptest.NewRecorder()
+		NewDebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug", nil))
+
+		var snapshot struct {
+			Commands []debugCommand `json:"commands"`
+		}
+		So(json.NewDecoder(rec.Body).Decode(&snapshot), ShouldBeNil)
+
+		Convey("every command is listed by name with its state", func() {
+			So(len(snapshot.Commands), ShouldEqual, 2)
+			failing, open := snapshot.Commands[0], snapshot.Commands[1]
+			So(failing.Name, ShouldEqual, "debug_failing")
+			So(failing.Settings.Timeout, ShouldEqual, 500*time.Millisecond)
+			So(failing.Open, ShouldBeFalse)
+			So(failing.Health.Requests, ShouldEqual, 2)
+			So(failing.Health.ErrorPercentage, ShouldEqual, 50)
+			So(failing.Pool.Size, ShouldEqual, 10)
+			So(open.Name, ShouldEqual, "debug_open")
+			So(open.Open, ShouldBeTrue)
+		})
+	})
+}
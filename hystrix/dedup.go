@@ -0,0 +1,106 @@
+package hystrix
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var dedupGroup singleflight.Group
+
+// GoCDedup runs your function like GoC, except that calls for the same name and key which
+// overlap in time are coalesced into a single execution of run. Only the first caller's run
+// function is used, given the values of its context; the others share its outcome, and the
+// execution holds a single concurrency ticket. As the callers share it, no one caller's context
+// can cancel the execution, which is bounded by the command's Timeout instead.
+//
+// Unlike GoC, the returned channel always receives exactly one value: nil on success, or the
+// error on failure. If the shared execution fails, every caller runs its own fallback, so
+// metrics record one attempt plus one fallback per caller. A caller whose context is canceled
+// before the shared execution finishes gets the context's error at once, and runs no fallback.
+func GoCDedup(ctx context.Context, name, key string, run runFuncC, fallback fallbackFuncC) chan error {
+	name = normalizeCommandName(name)
+	errChan := make(chan error, 1)
+	shared := dedupGroup.DoChan(name+"\x00"+key, func() (interface{}, error) {
+		return nil, doC(detachedContext{ctx}, name, run, nil, execOptions{detached: true})
+	})
+
+	go func() {
+		var err error
+		select {
+		case result := <-shared:
+			err = result.Err
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+			return
+		}
+		if ce, ok := err.(CommandError); ok {
+			// hand callers and their fallbacks the same errors GoC would
+			err = ce.RunErr
+		}
+		if err == nil || fallback == nil || (err == ErrCircuitOpen && getSettings(name).SkipFallbackOnOpen) {
+			errChan <- err
+			return
+		}
+
+		errChan <- detachedFallback(ctx, name, fallback, err)
+	}()
+
+	return errChan
+}
+
+// detachedContext carries the values of the context it wraps, but neither its deadline nor its
+// cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// detachedFallback runs a fallback for an execution which was reported without one, such as
+// the shared execution of coalesced callers, and reports the fallback on its own.
+func detachedFallback(ctx context.Context, name string, fallback fallbackFuncC, err error) error {
+	start := clockNow()
+	circuit, _, cbErr := GetCircuit(name)
+	if cbErr == nil && !circuit.acquireFallback() {
+		if reportErr := circuit.ReportEvent([]string{"fallback-failure", "fallback-rejected"}, start, 0); reportErr != nil {
+			log.Printf("%v", reportErr)
+		}
+		return fallbackFailedError(ErrMaxFallbackConcurrency, err)
+	}
+
+	if getSettings(name).RecoverPanics {
+		fallback = recoverFallback(fallback)
+	}
+	eventType := "fallback-success"
+	scope := &commandScope{name: name}
+	fallbackStart := clockNow()
+	fallbackErr := fallback(context.WithValue(ctx, commandScopeKey{}, scope), err)
+	fallbackDuration := clockNow().Sub(fallbackStart)
+	if fallbackErr != nil {
+		eventType = "fallback-failure"
+	}
+	eventTypes := append([]string{eventType}, scope.finish()...)
+
+	if cbErr == nil {
+		circuit.releaseFallback()
+		reportErr := circuit.reportExecution(&commandExecution{
+			Types:            eventTypes,
+			Start:            start,
+			FallbackQuality:  scope.reportedFallbackQuality(),
+			FallbackDuration: fallbackDuration,
+		})
+		if reportErr != nil {
+			log.Printf("%v", reportErr)
+		}
+	}
+
+	if fallbackErr != nil {
+		return fallbackFailedError(fallbackErr, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGoCDedup(t *testing.T) {
+	Convey("with several callers of the same command and key at once", t, func() {
+		defer Flush()
+
+		var runs int32
+		release := make(chan struct{})
+		run := func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			<-release
+			return nil
+		}
+
+		start := func(n int, run runFuncC, fallback fallbackFuncC) []chan error {
+			errChans := make([]chan error, n)
+			for i := range errChans {
+				errChans[i] = GoCDedup(context.Background(), "dedup", "key", run, fallback)
+			}
+			// give every caller time to join the in-flight call
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			return errChans
+		}
+
+		Convey("run executes once and every caller sees success", func() {
+			for _, errChan := range start(5, run, nil) {
+				So(<-errChan, ShouldBeNil)
+			}
+			So(atomic.LoadInt32(&runs), ShouldEqual, 1)
+		})
+
+		Convey("when the shared run fails", func() {
+			failing := func(ctx context.Context) error {
+				run(ctx)
+				return fmt.Errorf("shared failure")
+			}
+			var mu sync.Mutex
+			var fallbacks int
+			fallback := func(ctx context.Context, err error) error {
+				mu.Lock()
+				fallbacks++
+				mu.Unlock()
+				return nil
+			}
+
+			errChans := start(3, failing, fallback)
+			for _, errChan := range errChans {
+				So(<-errChan, ShouldBeNil)
+			}
+
+			Convey("every caller runs its own fallback", func() {
+				So(fallbacks, ShouldEqual, 3)
+			})
+
+			Convey("metrics record one attempt and a fallback per caller", func() {
+				time.Sleep(10 * time.Millisecond)
+				cb, _, _ := GetCircuit("dedup")
+				now := time.Now()
+				So(cb.Metrics().RequestCount(now), ShouldEqual, 1)
+				So(cb.Metrics().FailureCount(now), ShouldEqual, 1)
+				So(cb.Metrics().FallbackSuccessCount(now), ShouldEqual, 3)
+			})
+		})
+	})
+
+	Convey("with a command which requires a fallback", t, func() {
+		defer Flush()
+		ConfigureCommand("dedup_required", CommandConfig{RequireFallback: true})
+		defer ConfigureCommand("dedup_required", CommandConfig{})
+
+		Convey("the shared execution still runs, as each caller brings its own fallback", func() {
+			var runs int32
+			err := <-GoCDedup(context.Background(), "dedup_required", "key", func(ctx context.Context) error {
+				atomic.AddInt32(&runs, 1)
+				return nil
+			}, func(ctx context.Context, err error) error {
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(atomic.LoadInt32(&runs), ShouldEqual, 1)
+		})
+	})
+
+	Convey("when the shared execution is short-circuited", t, func() {
+		defer Flush()
+		cb, _, _ := GetCircuit("dedup_open")
+		So(cb.toggleForceOpen(true), ShouldBeNil)
+
+		err := <-GoCDedup(context.Background(), "dedup_open", "key", func(ctx context.Context) error {
+			return nil
+		}, func(ctx context.Context, err error) error {
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		Convey("the caller's fallback is recorded, and no skipped one", func() {
+			time.Sleep(10 * time.Millisecond)
+			now := time.Now()
+			So(cb.Metrics().ShortCircuitCount(now), ShouldEqual, 1)
+			So(cb.Metrics().FallbackSuccessCount(now), ShouldEqual, 1)
+			So(cb.Metrics().FallbackSkippedCount(now), ShouldEqual, 0)
+		})
+	})
+
+	Convey("when the first of two coalesced callers is canceled", t, func() {
+		defer Flush()
+		release := make(chan struct{})
+		var fallbacks int32
+		fallback := func(ctx context.Context, err error) error {
+			atomic.AddInt32(&fallbacks, 1)
+			return nil
+		}
+		start := func(runErr error) (first, second chan error) {
+			run := func(ctx context.Context) error {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				return runErr
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			first = GoCDedup(ctx, "dedup_canceled", "key", run, fallback)
+			second = GoCDedup(context.Background(), "dedup_canceled", "key", run, fallback)
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+			return first, second
+		}
+
+		Convey("it gets its context's error at once, running no fallback", func() {
+			first, second := start(nil)
+			So(errors.Is(<-first, context.Canceled), ShouldBeTrue)
+			So(atomic.LoadInt32(&fallbacks), ShouldEqual, 0)
+
+			Convey("while the second still gets the shared result", func() {
+				close(release)
+				So(<-second, ShouldBeNil)
+			})
+		})
+
+		Convey("the second still runs its fallback when the shared execution fails", func() {
+			first, second := start(fmt.Errorf("shared failure"))
+			So(errors.Is(<-first, context.Canceled), ShouldBeTrue)
+			close(release)
+			So(<-second, ShouldBeNil)
+			So(atomic.LoadInt32(&fallbacks), ShouldEqual, 1)
+		})
+	})
+}
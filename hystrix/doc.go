@@ -29,6 +29,21 @@ This triggers when your code returns an error, or whenever it is unable to compl
 		return nil
 	})
 
+The fallback is given the cause unwrapped: ErrTimeout when run took too long, ErrCircuitOpen when the circuit
+was open, ErrMaxConcurrency or ErrRateLimited when the command was rejected, and otherwise the error run returned.
+
+	hystrix.Go("my_command", run, func(err error) error {
+		switch err {
+		case hystrix.ErrTimeout:
+			// serve from a stale cache
+		case hystrix.ErrCircuitOpen:
+			// fail fast
+		default:
+			// run returned err
+		}
+		return err
+	})
+
 Waiting for output
 
 Calling Go is like launching a goroutine, except you receive a channel of errors you can choose to monitor.
@@ -0,0 +1,49 @@
+package hystrix
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// drainingAll is 1 while every command is draining.
+	drainingAll int32
+	// drainingCommands holds the names of the commands draining on their own.
+	drainingCommands sync.Map
+)
+
+// StartDraining makes every command drain, for a graceful shutdown: executions already started
+// finish as usual, while new ones fail with ErrDraining, running their fallbacks. Unlike an
+// open circuit, draining says nothing of a command's health, so the rejected executions are
+// recorded as "draining" rather than as short-circuits, and don't count towards the error
+// percentage. A circuit's ActiveCount falls to zero once the executions in flight have finished,
+// and CloseCommand fails until then.
+func StartDraining() {
+	atomic.StoreInt32(&drainingAll, 1)
+}
+
+// StopDraining stops the draining started by StartDraining. Commands draining on their own, through
+// StartDrainingCommand, carry on draining.
+func StopDraining() {
+	atomic.StoreInt32(&drainingAll, 0)
+}
+
+// StartDrainingCommand makes the named command drain, like StartDraining does every command.
+func StartDrainingCommand(name string) {
+	drainingCommands.Store(normalizeCommandName(name), true)
+}
+
+// StopDrainingCommand stops the named command draining on its own. It carries on draining while
+// every command is, until StopDraining.
+func StopDrainingCommand(name string) {
+	drainingCommands.Delete(normalizeCommandName(name))
+}
+
+// isDraining reports whether new executions of the named command are to be rejected.
+func isDraining(name string) bool {
+	if atomic.LoadInt32(&drainingAll) == 1 {
+		return true
+	}
+	_, ok := drainingCommands.Load(name)
+	return ok
+}
@@ -0,0 +1,92 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDraining(t *testing.T) {
+	Convey("with an execution of a command in flight", t, func() {
+		defer Flush()
+		release := make(chan struct{})
+		var once sync.Once
+		releaseRun := func() { once.Do(func() { close(release) }) }
+		defer releaseRun()
+		finished := make(chan struct{})
+		Go("draining", func() error {
+			<-release
+			close(finished)
+			return nil
+		}, nil)
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("once the command is draining", func() {
+			StartDrainingCommand("draining")
+			defer StopDrainingCommand("draining")
+
+			Convey("new executions fail with ErrDraining, running their fallbacks", func() {
+				var fallbackErr error
+				err := DoC(context.Background(), "draining", func(ctx context.Context) error {
+					return nil
+				}, func(ctx context.Context, err error) error {
+					fallbackErr = err
+					return err
+				})
+				So(errors.Is(err, ErrDraining), ShouldBeTrue)
+				So(err.(CommandError).Type, ShouldEqual, "draining")
+				So(fallbackErr, ShouldEqual, ErrDraining)
+
+				ok, tryErr := Try("draining")
+				So(ok, ShouldBeFalse)
+				So(tryErr, ShouldEqual, ErrDraining)
+
+				Convey("and are recorded as draining, not as errors or short-circuits", func() {
+					time.Sleep(50 * time.Millisecond)
+					cb, _, _ := GetCircuit("draining")
+					now := time.Now()
+					So(cb.Metrics().Draining().Sum(now), ShouldEqual, 1)
+					So(cb.Metrics().ShortCircuitCount(now), ShouldEqual, 0)
+					So(cb.Metrics().ErrorCount(now), ShouldEqual, 0)
+				})
+			})
+
+			Convey("the execution in flight finishes as usual", func() {
+				cb, _, _ := GetCircuit("draining")
+				So(cb.ActiveCount(), ShouldEqual, 1)
+
+				releaseRun()
+				select {
+				case <-finished:
+				case <-time.After(time.Second):
+					t.Fatal("the execution in flight didn't finish")
+				}
+				time.Sleep(10 * time.Millisecond)
+				So(cb.ActiveCount(), ShouldEqual, 0)
+			})
+
+			Convey("other commands aren't draining", func() {
+				So(Do("not_draining", func() error { return nil }, nil), ShouldBeNil)
+			})
+
+			Convey("it runs again once it stops draining", func() {
+				StopDrainingCommand("draining")
+				So(Do("draining", func() error { return nil }, nil), ShouldBeNil)
+			})
+		})
+
+		Convey("once every command is draining, each is until draining stops", func() {
+			StartDraining()
+			defer StopDraining()
+			err := Do("not_draining", func() error { return nil }, nil)
+			So(errors.Is(err, ErrDraining), ShouldBeTrue)
+
+			StopDraining()
+			So(Do("not_draining", func() error { return nil }, nil), ShouldBeNil)
+		})
+	})
+}
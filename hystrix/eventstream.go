@@ -2,8 +2,10 @@ package hystrix
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,55 +14,194 @@ import (
 
 const (
 	streamEventBufferSize = 10
+	ndjsonContentType     = "application/x-ndjson"
+
+	// DefaultStreamInterval is how often a StreamHandler publishes metrics unless told otherwise.
+	DefaultStreamInterval = 1 * time.Second
+	// MinStreamInterval is the shortest publish interval a StreamHandler accepts. Shorter intervals are clamped to it.
+	MinStreamInterval = 100 * time.Millisecond
 )
 
 // NewStreamHandler returns a server capable of exposing dashboard metrics via HTTP.
 func NewStreamHandler() *StreamHandler {
-	return &StreamHandler{}
+	return NewStreamHandlerWithInterval(DefaultStreamInterval)
 }
 
-// StreamHandler publishes metrics for each command and each pool once a second to all connected HTTP client.
+// NewStreamHandlerWithInterval returns a server capable of exposing dashboard metrics via HTTP,
+// publishing every d instead of once a second. Intervals below MinStreamInterval are clamped.
+func NewStreamHandlerWithInterval(d time.Duration) *StreamHandler {
+	if d < MinStreamInterval {
+		d = MinStreamInterval
+	}
+	return &StreamHandler{interval: d}
+}
+
+// StreamHandler publishes metrics for each command and each pool once a second, or at the
+// interval given to NewStreamHandlerWithInterval, to all connected HTTP client.
+//
+// Clients may pass a comma-separated "commands" query parameter to only receive
+// metrics for the named commands and their pools.
+//
+// Metrics are framed as server-sent events by default. Clients which send
+// "Accept: application/x-ndjson" or pass "format=ndjson" instead receive one
+// JSON object per line.
 type StreamHandler struct {
-	requests map[*http.Request]chan []byte
+	// requests holds the stream of each connected client by its *http.Request, and of each
+	// MetricRecorder by the recorder.
+	requests map[interface{}]*streamRequest
 	mu       sync.RWMutex
-	done     chan struct{}
+	interval time.Duration
+
+	// running, done and stopped are guarded by mu. done is closed to stop the publishing
+	// goroutine, which closes stopped once it has exited.
+	running bool
+	done    chan struct{}
+	stopped chan struct{}
+
+	username string
+	password string
+
+	cluster       string
+	reportingHost string
+}
+
+// WithBasicAuth makes the handler require the given HTTP basic auth credentials, sent over TLS.
+// Requests without valid credentials get 401 Unauthorized, and requests which didn't arrive over
+// TLS get 403 Forbidden, before any metrics are streamed. Serve the handler with ListenAndServeTLS.
+// It returns sh, so it can be chained onto NewStreamHandler, and must be called before serving.
+func (sh *StreamHandler) WithBasicAuth(username, password string) *StreamHandler {
+	sh.username = username
+	sh.password = password
+	return sh
+}
+
+// WithCluster labels the published metrics with the name of the cluster the instance belongs to,
+// for Turbine to aggregate instances by. It returns sh, and must be called before serving.
+func (sh *StreamHandler) WithCluster(cluster string) *StreamHandler {
+	sh.cluster = cluster
+	return sh
+}
+
+// WithReportingHost labels the published metrics with the host reporting them, such as its
+// hostname or address, so that Turbine can tell the instances of a cluster apart. It returns sh,
+// and must be called before serving.
+func (sh *StreamHandler) WithReportingHost(host string) *StreamHandler {
+	sh.reportingHost = host
+	return sh
+}
+
+// authorize reports whether req may stream metrics, having written an error response when it may not.
+func (sh *StreamHandler) authorize(rw http.ResponseWriter, req *http.Request) bool {
+	if sh.username == "" && sh.password == "" {
+		return true
+	}
+	if req.TLS == nil {
+		http.Error(rw, "TLS required", http.StatusForbidden)
+		return false
+	}
+
+	username, password, ok := req.BasicAuth()
+	// both comparisons run whatever the first's result, so timing reveals neither
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(sh.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(sh.password)) == 1
+	if !ok || !userOK || !passOK {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="hystrix"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
 }
 
-// Start begins watching the in-memory circuit breakers for metrics
+// Start begins watching the in-memory circuit breakers for metrics. Calling it again while
+// the handler is running does nothing.
 func (sh *StreamHandler) Start() {
-	sh.requests = make(map[*http.Request]chan []byte)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.running {
+		return
+	}
+	if sh.requests == nil {
+		sh.requests = make(map[interface{}]*streamRequest)
+	}
+	if sh.interval <= 0 {
+		sh.interval = DefaultStreamInterval
+	}
+	sh.running = true
 	sh.done = make(chan struct{})
-	go sh.loop()
+	sh.stopped = make(chan struct{})
+	go sh.loop(sh.done, sh.stopped)
 }
 
-// Stop shuts down the metric collection routine
+// Stop shuts down the metric collection routine, waiting for it to exit, and disconnects
+// every connected client. Calling it on a handler which isn't running does nothing.
 func (sh *StreamHandler) Stop() {
+	sh.mu.Lock()
+	if !sh.running {
+		sh.mu.Unlock()
+		return
+	}
+	sh.running = false
 	close(sh.done)
+	stopped := sh.stopped
+	sh.mu.Unlock()
+
+	<-stopped
+
+	// nothing publishes to the clients any more, so their streams can be closed
+	sh.mu.Lock()
+	for req, r := range sh.requests {
+		close(r.events)
+		delete(sh.requests, req)
+	}
+	sh.mu.Unlock()
 }
 
 var _ http.Handler = (*StreamHandler)(nil)
 
 func (sh *StreamHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !sh.authorize(rw, req) {
+		return
+	}
+
 	// Make sure that the writer supports flushing.
 	f, ok := rw.(http.Flusher)
 	if !ok {
 		http.Error(rw, "Streaming unsupported!", http.StatusInternalServerError)
 		return
 	}
-	events := sh.register(req)
+	r := sh.register(req)
+	if r == nil {
+		http.Error(rw, "Stream handler is not running", http.StatusServiceUnavailable)
+		return
+	}
 	defer sh.unregister(req)
 
 	notify := rw.(http.CloseNotifier).CloseNotify()
 
-	rw.Header().Add("Content-Type", "text/event-stream")
+	if r.ndjson {
+		rw.Header().Set("Content-Type", ndjsonContentType)
+	} else {
+		rw.Header().Set("Content-Type", "text/event-stream")
+	}
 	rw.Header().Set("Cache-Control", "no-cache")
 	rw.Header().Set("Connection", "keep-alive")
+	// stops reverse proxies such as nginx buffering the stream
+	rw.Header().Set("X-Accel-Buffering", "no")
+	// send the headers at once, rather than with the first event, so that proxies and clients
+	// know they have a stream
+	rw.WriteHeader(http.StatusOK)
+	f.Flush()
 	for {
 		select {
 		case <-notify:
 			// client is gone
 			return
-		case event := <-events:
+		case event, ok := <-r.events:
+			if !ok {
+				// the handler was stopped
+				return
+			}
 			_, err := rw.Write(event)
 			if err != nil {
 				return
@@ -70,48 +211,71 @@ func (sh *StreamHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (sh *StreamHandler) loop() {
-	tick := time.Tick(1 * time.Second)
+func (sh *StreamHandler) loop(done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	tick := time.NewTicker(sh.interval)
+	defer tick.Stop()
 	for {
 		select {
-		case <-tick:
+		case <-tick.C:
 			circuitBreakersMutex.RLock()
+			// commands in a group share their pool, which is published once, to the clients
+			// wanting any of them
+			var pools []*executorPool
+			commands := make(map[*executorPool][]string)
 			for _, cb := range circuitBreakers {
-				sh.publishMetrics(cb)
-				sh.publishThreadPools(cb.executorPool)
+				if err := sh.publishMetrics(cb); err != nil {
+					log.Printf("hystrix-go: failed to publish metrics for %v: %v", cb.Name, err)
+				}
+				if _, ok := commands[cb.executorPool]; !ok {
+					pools = append(pools, cb.executorPool)
+				}
+				commands[cb.executorPool] = append(commands[cb.executorPool], cb.Name)
+			}
+			for _, pool := range pools {
+				if err := sh.publishThreadPools(pool, commands[pool]); err != nil {
+					log.Printf("hystrix-go: failed to publish thread pool metrics for %v: %v", pool.Name, err)
+				}
 			}
 			circuitBreakersMutex.RUnlock()
-		case <-sh.done:
+		case <-done:
 			return
 		}
 	}
 }
 
 func (sh *StreamHandler) publishMetrics(cb *CircuitBreaker) error {
-	now := time.Now()
+	now := clockNow()
 	reqCount := cb.metrics.Requests().Sum(now)
-	errCount := cb.metrics.DefaultCollector().Errors().Sum(now)
+	errCount := cb.metrics.DefaultCollector().ErrorsStat().Sum(now)
 	errPct := cb.metrics.ErrorPercent(now)
+	group := getSettings(cb.Name).Group
+	if group == "" {
+		group = cb.Name
+	}
 
 	eventBytes, err := json.Marshal(&streamCmdMetric{
 		Type:           "HystrixCommand",
 		Name:           cb.Name,
-		Group:          cb.Name,
+		Group:          group,
 		Time:           currentTime(),
 		ReportingHosts: 1,
+		ReportingHost:  sh.reportingHost,
+		Cluster:        sh.cluster,
 
 		RequestCount:       uint32(reqCount),
 		ErrorCount:         uint32(errCount),
 		ErrorPct:           uint32(errPct),
 		CircuitBreakerOpen: cb.IsOpen(),
 
-		RollingCountSuccess:            uint32(cb.metrics.DefaultCollector().Successes().Sum(now)),
-		RollingCountFailure:            uint32(cb.metrics.DefaultCollector().Failures().Sum(now)),
-		RollingCountThreadPoolRejected: uint32(cb.metrics.DefaultCollector().Rejects().Sum(now)),
-		RollingCountShortCircuited:     uint32(cb.metrics.DefaultCollector().ShortCircuits().Sum(now)),
-		RollingCountTimeout:            uint32(cb.metrics.DefaultCollector().Timeouts().Sum(now)),
-		RollingCountFallbackSuccess:    uint32(cb.metrics.DefaultCollector().FallbackSuccesses().Sum(now)),
-		RollingCountFallbackFailure:    uint32(cb.metrics.DefaultCollector().FallbackFailures().Sum(now)),
+		RollingCountSuccess:            uint32(cb.metrics.DefaultCollector().SuccessesStat().Sum(now)),
+		RollingCountFailure:            uint32(cb.metrics.DefaultCollector().FailuresStat().Sum(now)),
+		RollingCountThreadPoolRejected: uint32(cb.metrics.DefaultCollector().RejectsStat().Sum(now)),
+		RollingCountShortCircuited:     uint32(cb.metrics.DefaultCollector().ShortCircuitsStat().Sum(now)),
+		RollingCountTimeout:            uint32(cb.metrics.DefaultCollector().TimeoutsStat().Sum(now)),
+		RollingCountFallbackSuccess:    uint32(cb.metrics.DefaultCollector().FallbackSuccessesStat().Sum(now)),
+		RollingCountFallbackFailure:    uint32(cb.metrics.DefaultCollector().FallbackFailuresStat().Sum(now)),
 
 		LatencyTotal:       generateLatencyTimings(cb.metrics.DefaultCollector().TotalDuration()),
 		LatencyTotalMean:   cb.metrics.DefaultCollector().TotalDuration().Mean(),
@@ -128,12 +292,12 @@ func (sh *StreamHandler) publishMetrics(cb *CircuitBreaker) error {
 		CircuitBreakerForceOpen:              cb.forceOpen,
 		CircuitBreakerErrorThresholdPercent:  uint32(getSettings(cb.Name).ErrorPercentThreshold),
 		CircuitBreakerSleepWindow:            uint32(getSettings(cb.Name).SleepWindow.Seconds() * 1000),
-		CircuitBreakerRequestVolumeThreshold: uint32(getSettings(cb.Name).RequestVolumeThreshold),
+		CircuitBreakerRequestVolumeThreshold: uint32(getSettings(cb.Name).VolumeThreshold()),
 	})
 	if err != nil {
 		return err
 	}
-	err = sh.writeToRequests(eventBytes)
+	err = sh.writeToRequests([]string{cb.Name}, eventBytes)
 	if err != nil {
 		return err
 	}
@@ -141,25 +305,30 @@ func (sh *StreamHandler) publishMetrics(cb *CircuitBreaker) error {
 	return nil
 }
 
-func (sh *StreamHandler) publishThreadPools(pool *executorPool) error {
-	now := time.Now()
+// publishThreadPools publishes the metrics of pool, which the named commands take tickets from.
+func (sh *StreamHandler) publishThreadPools(pool *executorPool, commands []string) error {
+	now := clockNow()
+	size := uint32(pool.size())
 
 	eventBytes, err := json.Marshal(&streamThreadPoolMetric{
 		Type:           "HystrixThreadPool",
 		Name:           pool.Name,
+		Time:           currentTime(),
 		ReportingHosts: 1,
+		ReportingHost:  sh.reportingHost,
+		Cluster:        sh.cluster,
 
 		CurrentActiveCount:        uint32(pool.ActiveCount()),
 		CurrentTaskCount:          0,
 		CurrentCompletedTaskCount: 0,
 
 		RollingCountThreadsExecuted: uint32(pool.Metrics.Executed.Sum(now)),
-		RollingMaxActiveThreads:     uint32(pool.Metrics.MaxActiveRequests.Max(now)),
+		RollingMaxActiveThreads:     uint32(pool.MaxActive()),
 
-		CurrentPoolSize:        uint32(pool.Max),
-		CurrentCorePoolSize:    uint32(pool.Max),
-		CurrentLargestPoolSize: uint32(pool.Max),
-		CurrentMaximumPoolSize: uint32(pool.Max),
+		CurrentPoolSize:        size,
+		CurrentCorePoolSize:    size,
+		CurrentLargestPoolSize: size,
+		CurrentMaximumPoolSize: size,
 
 		RollingStatsWindow:          10000,
 		QueueSizeRejectionThreshold: 0,
@@ -168,12 +337,16 @@ func (sh *StreamHandler) publishThreadPools(pool *executorPool) error {
 	if err != nil {
 		return err
 	}
-	err = sh.writeToRequests(eventBytes)
+	err = sh.writeToRequests(commands, eventBytes)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (sh *StreamHandler) writeToRequests(eventBytes []byte) error {
+// writeToRequests sends an event to the clients wanting any of the named commands.
+func (sh *StreamHandler) writeToRequests(commands []string, eventBytes []byte) error {
 	var b bytes.Buffer
 	_, err := b.Write([]byte("data:"))
 	if err != nil {
@@ -189,11 +362,19 @@ func (sh *StreamHandler) writeToRequests(eventBytes []byte) error {
 		return err
 	}
 	dataBytes := b.Bytes()
+	lineBytes := append(eventBytes[:len(eventBytes):len(eventBytes)], '\n')
 	sh.mu.RLock()
 
-	for _, requestEvents := range sh.requests {
+	for _, r := range sh.requests {
+		if !r.wantsAny(commands) {
+			continue
+		}
+		event := dataBytes
+		if r.ndjson {
+			event = lineBytes
+		}
 		select {
-		case requestEvents <- dataBytes:
+		case r.events <- event:
 		default:
 		}
 	}
@@ -202,19 +383,32 @@ func (sh *StreamHandler) writeToRequests(eventBytes []byte) error {
 	return nil
 }
 
-func (sh *StreamHandler) register(req *http.Request) <-chan []byte {
-	sh.mu.RLock()
-	events, ok := sh.requests[req]
-	sh.mu.RUnlock()
-	if ok {
-		return events
+// register returns the stream for req, or nil when the handler isn't running.
+func (sh *StreamHandler) register(req *http.Request) *streamRequest {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if !sh.running {
+		return nil
+	}
+	r, ok := sh.requests[req]
+	if !ok {
+		r = newStreamRequest(req)
+		sh.requests[req] = r
 	}
+	return r
+}
 
-	events = make(chan []byte, streamEventBufferSize)
+// subscribe publishes to r under key until the handler is stopped, reporting false when it isn't running.
+func (sh *StreamHandler) subscribe(key interface{}, r *streamRequest) bool {
 	sh.mu.Lock()
-	sh.requests[req] = events
-	sh.mu.Unlock()
-	return events
+	defer sh.mu.Unlock()
+
+	if !sh.running {
+		return false
+	}
+	sh.requests[key] = r
+	return true
 }
 
 func (sh *StreamHandler) unregister(req *http.Request) {
@@ -223,6 +417,50 @@ func (sh *StreamHandler) unregister(req *http.Request) {
 	sh.mu.Unlock()
 }
 
+// streamRequest holds the events queued for a single connected client, along
+// with the set of command names and the framing it asked for.
+type streamRequest struct {
+	events   chan []byte
+	commands map[string]bool
+	ndjson   bool
+}
+
+func newStreamRequest(req *http.Request) *streamRequest {
+	r := &streamRequest{
+		events: make(chan []byte, streamEventBufferSize),
+		ndjson: req.URL.Query().Get("format") == "ndjson" ||
+			strings.Contains(req.Header.Get("Accept"), ndjsonContentType),
+	}
+
+	for _, name := range strings.Split(req.URL.Query().Get("commands"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if r.commands == nil {
+			r.commands = make(map[string]bool)
+		}
+		r.commands[name] = true
+	}
+
+	return r
+}
+
+// wants reports whether metrics for the named command should be sent to this client.
+// A client which did not filter by command receives everything.
+func (r *streamRequest) wants(name string) bool {
+	return r.commands == nil || r.commands[name]
+}
+
+// wantsAny reports whether metrics for any of the named commands should be sent to this client.
+func (r *streamRequest) wantsAny(names []string) bool {
+	for _, name := range names {
+		if r.wants(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func generateLatencyTimings(r *rolling.Timing) streamCmdLatency {
 	return streamCmdLatency{
 		Timing0:   r.Percentile(0),
@@ -243,6 +481,8 @@ type streamCmdMetric struct {
 	Group          string `json:"group"`
 	Time           int64  `json:"currentTime"`
 	ReportingHosts uint32 `json:"reportingHosts"`
+	ReportingHost  string `json:"reportingHost,omitempty"`
+	Cluster        string `json:"cluster,omitempty"`
 
 	// Health
 	RequestCount       uint32 `json:"requestCount"`
@@ -303,7 +543,10 @@ type streamCmdLatency struct {
 type streamThreadPoolMetric struct {
 	Type           string `json:"type"`
 	Name           string `json:"name"`
+	Time           int64  `json:"currentTime"`
 	ReportingHosts uint32 `json:"reportingHosts"`
+	ReportingHost  string `json:"reportingHost,omitempty"`
+	Cluster        string `json:"cluster,omitempty"`
 
 	CurrentActiveCount        uint32 `json:"currentActiveCount"`
 	CurrentCompletedTaskCount uint32 `json:"currentCompletedTaskCount"`
@@ -322,5 +565,5 @@ type streamThreadPoolMetric struct {
 }
 
 func currentTime() int64 {
-	return time.Now().UnixNano() / int64(1000000)
+	return clockNow().UnixNano() / int64(1000000)
 }
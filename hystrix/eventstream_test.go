@@ -1,8 +1,10 @@
 package hystrix
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -19,8 +21,8 @@ type eventStreamTestServer struct {
 }
 
 func (s *eventStreamTestServer) stopTestServer() error {
-	s.Close()
 	s.Stop()
+	s.Close()
 	Flush()
 
 	return nil
@@ -125,6 +127,13 @@ func streamMetrics(t *testing.T, url string) (chan string, chan bool) {
 		for {
 			_, err := res.Body.Read(buf)
 			if err != nil {
+				select {
+				case _ = <-done:
+					// the stream was stopped after the caller had what it wanted
+					close(metrics)
+					return
+				default:
+				}
 				t.Fatal(err)
 			}
 
@@ -178,6 +187,273 @@ func TestEventStream(t *testing.T) {
 	})
 }
 
+func TestEventStreamTurbine(t *testing.T) {
+	Convey("given an event stream labelled with its cluster and host", t, func() {
+		handler := NewStreamHandler().WithCluster("checkout").WithReportingHost("10.0.0.7:8080")
+		handler.Start()
+		server := &eventStreamTestServer{httptest.NewServer(handler), handler}
+		defer server.stopTestServer()
+
+		ConfigureCommand("turbine", CommandConfig{Group: "payments"})
+		defer ConfigureCommand("turbine", CommandConfig{})
+		sleepingCommand(t, "turbine", 1*time.Millisecond)
+
+		Convey("command metrics carry the labels and the command's group", func() {
+			event := grabFirstCommandFromStream(t, server.URL)
+			So(event.Cluster, ShouldEqual, "checkout")
+			So(event.ReportingHost, ShouldEqual, "10.0.0.7:8080")
+			So(event.Group, ShouldEqual, "payments")
+		})
+
+		Convey("thread pool metrics carry the labels", func() {
+			event := grabFirstThreadPoolFromStream(t, server.URL)
+			So(event.Cluster, ShouldEqual, "checkout")
+			So(event.ReportingHost, ShouldEqual, "10.0.0.7:8080")
+		})
+	})
+}
+
+func TestEventStreamCommandFilter(t *testing.T) {
+	Convey("given a running event stream", t, func() {
+		server := startTestServer()
+		defer server.stopTestServer()
+
+		Convey("after commands with different names have run", func() {
+			sleepingCommand(t, "filtered_out", 1*time.Millisecond)
+			sleepingCommand(t, "filtered_in", 1*time.Millisecond)
+
+			Convey("a client filtering by command only receives the matching command", func() {
+				for i := 0; i < 3; i++ {
+					event := grabFirstCommandFromStream(t, server.URL+"?commands=other,filtered_in")
+					So(event.Name, ShouldEqual, "filtered_in")
+				}
+			})
+
+			Convey("a client filtering by command only receives the matching pool", func() {
+				for i := 0; i < 3; i++ {
+					metric := grabFirstThreadPoolFromStream(t, server.URL+"?commands=filtered_in")
+					So(metric.Name, ShouldEqual, "filtered_in")
+				}
+			})
+		})
+
+		Convey("after a command sharing its group's pool has run", func() {
+			ConfigureCommand("grouped_member", CommandConfig{Group: "stream_group"})
+			defer ConfigureCommand("grouped_member", CommandConfig{})
+			sleepingCommand(t, "grouped_member", 1*time.Millisecond)
+
+			Convey("a client filtering by the command receives the group's pool", func() {
+				metric := grabFirstThreadPoolFromStream(t, server.URL+"?commands=grouped_member")
+				So(metric.Name, ShouldEqual, "stream_group")
+			})
+		})
+	})
+}
+
+func TestEventStreamNDJSON(t *testing.T) {
+	Convey("given a running event stream", t, func() {
+		server := startTestServer()
+		defer server.stopTestServer()
+
+		sleepingCommand(t, "ndjson", 1*time.Millisecond)
+
+		readFirstLine := func(req *http.Request) (*http.Response, string) {
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			line, err := bufio.NewReader(res.Body).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res, line
+		}
+
+		Convey("a client asking for ndjson via the format parameter", func() {
+			req, _ := http.NewRequest("GET", server.URL+"?format=ndjson&commands=ndjson", nil)
+			res, line := readFirstLine(req)
+
+			Convey("receives one json object per line", func() {
+				So(res.Header.Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+
+				var event map[string]interface{}
+				So(json.Unmarshal([]byte(line), &event), ShouldBeNil)
+				So(event["name"], ShouldEqual, "ndjson")
+			})
+		})
+
+		Convey("a client asking for ndjson via the Accept header", func() {
+			req, _ := http.NewRequest("GET", server.URL+"?commands=ndjson", nil)
+			req.Header.Set("Accept", "application/x-ndjson")
+			res, line := readFirstLine(req)
+
+			Convey("receives one json object per line", func() {
+				So(res.Header.Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+
+				var event map[string]interface{}
+				So(json.Unmarshal([]byte(line), &event), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestEventStreamProxyHeaders(t *testing.T) {
+	Convey("given a stream handler mounted under a path of a mux", t, func() {
+		handler := NewStreamHandlerWithInterval(time.Hour)
+		handler.Start()
+		defer handler.Stop()
+		mux := http.NewServeMux()
+		mux.Handle("/ops/hystrix.stream", handler)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		Convey("a client receives the stream's headers before the first event", func() {
+			client := &http.Client{Timeout: time.Second}
+			res, err := client.Get(server.URL + "/ops/hystrix.stream")
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			So(res.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+			So(res.Header.Get("Cache-Control"), ShouldEqual, "no-cache")
+			So(res.Header.Get("X-Accel-Buffering"), ShouldEqual, "no")
+		})
+	})
+}
+
+func TestStreamInterval(t *testing.T) {
+	Convey("when creating a stream handler", t, func() {
+		Convey("the default interval is one second", func() {
+			So(NewStreamHandler().interval, ShouldEqual, time.Second)
+		})
+
+		Convey("a custom interval is kept", func() {
+			So(NewStreamHandlerWithInterval(5*time.Second).interval, ShouldEqual, 5*time.Second)
+		})
+
+		Convey("an interval below the minimum is clamped", func() {
+			So(NewStreamHandlerWithInterval(time.Millisecond).interval, ShouldEqual, MinStreamInterval)
+			So(NewStreamHandlerWithInterval(0).interval, ShouldEqual, MinStreamInterval)
+		})
+	})
+}
+
+func TestStreamBasicAuth(t *testing.T) {
+	Convey("given an event stream requiring basic auth", t, func() {
+		handler := NewStreamHandler().WithBasicAuth("dashboard", "secret")
+		handler.Start()
+		defer handler.Stop()
+		defer Flush()
+
+		sleepingCommand(t, "eventstream", 1*time.Millisecond)
+
+		get := func(server *httptest.Server, username, password string) *http.Response {
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+			res, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res
+		}
+
+		Convey("served over TLS", func() {
+			server := httptest.NewTLSServer(handler)
+			defer server.Close()
+
+			Convey("a request without credentials is refused", func() {
+				res := get(server, "", "")
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusUnauthorized)
+				So(res.Header.Get("WWW-Authenticate"), ShouldStartWith, "Basic")
+			})
+
+			Convey("a request with the wrong password is refused", func() {
+				res := get(server, "dashboard", "guess")
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("a request with the right credentials streams metrics", func() {
+				res := get(server, "dashboard", "secret")
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusOK)
+				So(res.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+			})
+		})
+
+		Convey("served without TLS, even the right credentials are refused", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			res := get(server, "dashboard", "secret")
+			defer res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
+
+func TestStreamHandlerStop(t *testing.T) {
+	Convey("given a running event stream with a connected client", t, func() {
+		server := startTestServer()
+		defer server.stopTestServer()
+
+		sleepingCommand(t, "eventstream", 1*time.Millisecond)
+
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		reader := bufio.NewReader(res.Body)
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+
+		Convey("starting it again does nothing", func() {
+			done := server.StreamHandler.done
+			server.StreamHandler.Start()
+			So(server.StreamHandler.done, ShouldEqual, done)
+		})
+
+		Convey("stopping it disconnects the client", func() {
+			server.StreamHandler.Stop()
+
+			disconnected := make(chan error, 1)
+			go func() {
+				_, err := ioutil.ReadAll(reader)
+				disconnected <- err
+			}()
+			select {
+			case err := <-disconnected:
+				So(err, ShouldBeNil)
+			case <-time.After(5 * time.Second):
+				t.Fatal("client was not disconnected")
+			}
+
+			server.StreamHandler.mu.RLock()
+			So(len(server.StreamHandler.requests), ShouldEqual, 0)
+			server.StreamHandler.mu.RUnlock()
+
+			Convey("new clients are refused, and stopping again does nothing", func() {
+				res, err := http.Get(server.URL)
+				So(err, ShouldBeNil)
+				res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+
+				server.StreamHandler.Stop()
+			})
+		})
+	})
+}
+
 func TestClientCancelEventStream(t *testing.T) {
 	Convey("given a running event stream", t, func() {
 		server := startTestServer()
@@ -266,5 +542,26 @@ func TestThreadPoolStream(t *testing.T) {
 				So(metric.CurrentPoolSize, ShouldEqual, 10)
 			})
 		})
+
+		Convey("while a command is still running", func() {
+			ConfigureCommand("threadpool_active", CommandConfig{Timeout: 10000})
+			release := make(chan struct{})
+			started := make(chan struct{})
+			errChan := Go("threadpool_active", func() error {
+				close(started)
+				<-release
+				return nil
+			}, nil)
+			<-started
+			metric := grabFirstThreadPoolFromStream(t, server.URL+"?commands=threadpool_active")
+			close(release)
+
+			Convey("the active count should include it", func() {
+				So(metric.Name, ShouldEqual, "threadpool_active")
+				So(metric.CurrentActiveCount, ShouldEqual, 1)
+				So(metric.CurrentQueueSize, ShouldEqual, 0)
+				So(len(errChan), ShouldEqual, 0)
+			})
+		})
 	})
 }
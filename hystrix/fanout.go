@@ -0,0 +1,67 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// A Group runs commands concurrently, each through its own circuit, and collects the first error
+// among them, like golang.org/x/sync/errgroup. The first command to fail cancels the context
+// shared by the others, so that they can give up early. A short-circuited command doesn't cancel
+// the others unless CancelOnShortCircuit is set, since its circuit being open says nothing about
+// the others' backends, though its error is still returned by Wait.
+//
+//	g, ctx := hystrix.NewGroup(ctx)
+//	g.Go("users", fetchUsers, nil)
+//	g.Go("orders", fetchOrders, nil)
+//	if err := g.Wait(); err != nil {
+//		return err
+//	}
+type Group struct {
+	// CancelOnShortCircuit makes a short-circuited command cancel the others, like any other failure.
+	// It must be set before calling Go.
+	CancelOnShortCircuit bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// NewGroup returns a Group, and the context its commands are run with, derived from ctx. The
+// context is canceled when a command fails, or when Wait returns.
+func NewGroup(ctx context.Context) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{ctx: ctx, cancel: cancel}, ctx
+}
+
+// Go runs the named command in a new goroutine, as DoC would with the group's context. A command
+// whose fallback succeeds hasn't failed.
+func (g *Group) Go(name string, run runFuncC, fallback fallbackFuncC) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		err := DoC(g.ctx, name, run, fallback)
+		if err == nil {
+			return
+		}
+		g.errOnce.Do(func() {
+			g.err = err
+		})
+		if g.CancelOnShortCircuit || !errors.Is(err, ErrCircuitOpen) {
+			g.cancel()
+		}
+	}()
+}
+
+// Wait blocks until every command started with Go has finished, then returns the first error
+// among them, as a CommandError, or nil if they all succeeded.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
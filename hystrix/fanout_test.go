@@ -0,0 +1,94 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGroup(t *testing.T) {
+	Convey("with a group of commands", t, func() {
+		defer Flush()
+		ConfigureCommand("fanout_slow", CommandConfig{Timeout: 5000})
+		defer ConfigureCommand("fanout_slow", CommandConfig{})
+
+		// slow waits for its context to be canceled, or a second to pass
+		slow := func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+
+		Convey("which all succeed, Wait returns nil", func() {
+			g, _ := NewGroup(context.Background())
+			for i := 0; i < 3; i++ {
+				g.Go("fanout", func(ctx context.Context) error { return nil }, nil)
+			}
+			So(g.Wait(), ShouldBeNil)
+		})
+
+		Convey("a failure cancels the others and is returned", func() {
+			g, ctx := NewGroup(context.Background())
+			failure := fmt.Errorf("failed")
+			g.Go("fanout_slow", slow, nil)
+			g.Go("fanout", func(ctx context.Context) error { return failure }, nil)
+
+			start := time.Now()
+			err := g.Wait()
+			So(errors.Is(err, failure), ShouldBeTrue)
+			So(ctx.Err(), ShouldEqual, context.Canceled)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("a failure whose fallback succeeds isn't a failure", func() {
+			g, _ := NewGroup(context.Background())
+			g.Go("fanout", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				return nil
+			})
+			So(g.Wait(), ShouldBeNil)
+		})
+
+		Convey("when a command's circuit is open", func() {
+			cb, _, _ := GetCircuit("fanout_open")
+			cb.setOpen()
+
+			Convey("the others run to completion, and the short-circuit is returned", func() {
+				g, _ := NewGroup(context.Background())
+				ran := make(chan error, 1)
+				g.Go("fanout_slow", func(ctx context.Context) error {
+					err := slow(ctx)
+					ran <- err
+					return err
+				}, nil)
+				g.Go("fanout_open", func(ctx context.Context) error { return nil }, nil)
+
+				So(errors.Is(g.Wait(), ErrCircuitOpen), ShouldBeTrue)
+				So(<-ran, ShouldBeNil)
+			})
+
+			Convey("with CancelOnShortCircuit, the others are canceled", func() {
+				g, _ := NewGroup(context.Background())
+				g.CancelOnShortCircuit = true
+				ran := make(chan error, 1)
+				g.Go("fanout_slow", func(ctx context.Context) error {
+					err := slow(ctx)
+					ran <- err
+					return err
+				}, nil)
+				g.Go("fanout_open", func(ctx context.Context) error { return nil }, nil)
+
+				So(errors.Is(g.Wait(), ErrCircuitOpen), ShouldBeTrue)
+				So(<-ran, ShouldEqual, context.Canceled)
+			})
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package hystrix
+
+import "context"
+
+// A CommandHandle controls a single execution started with GoHandle.
+type CommandHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Cancel aborts the execution, as canceling its context would, without affecting other commands
+// sharing that context. The command is recorded as canceled, and context.Canceled is sent on its
+// error channel, unless it had already finished.
+func (h *CommandHandle) Cancel() {
+	h.cancel()
+}
+
+// Done is closed once the execution has finished, whether it succeeded, failed or was canceled.
+func (h *CommandHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// GoHandle runs your function like GoC, also returning a handle with which the execution can be
+// canceled on its own, or waited for. Errors are sent on the returned channel just as GoC sends them.
+func GoHandle(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC) (*CommandHandle, chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &CommandHandle{cancel: cancel, done: make(chan struct{})}
+
+	// succeeded is sent to once, by whichever of run and the fallback succeeded as the command's
+	// outcome. A run which succeeds after the command timed out doesn't count.
+	succeeded := make(chan struct{}, 1)
+	signal := func() {
+		succeeded <- struct{}{}
+	}
+	var f fallbackFuncC
+	if fallback != nil {
+		f = func(ctx context.Context, runErr error) error {
+			err := fallback(ctx, runErr)
+			if err == nil {
+				signal()
+			}
+			return err
+		}
+	}
+
+	cmdErrs := goC(ctx, name, run, f, execOptions{succeeded: signal})
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(h.done)
+		defer cancel()
+
+		select {
+		case <-succeeded:
+		case err := <-cmdErrs:
+			errChan <- err
+		}
+	}()
+
+	return h, errChan
+}
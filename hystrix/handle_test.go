@@ -0,0 +1,75 @@
+package hystrix
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGoHandle(t *testing.T) {
+	Convey("with a command started with a handle", t, func() {
+		defer Flush()
+
+		Convey("canceling it aborts only that execution, recorded as canceled", func() {
+			ctx := context.Background()
+			h, errChan := GoHandle(ctx, "handle", func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}, nil)
+			other, otherErrs := GoHandle(ctx, "handle", func(ctx context.Context) error {
+				return nil
+			}, nil)
+
+			h.Cancel()
+			So(<-errChan, ShouldEqual, context.Canceled)
+			<-h.Done()
+
+			<-other.Done()
+			So(len(otherErrs), ShouldEqual, 0)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := GetCircuit("handle")
+			So(cb.Metrics().ContextCanceled().Sum(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("a failure is sent on its error channel before Done is closed", func() {
+			h, errChan := GoHandle(context.Background(), "handle", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, nil)
+
+			<-h.Done()
+			So((<-errChan).Error(), ShouldEqual, "failed")
+		})
+
+		Convey("a fallback's success is a success", func() {
+			h, errChan := GoHandle(context.Background(), "handle", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				return nil
+			})
+
+			<-h.Done()
+			So(len(errChan), ShouldEqual, 0)
+		})
+
+		Convey("a run which succeeds after timing out doesn't hide its fallback's failure", func() {
+			ConfigureCommand("handle", CommandConfig{Timeout: 10})
+			defer ConfigureCommand("handle", CommandConfig{})
+			h, errChan := GoHandle(context.Background(), "handle", func(ctx context.Context) error {
+				time.Sleep(30 * time.Millisecond)
+				return nil
+			}, func(ctx context.Context, err error) error {
+				time.Sleep(60 * time.Millisecond)
+				return fmt.Errorf("fallback failed")
+			})
+
+			<-h.Done()
+			So(len(errChan), ShouldEqual, 1)
+			So((<-errChan).Error(), ShouldContainSubstring, "fallback failed")
+		})
+	})
+}
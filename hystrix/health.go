@@ -0,0 +1,53 @@
+package hystrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// healthStatus is the body served by the handler from NewHealthHandler.
+type healthStatus struct {
+	Status string   `json:"status"`
+	Open   []string `json:"open"`
+}
+
+// NewHealthHandler returns a handler for load balancer health checks, which responds with 503
+// Service Unavailable while the circuit of any of the critical commands is open, and with 200 OK
+// otherwise. If no commands are given, every command's circuit is checked. Checking leaves the
+// circuits as they are: commands which haven't been used have no circuit and count as healthy, and
+// a circuit is reported by its state without being tripped. The body is JSON listing the open
+// circuits, such as
+//
+//	{"status":"unavailable","open":["payments"]}
+func NewHealthHandler(criticalCommands ...string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		names := criticalCommands
+		if len(names) == 0 {
+			names = CommandNames()
+		}
+
+		health := healthStatus{Status: "ok", Open: []string{}}
+		for _, name := range names {
+			cb, ok := circuitCache.Load(normalizeCommandName(name))
+			if !ok {
+				continue
+			}
+			if cb.(*CircuitBreaker).State() != CircuitClosed {
+				health.Open = append(health.Open, name)
+			}
+		}
+		sort.Strings(health.Open)
+
+		code := http.StatusOK
+		if len(health.Open) > 0 {
+			health.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(health)
+	})
+}
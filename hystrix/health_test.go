@@ -0,0 +1,71 @@
+package hystrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func checkHealth(h http.Handler) (int, healthStatus) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+
+	var health healthStatus
+	json.NewDecoder(rec.Body).Decode(&health)
+	return rec.Code, health
+}
+
+func TestHealthHandler(t *testing.T) {
+	Convey("with a closed and an open circuit", t, func() {
+		defer Flush()
+		GetCircuit("health_closed")
+		cb, _, _ := GetCircuit("health_open")
+		cb.setOpen()
+
+		Convey("checking the closed command is healthy", func() {
+			code, health := checkHealth(NewHealthHandler("health_closed"))
+			So(code, ShouldEqual, http.StatusOK)
+			So(health.Status, ShouldEqual, "ok")
+			So(health.Open, ShouldBeEmpty)
+		})
+
+		Convey("checking both commands lists the open one", func() {
+			code, health := checkHealth(NewHealthHandler("health_closed", "health_open"))
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+			So(health.Status, ShouldEqual, "unavailable")
+			So(health.Open, ShouldResemble, []string{"health_open"})
+		})
+
+		Convey("checking every command lists the open one", func() {
+			code, health := checkHealth(NewHealthHandler())
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+			So(health.Open, ShouldResemble, []string{"health_open"})
+		})
+
+		Convey("checking a command which hasn't been used doesn't create its circuit", func() {
+			code, _ := checkHealth(NewHealthHandler("health_unused"))
+			So(code, ShouldEqual, http.StatusOK)
+			_, created, _ := GetCircuit("health_unused")
+			So(created, ShouldBeTrue)
+		})
+	})
+
+	Convey("with a closed circuit whose errors would trip it", t, func() {
+		defer Flush()
+		ConfigureCommand("health_failing", CommandConfig{RequestVolumeThreshold: 1})
+		defer ConfigureCommand("health_failing", CommandConfig{})
+		cb, _, _ := GetCircuit("health_failing")
+		cb.ReportEvent([]string{"failure"}, time.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("checking it doesn't trip it", func() {
+			code, _ := checkHealth(NewHealthHandler("health_failing"))
+			So(code, ShouldEqual, http.StatusOK)
+			So(cb.State(), ShouldEqual, CircuitClosed)
+		})
+	})
+}
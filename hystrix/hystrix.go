@@ -2,8 +2,10 @@ package hystrix
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +24,182 @@ func (e CircuitError) Error() string {
 	return "hystrix: " + e.Message
 }
 
+// Is reports whether target is the same circuit error, allowing errors.Is to
+// recognise ErrCircuitOpen, ErrMaxConcurrency and ErrTimeout in fallbacks.
+func (e CircuitError) Is(target error) bool {
+	switch t := target.(type) {
+	case CircuitError:
+		return e.Message == t.Message
+	case *CircuitError:
+		return t != nil && e.Message == t.Message
+	}
+	return false
+}
+
+// A CommandError is returned by Do and DoC when a command fails. It keeps the error
+// which caused the command to fail alongside the fallback's error, if the fallback
+// failed too, and unwraps to the former.
+type CommandError struct {
+	// RunErr is the error returned by run, or the CircuitError or context error which prevented it from completing.
+	RunErr error
+	// FallbackErr is the error returned by the fallback, if one ran and failed.
+	FallbackErr error
+	// Type is "run", "timeout", "short-circuit" or "rejected", describing why the command
+	// did not succeed. It is "canceled" when the caller's context was canceled, and "draining"
+	// when the command was draining.
+	Type string
+}
+
+func (e CommandError) Error() string {
+	if e.FallbackErr != nil {
+		return fmt.Sprintf("fallback failed with '%v'. run error was '%v'", e.FallbackErr, e.RunErr)
+	}
+	return e.RunErr.Error()
+}
+
+// Unwrap returns the run error, so that errors.Is and errors.As see through to it.
+func (e CommandError) Unwrap() error {
+	return e.RunErr
+}
+
+// newCommandError describes err, which prevented a command from succeeding, as a CommandError.
+func newCommandError(err error) CommandError {
+	if ce, ok := err.(CommandError); ok {
+		return ce
+	}
+
+	errType := "run"
+	switch err {
+	case ErrCircuitOpen:
+		errType = "short-circuit"
+	case ErrMaxConcurrency, ErrRateLimited, ErrFallbackRequired, ErrNoDeadline:
+		errType = "rejected"
+	case ErrTimeout, context.DeadlineExceeded:
+		errType = "timeout"
+	case context.Canceled:
+		errType = "canceled"
+	case ErrDraining:
+		errType = "draining"
+	default:
+		if errors.Is(err, context.Canceled) {
+			errType = "canceled"
+		}
+	}
+
+	return CommandError{RunErr: err, Type: errType}
+}
+
+type commandScopeKey struct{}
+
+// commandScope is attached to the context handed to a command's run and fallback functions.
+type commandScope struct {
+	name string
+
+	mutex  sync.Mutex
+	done   bool
+	events []string
+	// runDuration is the duration reported by ReportRunDuration, when hasRunDuration is set.
+	runDuration    time.Duration
+	hasRunDuration bool
+	// fallbackQuality is the quality reported by ReportFallbackQuality.
+	fallbackQuality string
+}
+
+// finish returns the custom events reported within the scope. Events reported afterwards are dropped.
+func (s *commandScope) finish() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.done = true
+	return s.events
+}
+
+// reportedRunDuration returns the duration reported by ReportRunDuration, if there was one.
+func (s *commandScope) reportedRunDuration() (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.runDuration, s.hasRunDuration
+}
+
+// reportedFallbackQuality returns the quality reported by ReportFallbackQuality, or "" if there was none.
+func (s *commandScope) reportedFallbackQuality() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.fallbackQuality
+}
+
+// CommandNameFromContext returns the name of the command whose run or fallback
+// function was handed ctx. When commands are nested, the innermost name wins.
+func CommandNameFromContext(ctx context.Context) (string, bool) {
+	scope, ok := ctx.Value(commandScopeKey{}).(*commandScope)
+	if !ok {
+		return "", false
+	}
+	return scope.name, true
+}
+
+// ReportCustomEvent records an event of your own naming, such as "degraded" for a partial success,
+// against the command whose run or fallback function was handed ctx. Custom events are passed to
+// metric collectors alongside the command's outcome and do not affect the circuit's health.
+// Events reported once the command has finished are dropped.
+func ReportCustomEvent(ctx context.Context, eventType string) error {
+	scope, ok := ctx.Value(commandScopeKey{}).(*commandScope)
+	if !ok {
+		return fmt.Errorf("hystrix: context does not belong to a command")
+	}
+	if isBuiltinEvent(eventType) {
+		return fmt.Errorf("hystrix: %q is a built-in event type", eventType)
+	}
+
+	scope.mutex.Lock()
+	defer scope.mutex.Unlock()
+	if !scope.done {
+		scope.events = append(scope.events, eventType)
+	}
+	return nil
+}
+
+// ReportRunDuration records d, such as the latency the backend measured itself, as the run
+// duration of the command whose run function was handed ctx, in place of the time hystrix
+// measured around run, which includes local overhead and scheduling. It must be called before
+// run returns; otherwise, the measured duration is recorded.
+func ReportRunDuration(ctx context.Context, d time.Duration) error {
+	scope, ok := ctx.Value(commandScopeKey{}).(*commandScope)
+	if !ok {
+		return fmt.Errorf("hystrix: context does not belong to a command")
+	}
+
+	scope.mutex.Lock()
+	defer scope.mutex.Unlock()
+	scope.runDuration = d
+	scope.hasRunDuration = true
+	return nil
+}
+
+// ReportFallbackQuality labels the successful fallback of the command whose fallback function was
+// handed ctx with a quality of your own naming, such as "fresh" for a recent cached response and
+// "degraded" for a stale one, so that metric collectors can count fallbacks by how good they were.
+// The last quality reported before the fallback returns wins. Like custom events, qualities do
+// not affect the circuit's health.
+func ReportFallbackQuality(ctx context.Context, quality string) error {
+	scope, ok := ctx.Value(commandScopeKey{}).(*commandScope)
+	if !ok {
+		return fmt.Errorf("hystrix: context does not belong to a command")
+	}
+	if quality == "" {
+		return fmt.Errorf("hystrix: fallback quality is empty")
+	}
+
+	scope.mutex.Lock()
+	defer scope.mutex.Unlock()
+	if !scope.done {
+		scope.fallbackQuality = quality
+	}
+	return nil
+}
+
 // command models the state used for a single execution on a circuit. "hystrix command" is commonly
 // used to describe the pairing of your run/fallback functions with a circuit.
 type command struct {
@@ -36,6 +214,40 @@ type command struct {
 	fallback    fallbackFuncC
 	runDuration time.Duration
 	events      []string
+	errorWeight float64
+	scope       *commandScope
+	// err is the error which stopped the command succeeding, if any.
+	err error
+	// fallbackDuration is how long the fallback took, if it ran.
+	fallbackDuration time.Duration
+	// override is the Override the command was executed with, if any.
+	override Override
+	// noTicket is set when the command took no ticket from the executor pool, as its NoTicket
+	// setting asks, and holds one which stands in for it.
+	noTicket bool
+	// detached is set when the caller runs a fallback of its own, as execOptions describe.
+	detached bool
+	// succeeded is called once run's success is settled as the outcome, as execOptions describe.
+	succeeded func()
+	// probe is set while the command holds its circuit's probe, until its outcome reports it.
+	probe bool
+
+	// ticketCond is signalled once ticketChecked is set, after the command has tried to take a ticket.
+	ticketCond    *sync.Cond
+	ticketChecked bool
+	// returned is set by whichever goroutine settles the command's outcome first.
+	returned int32
+	// live counts the goroutines still using the command. The last to finish returns it to commandPool.
+	live int32
+}
+
+// commandPool recycles commands between executions to spare the garbage collector.
+var commandPool = sync.Pool{
+	New: func() interface{} {
+		c := &command{finished: make(chan bool, 1)}
+		c.ticketCond = sync.NewCond(c)
+		return c
+	},
 }
 
 var (
@@ -45,6 +257,16 @@ var (
 	ErrCircuitOpen = CircuitError{Message: "circuit open"}
 	// ErrTimeout occurs when the provided function takes too long to execute.
 	ErrTimeout = CircuitError{Message: "timeout"}
+	// ErrRateLimited occurs when a command is executed more often than its MaxRequestsPerSecond allows.
+	ErrRateLimited = CircuitError{Message: "rate limit exceeded"}
+	// ErrFallbackRequired occurs when a command configured with RequireFallback is executed without a fallback.
+	ErrFallbackRequired = CircuitError{Message: "fallback required"}
+	// ErrNoDeadline occurs when DoCContextTimeout is given a context without a deadline.
+	ErrNoDeadline = CircuitError{Message: "context has no deadline"}
+	// ErrMaxFallbackConcurrency occurs when a fallback is rejected because MaxConcurrentFallbacks are already running.
+	ErrMaxFallbackConcurrency = CircuitError{Message: "max fallback concurrency"}
+	// ErrDraining occurs when a command is executed while it is draining, as started by StartDraining or StartDrainingCommand.
+	ErrDraining = CircuitError{Message: "draining"}
 )
 
 // Go runs your function while tracking the health of previous calls to it.
@@ -52,6 +274,8 @@ var (
 // new calls to it for you to give the dependent service time to repair.
 //
 // Define a fallback function if you want to define some code to execute during outages.
+// Without one, the error which stopped your function from succeeding is sent on the
+// returned channel as is, and no fallback metrics are recorded.
 func Go(name string, run runFunc, fallback fallbackFunc) chan error {
 	runC := func(ctx context.Context) error {
 		return run()
@@ -70,135 +294,289 @@ func Go(name string, run runFunc, fallback fallbackFunc) chan error {
 // new calls to it for you to give the dependent service time to repair.
 //
 // Define a fallback function if you want to define some code to execute during outages.
+// The error given to the fallback is ErrCircuitOpen, ErrMaxConcurrency, ErrRateLimited or ErrTimeout when
+// the command did not run to completion, the context's error when ctx ended first, and
+// otherwise the error returned by run. These are passed unwrapped, so a fallback can tell
+// a timeout from a failure by comparing against the sentinel errors with == or errors.Is.
+// Without a fallback, that same error is sent on the returned channel as is, and no fallback
+// metrics are recorded. Commands configured with RequireFallback fail with ErrFallbackRequired,
+// without running, when fallback is nil.
+//
+// Cancellation is the caller's decision rather than a failure of the backend: when ctx is
+// canceled, or run returns an error which is context.Canceled, the command is recorded as
+// canceled, which doesn't count towards the error percentage, and the error is sent on the
+// returned channel without calling the fallback.
 func GoC(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC) chan error {
-	cmd := &command{
-		run:      run,
-		fallback: fallback,
-		start:    time.Now(),
-		errChan:  make(chan error, 1),
-		finished: make(chan bool, 1),
+	return goC(ctx, name, run, fallback, execOptions{})
+}
+
+// GoCWithStart runs your function like GoC, measuring the command's total duration from startedAt
+// rather than from the call, so that it includes time the request spent queued beforehand. A zero
+// startedAt behaves exactly like GoC.
+func GoCWithStart(ctx context.Context, name string, startedAt time.Time, run runFuncC, fallback fallbackFuncC) chan error {
+	return goC(ctx, name, run, fallback, execOptions{startedAt: startedAt})
+}
+
+// execOptions say how goC executes a command, beyond what GoC is given.
+type execOptions struct {
+	// deadlineTimeout times the command out when ctx's deadline passes rather than after the
+	// configured Timeout.
+	deadlineTimeout bool
+	// inline runs the command on the caller's goroutine without timing out, so that it has
+	// finished by the time goC returns.
+	inline bool
+	// startedAt, unless zero, is when the command's total duration is measured from.
+	startedAt time.Time
+	// detached is set by callers which run a fallback of their own once the command has failed,
+	// such as GoCDedup and GoCRetry. The command runs without a fallback, yet is neither refused
+	// by RequireFallback nor recorded as having skipped its fallback.
+	detached bool
+	// succeeded, when set, is called once run's success is the command's outcome, rather than
+	// whenever run returns nil, as it may after the command has timed out.
+	succeeded func()
+}
+
+// goC runs a command as opts say.
+func goC(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC, opts execOptions) chan error {
+	name = normalizeCommandName(name)
+	if fallback == nil && !opts.detached && getSettings(name).RequireFallback {
+		errChan := make(chan error, 1)
+		errChan <- ErrFallbackRequired
+		return errChan
+	}
+	run = applyMiddleware(name, run)
+	if getSettings(name).RecoverPanics {
+		run = recoverRun(run)
+		if fallback != nil {
+			fallback = recoverFallback(fallback)
+		}
+	}
+
+	scope := &commandScope{name: name}
+	ctx = context.WithValue(ctx, commandScopeKey{}, scope)
+	override, overridden := overrideFrom(ctx)
+	if overridden {
+		// the override is for this execution alone, not those its run and fallback start
+		ctx = context.WithValue(ctx, overrideKey{}, nil)
 	}
 
+	cmd := commandPool.Get().(*command)
+	cmd.scope = scope
+	cmd.override = override
+	cmd.run = run
+	cmd.fallback = fallback
+	cmd.detached = opts.detached
+	cmd.succeeded = opts.succeeded
+	cmd.start = opts.startedAt
+	if cmd.start.IsZero() {
+		cmd.start = clockNow()
+	}
+	cmd.errChan = make(chan error, 1)
+	errChan := cmd.errChan
+
 	// dont have methods with explicit params and returns
 	// let data come in and out naturally, like with any closure
 	// explicit error return to give place for us to kill switch the operation (fallback)
 
-	circuit, _, err := GetCircuit(name)
+	circuit, err := enterCircuit(name)
 	if err != nil {
-		cmd.errChan <- err
-		return cmd.errChan
+		errChan <- err
+		cmd.live = 1
+		cmd.release()
+		return errChan
 	}
 	cmd.circuit = circuit
-	ticketCond := sync.NewCond(cmd)
-	ticketChecked := false
-	// When the caller extracts error from returned errChan, it's assumed that
-	// the ticket's been returned to executorPool. Therefore, returnTicket() can
-	// not run after cmd.errorWithFallback().
-	returnTicket := func() {
-		cmd.Lock()
-		// Avoid releasing before a ticket is acquired.
-		for !ticketChecked {
-			ticketCond.Wait()
-		}
-		cmd.circuit.executorPool.Return(cmd.ticket)
-		cmd.Unlock()
-	}
-	// Shared by the following two goroutines. It ensures only the faster
-	// goroutine runs errWithFallback() and reportAllEvent().
-	returnOnce := &sync.Once{}
-	reportAllEvent := func() {
-		err := cmd.circuit.ReportEvent(cmd.events, cmd.start, cmd.runDuration)
-		if err != nil {
-			log.Printf(err.Error())
-		}
+
+	if opts.inline {
+		cmd.live = 1
+		defer cmd.release()
+		cmd.execute(ctx, ctx, func() {}, opts.deadlineTimeout)
+		return errChan
+	}
+
+	// Commands which stop when their circuit opens run with a context of their own,
+	// canceled if the circuit opens before they finish.
+	runCtx, cancelRun := ctx, context.CancelFunc(func() {})
+	var circuitOpened <-chan struct{}
+	if getSettings(name).CancelOnOpen {
+		runCtx, cancelRun = context.WithCancel(ctx)
+		circuitOpened = circuit.openSignal()
 	}
 
+	// Both goroutines below use cmd; whichever finishes last returns it to the pool.
+	cmd.live = 2
+
 	go func() {
+		defer cmd.release()
 		defer func() { cmd.finished <- true }()
 
-		// Circuits get opened when recent executions have shown to have a high error rate.
-		// Rejecting new executions allows backends to recover, and the circuit will allow
-		// new traffic when it feels a healthly state has returned.
-		if !cmd.circuit.AllowRequest() {
-			cmd.Lock()
-			// It's safe for another goroutine to go ahead releasing a nil ticket.
-			ticketChecked = true
-			ticketCond.Signal()
-			cmd.Unlock()
-			returnOnce.Do(func() {
-				returnTicket()
-				cmd.errorWithFallback(ctx, ErrCircuitOpen)
-				reportAllEvent()
-			})
-			return
+		cmd.execute(ctx, runCtx, cancelRun, opts.deadlineTimeout)
+	}()
+
+	go func() {
+		defer cmd.release()
+
+		var timeout <-chan time.Time
+		if !opts.deadlineTimeout {
+			runTimeout := cmd.timeout()
+			if total := getSettings(name).TotalTimeout; total > 0 && total < runTimeout {
+				runTimeout = total
+			}
+			timer := time.NewTimer(runTimeout)
+			defer timer.Stop()
+			timeout = timer.C
 		}
 
-		// As backends falter, requests take longer but don't always fail.
-		//
-		// When requests slow down but the incoming rate of requests stays the same, you have to
-		// run more at a time to keep up. By controlling concurrency during these situations, you can
-		// shed load which accumulates due to the increasing ratio of active commands to incoming requests.
-		cmd.Lock()
 		select {
-		case cmd.ticket = <-circuit.executorPool.Tickets:
-			ticketChecked = true
-			ticketCond.Signal()
-			cmd.Unlock()
-		default:
-			ticketChecked = true
-			ticketCond.Signal()
-			cmd.Unlock()
-			returnOnce.Do(func() {
-				returnTicket()
-				cmd.errorWithFallback(ctx, ErrMaxConcurrency)
-				reportAllEvent()
-			})
-			return
+		case <-cmd.finished:
+			// the outcome has been settled in another goroutine
+		case <-ctx.Done():
+			err := ctx.Err()
+			if opts.deadlineTimeout && err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			cmd.settle(ctx, err)
+		case <-timeout:
+			cmd.settle(ctx, ErrTimeout)
+		case <-circuitOpened:
+			cmd.settle(ctx, ErrCircuitOpen)
+			cancelRun()
 		}
+	}()
+
+	return errChan
+}
 
-		runStart := time.Now()
-		runErr := run(ctx)
-		returnOnce.Do(func() {
-			defer reportAllEvent()
-			cmd.runDuration = time.Since(runStart)
-			returnTicket()
-			if runErr != nil {
-				cmd.errorWithFallback(ctx, runErr)
-				return
+// execute runs the command once its circuit, rate limit and concurrency allow, settling its outcome
+// unless the goroutine watching for timeouts has already done so. run is given runCtx.
+func (c *command) execute(ctx, runCtx context.Context, cancelRun context.CancelFunc, deadlineTimeout bool) {
+	// A command being shut down lets the executions it has already started finish, but starts no more.
+	if isDraining(c.circuit.Name) {
+		c.Lock()
+		c.ticketChecked = true
+		c.ticketCond.Signal()
+		c.Unlock()
+		c.settle(ctx, ErrDraining)
+		return
+	}
+
+	// Circuits get opened when recent executions have shown to have a high error rate.
+	// Rejecting new executions allows backends to recover, and the circuit will allow
+	// new traffic when it feels a healthly state has returned.
+	allowed, probe := c.circuit.allowRequest()
+	if probe {
+		c.Lock()
+		c.probe = true
+		c.Unlock()
+		// a probe which the command's outcome didn't report, such as one let through after the
+		// command timed out, mustn't keep the circuit from letting another through
+		defer func() {
+			c.Lock()
+			unreported := c.probe
+			c.probe = false
+			c.Unlock()
+			if unreported {
+				c.circuit.endProbe()
 			}
-			cmd.reportEvent("success")
-		})
-	}()
+		}()
+	}
+	if !allowed {
+		c.Lock()
+		// It's safe for another goroutine to go ahead releasing a nil ticket.
+		c.ticketChecked = true
+		c.ticketCond.Signal()
+		c.Unlock()
+		c.settle(ctx, ErrCircuitOpen)
+		return
+	}
 
-	go func() {
-		timer := time.NewTimer(getSettings(name).Timeout)
-		defer timer.Stop()
+	// Some backends can only take so many requests a second, however quickly they answer.
+	if !c.circuit.allowRate() {
+		c.Lock()
+		c.ticketChecked = true
+		c.ticketCond.Signal()
+		c.Unlock()
+		c.settle(ctx, ErrRateLimited)
+		return
+	}
 
-		select {
-		case <-cmd.finished:
-			// returnOnce has been executed in another goroutine
-		case <-ctx.Done():
-			returnOnce.Do(func() {
-				returnTicket()
-				cmd.errorWithFallback(ctx, ctx.Err())
-				reportAllEvent()
-			})
-			return
-		case <-timer.C:
-			returnOnce.Do(func() {
-				returnTicket()
-				cmd.errorWithFallback(ctx, ErrTimeout)
-				reportAllEvent()
-			})
+	// As backends falter, requests take longer but don't always fail.
+	//
+	// When requests slow down but the incoming rate of requests stays the same, you have to
+	// run more at a time to keep up. By controlling concurrency during these situations, you can
+	// shed load which accumulates due to the increasing ratio of active commands to incoming requests.
+	var ticket *struct{}
+	if getSettings(c.circuit.Name).NoTicket {
+		c.noTicket = true
+		ticket = &struct{}{}
+	} else {
+		ticket = c.circuit.executorPool.tryAcquire()
+	}
+	queued := false
+	if wait := c.maxQueueWait(); ticket == nil && wait > 0 {
+		// Commands allowed to queue wait for a ticket to be returned. Meanwhile they may time out,
+		// or be canceled, so they are marked as holding no ticket while they wait.
+		queued = true
+		c.Lock()
+		c.ticketChecked = true
+		c.ticketCond.Signal()
+		c.Unlock()
+		ticket = c.circuit.executorPool.acquire(ctx, wait)
+		if ticket == nil && ctx.Err() != nil {
+			err := ctx.Err()
+			if deadlineTimeout && err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			c.settle(ctx, err)
 			return
 		}
-	}()
+	}
 
-	return cmd.errChan
+	c.Lock()
+	if ticket == nil {
+		c.ticketChecked = true
+		c.ticketCond.Signal()
+		c.Unlock()
+		c.settle(ctx, ErrMaxConcurrency)
+		return
+	}
+	if queued && atomic.LoadInt32(&c.returned) == 1 {
+		// the command was settled while it waited, so it won't run
+		c.Unlock()
+		c.circuit.executorPool.put(ticket)
+		return
+	}
+	c.ticket = ticket
+	c.ticketChecked = true
+	c.ticketCond.Signal()
+	c.Unlock()
+
+	runStart := clockNow()
+	runErr := c.run(runCtx)
+	cancelRun()
+	if runErr != nil && deadlineTimeout && ctx.Err() == context.DeadlineExceeded {
+		runErr = ErrTimeout
+	}
+	if c.claim() {
+		c.runDuration = clockNow().Sub(runStart)
+		if d, ok := c.scope.reportedRunDuration(); ok {
+			c.runDuration = d
+		}
+		c.returnTicket()
+		if runErr != nil {
+			c.errorWithFallback(ctx, runErr)
+		} else {
+			c.reportEvent("success")
+			if c.succeeded != nil {
+				c.succeeded()
+			}
+		}
+		c.reportAllEvent()
+	}
 }
 
 // Do runs your function in a synchronous manner, blocking until either your function succeeds
-// or an error is returned, including hystrix circuit errors
+// or an error is returned, including hystrix circuit errors. Errors are returned as a CommandError.
 func Do(name string, run runFunc, fallback fallbackFunc) error {
 	runC := func(ctx context.Context) error {
 		return run()
@@ -213,18 +591,67 @@ func Do(name string, run runFunc, fallback fallbackFunc) error {
 }
 
 // DoC runs your function in a synchronous manner, blocking until either your function succeeds
-// or an error is returned, including hystrix circuit errors
+// or an error is returned, including hystrix circuit errors. Errors are returned as a CommandError.
 func DoC(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC) error {
-	done := make(chan struct{}, 1)
+	return doC(ctx, name, run, fallback, execOptions{})
+}
 
-	r := func(ctx context.Context) error {
-		err := run(ctx)
-		if err != nil {
-			return err
+// DoCContextTimeout runs your function like DoC, but times it out only when ctx's deadline passes,
+// ignoring the command's configured Timeout. A deadline passing is reported as a timeout, and the
+// fallback is given ErrTimeout. A context without a deadline is refused with ErrNoDeadline.
+func DoCContextTimeout(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return newCommandError(ErrNoDeadline)
+	}
+	return doC(ctx, name, run, fallback, execOptions{deadlineTimeout: true})
+}
+
+// Try reports whether an execution of the command would currently be let through, and if not, the
+// error it would fail with: ErrDraining, ErrCircuitOpen, ErrRateLimited or ErrMaxConcurrency. It takes nothing from the
+// command, neither a ticket nor its circuit's recovery test, so it can be used to skip preparing an
+// execution which would be rejected. The answer is advisory; an execution started afterwards may still
+// be rejected if other executions get in first.
+func Try(name string) (bool, error) {
+	circuit, _, err := GetCircuit(name)
+	if err != nil {
+		return false, err
+	}
+
+	if isDraining(circuit.Name) {
+		return false, ErrDraining
+	}
+	if circuit.IsOpen() && !circuit.wouldAllowSingleTest() {
+		return false, ErrCircuitOpen
+	}
+	if !circuit.wouldAllowRate() {
+		return false, ErrRateLimited
+	}
+	if !getSettings(circuit.Name).NoTicket && !circuit.executorPool.canAcquire() {
+		return false, ErrMaxConcurrency
+	}
+	return true, nil
+}
+
+// doC runs a command like DoC, as opts say. opts.inline is set here when the command's settings ask.
+func doC(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC, opts execOptions) error {
+	name = normalizeCommandName(name)
+	if settings := getSettings(name); settings.RunInline && !settings.CancelOnOpen {
+		// the command has finished when goC returns, and failed if it sent an error
+		opts.inline = true
+		select {
+		case err := <-goC(ctx, name, run, fallback, opts):
+			return newCommandError(err)
+		default:
+			return nil
 		}
+	}
 
+	// done is sent to once, by whichever of run and the fallback succeeded as the command's
+	// outcome. A run which succeeds after the command timed out, while the fallback may still be
+	// running, doesn't count.
+	done := make(chan struct{}, 1)
+	opts.succeeded = func() {
 		done <- struct{}{}
-		return nil
 	}
 
 	f := func(ctx context.Context, e error) error {
@@ -239,17 +666,117 @@ func DoC(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC)
 
 	var errChan chan error
 	if fallback == nil {
-		errChan = GoC(ctx, name, r, nil)
+		errChan = goC(ctx, name, run, nil, opts)
 	} else {
-		errChan = GoC(ctx, name, r, f)
+		errChan = goC(ctx, name, run, f, opts)
 	}
 
 	select {
 	case <-done:
 		return nil
 	case err := <-errChan:
-		return err
+		return newCommandError(err)
+	}
+}
+
+// claim reports whether the caller is the first to settle the command's outcome, which
+// only one of the goroutines running the command may do.
+func (c *command) claim() bool {
+	return atomic.CompareAndSwapInt32(&c.returned, 0, 1)
+}
+
+// settle records err as the command's outcome and runs the fallback, unless the outcome
+// has already been settled.
+func (c *command) settle(ctx context.Context, err error) {
+	if !c.claim() {
+		return
 	}
+	c.returnTicket()
+	c.errorWithFallback(ctx, err)
+	c.reportAllEvent()
+}
+
+// returnTicket gives the command's ticket back to the executor pool. When the caller
+// extracts error from errChan, it's assumed that the ticket's been returned to
+// executorPool. Therefore, returnTicket() can not run after errorWithFallback().
+func (c *command) returnTicket() {
+	c.Lock()
+	// Avoid releasing before a ticket is acquired.
+	for !c.ticketChecked {
+		c.ticketCond.Wait()
+	}
+	switch {
+	case c.noTicket:
+		// nothing was taken from the pool, nor is counted in its metrics
+	case getSettings(c.circuit.Name).DisableMetrics:
+		// returned without counting it in the pool's metrics
+		if c.ticket != nil {
+			c.circuit.executorPool.put(c.ticket)
+		}
+	default:
+		c.circuit.executorPool.Return(c.ticket)
+	}
+	c.Unlock()
+}
+
+func (c *command) reportAllEvent() {
+	c.Lock()
+	c.events = append(c.events, c.scope.finish()...)
+	probe := c.probe
+	c.probe = false
+	c.Unlock()
+
+	err := c.circuit.reportExecution(&commandExecution{
+		Types:            c.events,
+		Start:            c.start,
+		RunDuration:      c.runDuration,
+		ErrorWeight:      c.errorWeight,
+		FallbackQuality:  c.scope.reportedFallbackQuality(),
+		FallbackDuration: c.fallbackDuration,
+		probe:            probe,
+		command:          true,
+	})
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	c.observeOutcome()
+}
+
+// release is called as each goroutine running the command finishes. The last one
+// resets the command and returns it to commandPool.
+func (c *command) release() {
+	if atomic.AddInt32(&c.live, -1) > 0 {
+		return
+	}
+
+	if c.circuit != nil {
+		atomic.AddInt64(&c.circuit.executing, -1)
+	}
+	c.ticket = nil
+	c.errChan = nil
+	c.circuit = nil
+	c.run = nil
+	c.fallback = nil
+	c.scope = nil
+	c.runDuration = 0
+	c.fallbackDuration = 0
+	c.override = Override{}
+	c.noTicket = false
+	c.detached = false
+	c.succeeded = nil
+	c.probe = false
+	c.errorWeight = 0
+	c.err = nil
+	// the events slice was handed to the metrics exchange, so it can't be reused
+	c.events = nil
+	c.ticketChecked = false
+	c.returned = 0
+	select {
+	case <-c.finished:
+	default:
+	}
+
+	commandPool.Put(c)
 }
 
 func (c *command) reportEvent(eventType string) {
@@ -259,22 +786,52 @@ func (c *command) reportEvent(eventType string) {
 	c.events = append(c.events, eventType)
 }
 
-// errorWithFallback triggers the fallback while reporting the appropriate metric events.
-func (c *command) errorWithFallback(ctx context.Context, err error) {
+// errorEventType is the metric event which err, having stopped a command succeeding, is reported as.
+func errorEventType(err error) string {
 	eventType := "failure"
 	if err == ErrCircuitOpen {
 		eventType = "short-circuit"
-	} else if err == ErrMaxConcurrency {
+	} else if err == ErrMaxConcurrency || err == ErrRateLimited {
 		eventType = "rejected"
+	} else if err == ErrDraining {
+		eventType = "draining"
 	} else if err == ErrTimeout {
 		eventType = "timeout"
-	} else if err == context.Canceled {
+	} else if errors.Is(err, context.Canceled) {
 		eventType = "context_canceled"
 	} else if err == context.DeadlineExceeded {
 		eventType = "context_deadline_exceeded"
 	}
+	return eventType
+}
+
+// errorWithFallback triggers the fallback while reporting the appropriate metric events.
+func (c *command) errorWithFallback(ctx context.Context, err error) {
+	c.err = err
+	eventType := errorEventType(err)
+
+	if eventType == "context_canceled" {
+		// the caller has given up, so there is no one to serve a fallback to
+		c.reportEvent(eventType)
+		c.errChan <- err
+		return
+	}
+
+	if weigh := getSettings(c.circuit.Name).ErrorWeight; weigh != nil {
+		c.errorWeight = weigh(err)
+	}
 
 	c.reportEvent(eventType)
+	if eventType == "short-circuit" && getSettings(c.circuit.Name).SkipFallbackOnOpen {
+		// the caller would rather have the error at once than wait for the fallback
+		c.reportEvent("fallback-skipped")
+		c.errChan <- err
+		return
+	}
+	if c.fallback == nil && !c.detached && (eventType == "short-circuit" || eventType == "rejected" || eventType == "draining") {
+		// run never started and there is nothing to serve in its place
+		c.reportEvent("fallback-skipped")
+	}
 	fallbackErr := c.tryFallback(ctx, err)
 	if fallbackErr != nil {
 		c.errChan <- fallbackErr
@@ -287,13 +844,64 @@ func (c *command) tryFallback(ctx context.Context, err error) error {
 		return err
 	}
 
-	fallbackErr := c.fallback(ctx, err)
+	if !c.circuit.acquireFallback() {
+		c.reportEvent("fallback-failure")
+		c.reportEvent("fallback-rejected")
+		return fallbackFailedError(ErrMaxFallbackConcurrency, err)
+	}
+	fallbackStart := clockNow()
+	fallbackErr := c.callFallback(ctx, err)
+	c.fallbackDuration = clockNow().Sub(fallbackStart)
 	if fallbackErr != nil {
 		c.reportEvent("fallback-failure")
-		return fmt.Errorf("fallback failed with '%v'. run error was '%v'", fallbackErr, err)
+		return fallbackFailedError(fallbackErr, err)
 	}
 
 	c.reportEvent("fallback-success")
 
 	return nil
 }
+
+// callFallback runs the fallback, which holds one of the circuit's concurrent fallbacks. With a
+// TotalTimeout, the fallback is given what is left of it, and abandoned with ErrTimeout if it
+// hasn't returned by then.
+func (c *command) callFallback(ctx context.Context, err error) error {
+	total := getSettings(c.circuit.Name).TotalTimeout
+	if total <= 0 {
+		defer c.circuit.releaseFallback()
+		return c.fallback(ctx, err)
+	}
+
+	remaining := total - clockNow().Sub(c.start)
+	if remaining <= 0 {
+		c.circuit.releaseFallback()
+		return ErrTimeout
+	}
+	fallbackCtx, cancel := context.WithTimeout(ctx, remaining)
+	defer cancel()
+
+	// an abandoned fallback still counts as running until it returns
+	circuit, fallback := c.circuit, c.fallback
+	done := make(chan error, 1)
+	go func() {
+		defer circuit.releaseFallback()
+		done <- fallback(fallbackCtx, err)
+	}()
+
+	select {
+	case fallbackErr := <-done:
+		return fallbackErr
+	case <-fallbackCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrTimeout
+	}
+}
+
+// fallbackFailedError describes a fallback which failed after the run error it was handling.
+func fallbackFailedError(fallbackErr, runErr error) error {
+	ce := newCommandError(runErr)
+	ce.FallbackErr = fallbackErr
+	return ce
+}
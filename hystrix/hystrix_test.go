@@ -2,7 +2,9 @@ package hystrix
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -157,6 +159,47 @@ func TestMaxConcurrent(t *testing.T) {
 	})
 }
 
+func TestMaxRequestsPerSecond(t *testing.T) {
+	Convey("if a command is limited to 2 requests per second", t, func() {
+		defer Flush()
+		ConfigureCommand("", CommandConfig{MaxRequestsPerSecond: 2})
+		run := func(ctx context.Context) error {
+			return nil
+		}
+
+		Convey("and 3 of those commands execute at once", func() {
+			var good, bad int
+			for i := 0; i < 3; i++ {
+				err := DoC(context.Background(), "", run, nil)
+				if errors.Is(err, ErrRateLimited) {
+					bad++
+				} else if err == nil {
+					good++
+				}
+			}
+
+			Convey("one will return a 'rate limit exceeded' error", func() {
+				So(good, ShouldEqual, 2)
+				So(bad, ShouldEqual, 1)
+			})
+
+			Convey("it is recorded as a rejection", func() {
+				time.Sleep(10 * time.Millisecond)
+				cb, _, _ := GetCircuit("")
+				So(cb.Metrics().RejectCount(time.Now()), ShouldEqual, 1)
+			})
+
+			Convey("and the limit is lifted", func() {
+				ConfigureCommand("", CommandConfig{})
+
+				Convey("commands are no longer rejected", func() {
+					So(DoC(context.Background(), "", run, nil), ShouldBeNil)
+				})
+			})
+		})
+	})
+}
+
 func TestForceOpenCircuit(t *testing.T) {
 	Convey("when a command with a forced open circuit is run", t, func() {
 		defer Flush()
@@ -183,6 +226,40 @@ func TestForceOpenCircuit(t *testing.T) {
 	})
 }
 
+func TestCancelOnOpen(t *testing.T) {
+	Convey("with a command which is canceled when its circuit opens", t, func() {
+		defer Flush()
+		defer ConfigureCommand("", CommandConfig{})
+		ConfigureCommand("", CommandConfig{CancelOnOpen: true})
+
+		started := make(chan struct{})
+		runErr := make(chan error, 1)
+		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			runErr <- ctx.Err()
+			return ctx.Err()
+		}, nil)
+		<-started
+
+		Convey("opening the circuit mid-flight", func() {
+			cb, _, _ := GetCircuit("")
+			cb.setOpen()
+
+			Convey("returns a 'circuit open' error and cancels the run function", func() {
+				So(<-errChan, ShouldResemble, ErrCircuitOpen)
+				So(<-runErr, ShouldEqual, context.Canceled)
+
+				Convey("and records a short-circuit rather than a failure", func() {
+					time.Sleep(10 * time.Millisecond)
+					So(cb.Metrics().ShortCircuitCount(time.Now()), ShouldEqual, 1)
+					So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
+
 func TestNilFallbackRunError(t *testing.T) {
 	Convey("when your run function returns an error and you have no fallback", t, func() {
 		defer Flush()
@@ -198,6 +275,30 @@ func TestNilFallbackRunError(t *testing.T) {
 	})
 }
 
+func TestRequireFallback(t *testing.T) {
+	Convey("when a command requires a fallback", t, func() {
+		defer Flush()
+		defer ConfigureCommand("", CommandConfig{})
+		ConfigureCommand("", CommandConfig{RequireFallback: true})
+
+		Convey("running it without one fails without running", func() {
+			ran := false
+			err := <-GoC(context.Background(), "", func(ctx context.Context) error {
+				ran = true
+				return nil
+			}, nil)
+
+			So(err, ShouldResemble, ErrFallbackRequired)
+			So(ran, ShouldBeFalse)
+		})
+
+		Convey("running it with one succeeds", func() {
+			err := Do("", func() error { return nil }, func(err error) error { return nil })
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
 func TestFailedFallback(t *testing.T) {
 	Convey("when your run and fallback functions return an error", t, func() {
 		defer Flush()
@@ -474,19 +575,36 @@ func TestContextHandling(t *testing.T) {
 			So(cb.metrics.DefaultCollector().ContextDeadlineExceeded().Sum(time.Now()), ShouldEqual, 0)
 		})
 
-		Convey("with a canceled context and a fallback", func() {
+		Convey("with a canceled context and a fallback, the fallback is skipped", func() {
 			testCtx, cancel := context.WithCancel(context.Background())
 			errChan := GoC(testCtx, "", run, fallback)
 			time.Sleep(5 * time.Millisecond)
 			cancel()
 			time.Sleep(20 * time.Millisecond)
-			So(len(errChan), ShouldEqual, 0)
+			So(<-errChan, ShouldEqual, context.Canceled)
 			So(cb.metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 1)
 			So(cb.metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 0)
 			So(cb.metrics.DefaultCollector().Timeouts().Sum(time.Now()), ShouldEqual, 0)
 			So(cb.metrics.DefaultCollector().ContextCanceled().Sum(time.Now()), ShouldEqual, 1)
 			So(cb.metrics.DefaultCollector().ContextDeadlineExceeded().Sum(time.Now()), ShouldEqual, 0)
-			So(cb.metrics.DefaultCollector().FallbackSuccesses().Sum(time.Now()), ShouldEqual, 1)
+			So(cb.metrics.DefaultCollector().FallbackSuccesses().Sum(time.Now()), ShouldEqual, 0)
+		})
+
+		Convey("with a run which returns a wrapped cancellation", func() {
+			canceled := fmt.Errorf("query aborted: %w", context.Canceled)
+			fallbackCalled := false
+			errChan := GoC(context.Background(), "", func(ctx context.Context) error {
+				return canceled
+			}, func(ctx context.Context, e error) error {
+				fallbackCalled = true
+				return nil
+			})
+			So(<-errChan, ShouldEqual, canceled)
+			time.Sleep(5 * time.Millisecond)
+			So(fallbackCalled, ShouldBeFalse)
+			So(cb.metrics.DefaultCollector().Errors().Sum(time.Now()), ShouldEqual, 0)
+			So(cb.metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 0)
+			So(cb.metrics.DefaultCollector().ContextCanceled().Sum(time.Now()), ShouldEqual, 1)
 		})
 
 	})
@@ -547,6 +665,25 @@ func TestDoC(t *testing.T) {
 
 			Convey("both errors are returned", func() {
 				So(err.Error(), ShouldEqual, "fallback failed with 'fallback failed'. run error was 'i failed'")
+
+				var ce CommandError
+				So(errors.As(err, &ce), ShouldBeTrue)
+				So(ce.Type, ShouldEqual, "run")
+				So(ce.RunErr.Error(), ShouldEqual, "i failed")
+				So(ce.FallbackErr.Error(), ShouldEqual, "fallback failed")
+			})
+		})
+
+		Convey("with a domain error", func() {
+			errDomain := fmt.Errorf("domain")
+			err := DoC(context.Background(), "", func(ctx context.Context) error {
+				return errDomain
+			}, func(ctx context.Context, err error) error {
+				return fmt.Errorf("fallback failed")
+			})
+
+			Convey("the run error can be unwrapped", func() {
+				So(errors.Is(err, errDomain), ShouldBeTrue)
 			})
 		})
 	})
@@ -563,6 +700,724 @@ func TestDoC(t *testing.T) {
 
 		Convey("the timeout error is returned", func() {
 			So(err.Error(), ShouldEqual, "hystrix: timeout")
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(err.(CommandError).Type, ShouldEqual, "timeout")
+		})
+	})
+}
+
+func TestDoCContextTimeout(t *testing.T) {
+	Convey("with a command configured to time out after 10ms", t, func() {
+		defer Flush()
+
+		ConfigureCommand("ctx_timeout", CommandConfig{Timeout: 10})
+
+		Convey("a context without a deadline is refused", func() {
+			err := DoCContextTimeout(context.Background(), "ctx_timeout", func(ctx context.Context) error {
+				return nil
+			}, nil)
+			So(errors.Is(err, ErrNoDeadline), ShouldBeTrue)
+		})
+
+		Convey("the configured timeout is ignored in favour of the deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := DoCContextTimeout(ctx, "ctx_timeout", func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("the deadline passing is reported as a timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			var fallbackErr error
+			err := DoCContextTimeout(ctx, "ctx_timeout", func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}, func(ctx context.Context, err error) error {
+				fallbackErr = err
+				return err
+			})
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(fallbackErr, ShouldEqual, ErrTimeout)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := GetCircuit("ctx_timeout")
+			So(cb.Metrics().TimeoutCount(time.Now()), ShouldEqual, 1)
 		})
 	})
 }
+
+func TestReportCustomEvent(t *testing.T) {
+	Convey("with a command which reports a custom event", t, func() {
+		defer Flush()
+
+		var reportErr error
+		err := DoC(context.Background(), "custom_event", func(ctx context.Context) error {
+			reportErr = ReportCustomEvent(ctx, "degraded")
+			return nil
+		}, nil)
+		So(err, ShouldBeNil)
+		So(reportErr, ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("the event is counted alongside the command's outcome", func() {
+			cb, _, _ := GetCircuit("custom_event")
+			So(cb.Metrics().CustomEventCount("degraded", time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+		})
+	})
+
+	Convey("built-in event types can't be reported as custom events", t, func() {
+		defer Flush()
+
+		var reportErr error
+		DoC(context.Background(), "custom_event", func(ctx context.Context) error {
+			reportErr = ReportCustomEvent(ctx, "failure")
+			return nil
+		}, nil)
+		So(reportErr, ShouldNotBeNil)
+	})
+
+	Convey("a context which doesn't belong to a command is refused", t, func() {
+		So(ReportCustomEvent(context.Background(), "degraded"), ShouldNotBeNil)
+	})
+}
+
+func TestGoCWithStart(t *testing.T) {
+	Convey("with a command whose request was queued for 2 seconds beforehand", t, func() {
+		defer Flush()
+
+		done := make(chan struct{})
+		GoCWithStart(context.Background(), "queued", time.Now().Add(-2*time.Second), func(ctx context.Context) error {
+			close(done)
+			return nil
+		}, nil)
+		<-done
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("its total duration includes the queueing", func() {
+			cb, _, _ := GetCircuit("queued")
+			durations := cb.Metrics().TotalDuration().SortedDurations()
+			So(len(durations), ShouldEqual, 1)
+			So(durations[0], ShouldBeGreaterThanOrEqualTo, 2*time.Second)
+			So(cb.Metrics().RunDuration().SortedDurations()[0], ShouldBeLessThan, time.Second)
+		})
+	})
+}
+
+func TestReportRunDuration(t *testing.T) {
+	Convey("with a command whose run reports the backend's latency", t, func() {
+		defer Flush()
+
+		var reportErr error
+		err := DoC(context.Background(), "run_duration", func(ctx context.Context) error {
+			reportErr = ReportRunDuration(ctx, 250*time.Millisecond)
+			return nil
+		}, nil)
+		So(err, ShouldBeNil)
+		So(reportErr, ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("that latency is recorded as the run duration", func() {
+			cb, _, _ := GetCircuit("run_duration")
+			So(cb.Metrics().RunDuration().SortedDurations(), ShouldResemble, []time.Duration{250 * time.Millisecond})
+		})
+	})
+
+	Convey("without a reported latency, the measured run duration is recorded", t, func() {
+		defer Flush()
+
+		DoC(context.Background(), "run_duration", func(ctx context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}, nil)
+		time.Sleep(50 * time.Millisecond)
+
+		cb, _, _ := GetCircuit("run_duration")
+		durations := cb.Metrics().RunDuration().SortedDurations()
+		So(len(durations), ShouldEqual, 1)
+		So(durations[0], ShouldBeBetween, 10*time.Millisecond, 250*time.Millisecond)
+	})
+
+	Convey("a context which doesn't belong to a command is refused", t, func() {
+		So(ReportRunDuration(context.Background(), time.Second), ShouldNotBeNil)
+	})
+}
+
+func TestErrorWeight(t *testing.T) {
+	Convey("with a command which weighs backend errors at 3 and others at 0.5", t, func() {
+		defer Flush()
+
+		errBackend := fmt.Errorf("backend")
+		ConfigureCommand("weighted", CommandConfig{
+			ErrorWeight: func(err error) float64 {
+				if err == errBackend {
+					return 3
+				}
+				return 0.5
+			},
+		})
+
+		Do("weighted", func() error { return errBackend }, nil)
+		Do("weighted", func() error { return fmt.Errorf("other") }, nil)
+		Do("weighted", func() error { return nil }, nil)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("errors are counted by their weight", func() {
+			cb, _, _ := GetCircuit("weighted")
+			So(cb.Metrics().ErrorCount(time.Now()), ShouldEqual, 3.5)
+			So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 2)
+			So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 3)
+		})
+	})
+}
+
+func TestFallbackSkipped(t *testing.T) {
+	Convey("with an open circuit", t, func() {
+		defer Flush()
+
+		cb, _, _ := GetCircuit("skipped")
+		cb.setOpen()
+
+		Convey("a command without a fallback is counted as skipped", func() {
+			Do("skipped", func() error { return nil }, nil)
+			time.Sleep(50 * time.Millisecond)
+
+			So(cb.Metrics().FallbackSkippedCount(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().ShortCircuitCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("a command with a fallback is not", func() {
+			Do("skipped", func() error { return nil }, func(err error) error { return nil })
+			time.Sleep(50 * time.Millisecond)
+
+			So(cb.Metrics().FallbackSkippedCount(time.Now()), ShouldEqual, 0)
+			So(cb.Metrics().FallbackSuccessCount(time.Now()), ShouldEqual, 1)
+		})
+	})
+
+	Convey("a command without a fallback whose run fails is not counted as skipped", t, func() {
+		defer Flush()
+
+		Do("skipped", func() error { return fmt.Errorf("failed") }, nil)
+		time.Sleep(50 * time.Millisecond)
+
+		cb, _, _ := GetCircuit("skipped")
+		So(cb.Metrics().FallbackSkippedCount(time.Now()), ShouldEqual, 0)
+		So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 1)
+	})
+}
+
+func TestMaxConcurrentFallbacks(t *testing.T) {
+	Convey("with a command allowing one fallback at a time", t, func() {
+		defer Flush()
+		ConfigureCommand("max_fallbacks", CommandConfig{MaxConcurrentFallbacks: 1, MaxConcurrentRequests: 10})
+		defer ConfigureCommand("max_fallbacks", CommandConfig{})
+
+		release := make(chan struct{})
+		running := make(chan struct{})
+		finished := make(chan struct{})
+		GoC(context.Background(), "max_fallbacks", func(ctx context.Context) error {
+			return fmt.Errorf("failed")
+		}, func(ctx context.Context, err error) error {
+			close(running)
+			<-release
+			close(finished)
+			return nil
+		})
+		<-running
+
+		Convey("a second fallback is rejected while the first runs", func() {
+			err := DoC(context.Background(), "max_fallbacks", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				return nil
+			})
+			So(err.(CommandError).FallbackErr, ShouldEqual, ErrMaxFallbackConcurrency)
+
+			close(release)
+			<-finished
+			time.Sleep(50 * time.Millisecond)
+
+			cb, _, _ := GetCircuit("max_fallbacks")
+			So(cb.Metrics().FallbackRejectedCount(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().FallbackFailureCount(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().FallbackSuccessCount(time.Now()), ShouldEqual, 1)
+
+			Convey("and once it has finished, fallbacks run again", func() {
+				err := DoC(context.Background(), "max_fallbacks", func(ctx context.Context) error {
+					return fmt.Errorf("failed")
+				}, func(ctx context.Context, err error) error {
+					return nil
+				})
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestRecoverPanics(t *testing.T) {
+	Convey("with a command configured to recover panics", t, func() {
+		defer Flush()
+		ConfigureCommand("panics", CommandConfig{RecoverPanics: true})
+		defer ConfigureCommand("panics", CommandConfig{})
+
+		Convey("a run which panics fails, and its fallback is given the panic", func() {
+			var fallbackErr error
+			err := DoC(context.Background(), "panics", func(ctx context.Context) error {
+				panic("boom")
+			}, func(ctx context.Context, err error) error {
+				fallbackErr = err
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(errors.Is(fallbackErr, ErrPanic), ShouldBeTrue)
+
+			var pe PanicError
+			So(errors.As(fallbackErr, &pe), ShouldBeTrue)
+			So(pe.Value, ShouldEqual, "boom")
+			So(string(pe.Stack), ShouldContainSubstring, "TestRecoverPanics")
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := GetCircuit("panics")
+			So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("a fallback which panics fails", func() {
+			err := DoC(context.Background(), "panics", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				panic("fallback boom")
+			})
+			So(errors.Is(err.(CommandError).FallbackErr, ErrPanic), ShouldBeTrue)
+		})
+	})
+}
+
+func TestSkipFallbackOnOpen(t *testing.T) {
+	Convey("with a command which skips its fallback while its circuit is open", t, func() {
+		defer Flush()
+		ConfigureCommand("skip_fallback", CommandConfig{SkipFallbackOnOpen: true})
+		defer ConfigureCommand("skip_fallback", CommandConfig{})
+
+		var fellBack int32
+		fallback := func(ctx context.Context, err error) error {
+			atomic.StoreInt32(&fellBack, 1)
+			return nil
+		}
+
+		Convey("a short-circuited execution fails at once without the fallback", func() {
+			cb, _, _ := GetCircuit("skip_fallback")
+			cb.setOpen()
+			err := DoC(context.Background(), "skip_fallback", func(ctx context.Context) error {
+				return nil
+			}, fallback)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+			So(atomic.LoadInt32(&fellBack), ShouldEqual, 0)
+
+			time.Sleep(50 * time.Millisecond)
+			So(cb.Metrics().ShortCircuits().Sum(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().FallbackSkippedCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("a failure still runs the fallback", func() {
+			err := DoC(context.Background(), "skip_fallback", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, fallback)
+			So(err, ShouldBeNil)
+			So(atomic.LoadInt32(&fellBack), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestTotalTimeout(t *testing.T) {
+	Convey("with a command whose run and fallback must finish within 100ms together", t, func() {
+		defer Flush()
+		ConfigureCommand("total_timeout", CommandConfig{Timeout: 1000, TotalTimeout: 100})
+		defer ConfigureCommand("total_timeout", CommandConfig{})
+
+		Convey("a slow fallback is canceled and the command times out", func() {
+			fallbackCanceled := make(chan struct{})
+			start := time.Now()
+			err := DoC(context.Background(), "total_timeout", func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				<-ctx.Done()
+				close(fallbackCanceled)
+				return ctx.Err()
+			})
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			var ce CommandError
+			So(errors.As(err, &ce), ShouldBeTrue)
+			So(ce.FallbackErr, ShouldEqual, ErrTimeout)
+			<-fallbackCanceled
+		})
+
+		Convey("a run outlasting the total times out then, leaving nothing for the fallback", func() {
+			var fellBack int32
+			start := time.Now()
+			err := DoC(context.Background(), "total_timeout", func(ctx context.Context) error {
+				time.Sleep(300 * time.Millisecond)
+				return nil
+			}, func(ctx context.Context, err error) error {
+				atomic.StoreInt32(&fellBack, 1)
+				return nil
+			})
+			So(time.Since(start), ShouldBeLessThan, 300*time.Millisecond)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(atomic.LoadInt32(&fellBack), ShouldEqual, 0)
+		})
+
+		Convey("a quick fallback succeeds", func() {
+			err := DoC(context.Background(), "total_timeout", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				return nil
+			})
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestRunInline(t *testing.T) {
+	Convey("with a command which runs inline", t, func() {
+		defer Flush()
+		ConfigureCommand("inline", CommandConfig{Timeout: 10, RunInline: true})
+		defer ConfigureCommand("inline", CommandConfig{})
+
+		Convey("a slow run isn't timed out", func() {
+			err := DoC(context.Background(), "inline", func(ctx context.Context) error {
+				time.Sleep(30 * time.Millisecond)
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := GetCircuit("inline")
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("a failure is handed to the fallback", func() {
+			var fallbackErr error
+			err := DoC(context.Background(), "inline", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				fallbackErr = err
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(fallbackErr, ShouldNotBeNil)
+		})
+
+		Convey("a failure without a fallback is returned", func() {
+			runErr := fmt.Errorf("failed")
+			err := DoC(context.Background(), "inline", func(ctx context.Context) error {
+				return runErr
+			}, nil)
+			So(errors.Is(err, runErr), ShouldBeTrue)
+		})
+
+		Convey("an open circuit short-circuits it", func() {
+			cb, _, _ := GetCircuit("inline")
+			cb.setOpen()
+			err := DoC(context.Background(), "inline", func(ctx context.Context) error {
+				return nil
+			}, nil)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+		})
+
+		Convey("a deadline which passes is a timeout when it is the command's timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := DoCContextTimeout(ctx, "inline", func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}, nil)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+		})
+	})
+}
+
+func TestMaxQueueWait(t *testing.T) {
+	Convey("with a command of 1 ticket which queues for up to 200ms", t, func() {
+		defer Flush()
+		ConfigureCommand("queue", CommandConfig{MaxConcurrentRequests: 1, MaxQueueWait: 200})
+		defer ConfigureCommand("queue", CommandConfig{})
+
+		release := make(chan struct{})
+		holding := make(chan struct{})
+		held := make(chan struct{})
+		go func() {
+			Do("queue", func() error {
+				close(holding)
+				<-release
+				return nil
+			}, nil)
+			close(held)
+		}()
+		<-holding
+		defer func() { <-held }()
+
+		Convey("an execution waits for the ticket to be returned", func() {
+			time.AfterFunc(50*time.Millisecond, func() { close(release) })
+			err := Do("queue", func() error { return nil }, nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("an execution is rejected once the wait is over", func() {
+			defer close(release)
+			start := time.Now()
+			err := Do("queue", func() error { return nil }, nil)
+			So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := GetCircuit("queue")
+			So(cb.Metrics().Rejects().Sum(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("an execution whose context is canceled stops waiting", func() {
+			defer close(release)
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			var ran int32
+			err := DoC(ctx, "queue", func(ctx context.Context) error {
+				atomic.StoreInt32(&ran, 1)
+				return nil
+			}, nil)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+			time.Sleep(250 * time.Millisecond)
+			So(atomic.LoadInt32(&ran), ShouldEqual, 0)
+			cb, _, _ := GetCircuit("queue")
+			So(cb.Metrics().Rejects().Sum(time.Now()), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestOutcomeObserver(t *testing.T) {
+	Convey("with an outcome observer", t, func() {
+		defer Flush()
+		outcomes := make(chan CommandOutcome, 1)
+		SetOutcomeObserver(func(o CommandOutcome) {
+			outcomes <- o
+		})
+		defer SetOutcomeObserver(nil)
+
+		Convey("a successful command is observed once", func() {
+			Do("observed", func() error { return nil }, nil)
+
+			o := <-outcomes
+			So(o.Name, ShouldEqual, "observed")
+			So(o.Success, ShouldBeTrue)
+			So(o.Err, ShouldBeNil)
+			So(o.FellBack, ShouldBeFalse)
+			So(o.Duration, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("a failing command reports its error and fallback", func() {
+			runErr := fmt.Errorf("failed")
+			Do("observed", func() error { return runErr }, func(err error) error { return nil })
+
+			o := <-outcomes
+			So(o.Success, ShouldBeFalse)
+			So(o.Err, ShouldEqual, runErr)
+			So(o.FellBack, ShouldBeTrue)
+			So(o.ShortCircuited, ShouldBeFalse)
+		})
+
+		Convey("a short-circuited command is marked as such", func() {
+			cb, _, _ := GetCircuit("observed")
+			cb.setOpen()
+			Do("observed", func() error { return nil }, nil)
+
+			o := <-outcomes
+			So(o.ShortCircuited, ShouldBeTrue)
+			So(o.Err, ShouldEqual, ErrCircuitOpen)
+			So(o.FellBack, ShouldBeFalse)
+		})
+	})
+}
+
+func TestTry(t *testing.T) {
+	Convey("with a command allowing 1 execution at a time", t, func() {
+		defer Flush()
+
+		ConfigureCommand("try", CommandConfig{MaxConcurrentRequests: 1, SleepWindow: 50})
+		cb, _, _ := GetCircuit("try")
+
+		Convey("an idle command would be let through, and no ticket is taken", func() {
+			proceed, reason := Try("try")
+			So(proceed, ShouldBeTrue)
+			So(reason, ShouldBeNil)
+			So(cb.executorPool.ActiveCount(), ShouldEqual, 0)
+		})
+
+		Convey("a busy command would be rejected", func() {
+			ticket := <-cb.executorPool.Tickets
+			defer cb.executorPool.Return(ticket)
+
+			proceed, reason := Try("try")
+			So(proceed, ShouldBeFalse)
+			So(reason, ShouldEqual, ErrMaxConcurrency)
+		})
+
+		Convey("an open circuit would short-circuit", func() {
+			cb.setOpen()
+
+			proceed, reason := Try("try")
+			So(proceed, ShouldBeFalse)
+			So(reason, ShouldEqual, ErrCircuitOpen)
+
+			Convey("until its sleep window passes, without claiming the test", func() {
+				time.Sleep(60 * time.Millisecond)
+				proceed, _ = Try("try")
+				So(proceed, ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestCommandNameFromContext(t *testing.T) {
+	Convey("with a command which reads its name from the context", t, func() {
+		defer Flush()
+
+		Convey("the run function sees the command name", func() {
+			var name string
+			var ok bool
+			err := DoC(context.Background(), "outer", func(ctx context.Context) error {
+				name, ok = CommandNameFromContext(ctx)
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(name, ShouldEqual, "outer")
+		})
+
+		Convey("the fallback function sees the command name", func() {
+			var name string
+			err := DoC(context.Background(), "outer", func(ctx context.Context) error {
+				return fmt.Errorf("run_error")
+			}, func(ctx context.Context, err error) error {
+				name, _ = CommandNameFromContext(ctx)
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "outer")
+		})
+
+		Convey("a nested command sees its own name, and the outer name is restored afterwards", func() {
+			var inner, outer string
+			err := DoC(context.Background(), "outer", func(ctx context.Context) error {
+				err := DoC(ctx, "inner", func(ctx context.Context) error {
+					inner, _ = CommandNameFromContext(ctx)
+					return nil
+				}, nil)
+				outer, _ = CommandNameFromContext(ctx)
+				return err
+			}, nil)
+			So(err, ShouldBeNil)
+			So(inner, ShouldEqual, "inner")
+			So(outer, ShouldEqual, "outer")
+		})
+
+		Convey("a context which did not pass through a command has no name", func() {
+			_, ok := CommandNameFromContext(context.Background())
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestFallbackErrorIs(t *testing.T) {
+	Convey("with a fallback which records the error it was given", t, func() {
+		defer Flush()
+
+		fallbackErr := make(chan error, 1)
+		fallback := func(ctx context.Context, err error) error {
+			fallbackErr <- err
+			return nil
+		}
+
+		Convey("an open circuit passes ErrCircuitOpen", func() {
+			cb, _, _ := GetCircuit("")
+			cb.setOpen()
+			GoC(context.Background(), "", func(ctx context.Context) error { return nil }, fallback)
+
+			err := <-fallbackErr
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+			So(errors.Is(err, ErrTimeout), ShouldBeFalse)
+		})
+
+		Convey("a full pool passes ErrMaxConcurrency", func() {
+			ConfigureCommand("", CommandConfig{MaxConcurrentRequests: 1})
+			cb, _, _ := GetCircuit("")
+			<-cb.executorPool.Tickets
+			GoC(context.Background(), "", func(ctx context.Context) error { return nil }, fallback)
+
+			err := <-fallbackErr
+			So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeFalse)
+		})
+
+		Convey("a slow run passes ErrTimeout", func() {
+			ConfigureCommand("", CommandConfig{Timeout: 10})
+			GoC(context.Background(), "", func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, fallback)
+
+			err := <-fallbackErr
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(errors.Is(fmt.Errorf("wrapped: %w", err), ErrTimeout), ShouldBeTrue)
+		})
+
+		Convey("a failing run passes its own error, distinct from ErrTimeout", func() {
+			runErr := fmt.Errorf("backend unavailable")
+			GoC(context.Background(), "", func(ctx context.Context) error { return runErr }, fallback)
+
+			err := <-fallbackErr
+			So(err, ShouldEqual, runErr)
+			So(errors.Is(err, ErrTimeout), ShouldBeFalse)
+		})
+	})
+}
+
+func BenchmarkDoC(b *testing.B) {
+	defer Flush()
+	ConfigureCommand("bench", CommandConfig{MaxConcurrentRequests: 1000})
+	run := func(ctx context.Context) error {
+		return nil
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := DoC(context.Background(), "bench", run, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDoCInline(b *testing.B) {
+	defer Flush()
+	ConfigureCommand("bench_inline", CommandConfig{MaxConcurrentRequests: 1000, RunInline: true})
+	defer ConfigureCommand("bench_inline", CommandConfig{})
+	run := func(ctx context.Context) error {
+		return nil
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := DoC(context.Background(), "bench_inline", run, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Package hystrixtest provides helpers for tests which need hystrix circuits in a known state.
+//
+// Rather than running enough failing commands to trip a circuit, and sleeping until their
+// metrics are recorded, tests can open and close circuits directly.
+//
+//	func TestServesFromCacheWhenBackendIsDown(t *testing.T) {
+//		hystrixtest.TripCircuit(t, "backend")
+//		defer hystrixtest.ResetCircuit("backend")
+//
+//		// exercise code which calls hystrix.Do("backend", ...)
+//	}
+package hystrixtest
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+	"github.com/lesha888/hystrix-go/hystrix/rolling"
+)
+
+// TripCircuit opens the named circuit after reporting a full request volume of synthetic
+// failures for it. The circuit stays open until its sleep window elapses and a test request
+// succeeds, or until ResetCircuit is called. It opens even while the command is warming up.
+func TripCircuit(t testing.TB, name string) {
+	t.Helper()
+
+	cb, _, err := hystrix.GetCircuit(name)
+	if err != nil {
+		t.Fatalf("hystrixtest: could not get circuit %v: %v", name, err)
+	}
+
+	// the failures are reported as executions' would be, so they are counted however the
+	// command's metrics are kept
+	now := rolling.Now()
+	settings := hystrix.GetCircuitSettings()[cb.Name]
+	volume := int(settings.VolumeThreshold())
+	if volume < 1 {
+		volume = 1
+	}
+	requests := cb.Metrics().RequestCount(now)
+	for i := 0; i < volume; i++ {
+		if err := cb.ReportEvent([]string{"failure"}, now, 0); err != nil {
+			t.Fatalf("hystrixtest: could not report a failure of %v: %v", name, err)
+		}
+	}
+	// metrics take in reports in the background; waiting for them lets ResetCircuit discard them all
+	if !settings.DisableMetrics {
+		deadline := time.Now().Add(time.Second)
+		for cb.Metrics().RequestCount(now) < requests+float64(volume) {
+			if time.Now().After(deadline) {
+				t.Fatalf("hystrixtest: the metrics of %v did not take in its failures", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Metrics can't open a circuit while its command warms up, and may not have taken in the
+	// failures yet, so the circuit is opened the way ImportState restores an open one.
+	state, _ := json.Marshal([]map[string]interface{}{{
+		"name":                       cb.Name,
+		"open":                       true,
+		"opened_or_last_tested_time": now.UnixNano(),
+	}})
+	if err := hystrix.ImportState(state); err != nil {
+		t.Fatalf("hystrixtest: could not open circuit %v: %v", name, err)
+	}
+	if cb.State() == hystrix.CircuitClosed {
+		t.Fatalf("hystrixtest: circuit %v did not open", name)
+	}
+}
+
+// ResetCircuit closes the named circuit and discards its metrics.
+func ResetCircuit(name string) {
+	cb, _, err := hystrix.GetCircuit(name)
+	if err != nil {
+		return
+	}
+	cb.Reset()
+}
+
+// Clock is a clock for hystrix.SetClock which only moves when advanced, letting tests
+// step past sleep windows and rolling metric buckets without sleeping.
+//
+//	clock := hystrixtest.NewClock(time.Now())
+//	hystrix.SetClock(clock)
+//	defer hystrix.SetClock(nil)
+//
+//	hystrixtest.TripCircuit(t, "backend")
+//	clock.Advance(hystrix.GetCircuitSettings()["backend"].SleepWindow)
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewClock returns a Clock stopped at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,86 @@
+package hystrixtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTripCircuit(t *testing.T) {
+	Convey("when a circuit is tripped", t, func() {
+		defer hystrix.Flush()
+		TripCircuit(t, "tripped")
+
+		Convey("commands short circuit", func() {
+			err := hystrix.Do("tripped", func() error { return nil }, nil)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+		})
+
+		Convey("and then reset", func() {
+			ResetCircuit("tripped")
+
+			Convey("commands run again", func() {
+				err := hystrix.Do("tripped", func() error { return nil }, nil)
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestTripCircuitSettings(t *testing.T) {
+	Convey("circuits trip whatever their command's settings", t, func() {
+		defer hystrix.Flush()
+
+		Convey("when tripped by an alias of the command", func() {
+			hystrix.AliasCommand("tripped_alias", "tripped_original")
+			defer hystrix.AliasCommand("tripped_alias", "tripped_alias")
+			TripCircuit(t, "tripped_alias")
+
+			err := hystrix.Do("tripped_original", func() error { return nil }, nil)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+		})
+
+		Convey("while the command warms up", func() {
+			hystrix.ConfigureCommand("tripped_warmup", hystrix.CommandConfig{WarmupDuration: 60000})
+			defer hystrix.ConfigureCommand("tripped_warmup", hystrix.CommandConfig{})
+			TripCircuit(t, "tripped_warmup")
+
+			err := hystrix.Do("tripped_warmup", func() error { return nil }, nil)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+		})
+
+		Convey("when the command's metrics are disabled", func() {
+			hystrix.ConfigureCommand("tripped_lite", hystrix.CommandConfig{DisableMetrics: true})
+			defer hystrix.ConfigureCommand("tripped_lite", hystrix.CommandConfig{})
+			TripCircuit(t, "tripped_lite")
+
+			err := hystrix.Do("tripped_lite", func() error { return nil }, nil)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+		})
+	})
+}
+
+func TestClock(t *testing.T) {
+	Convey("when a tripped circuit runs on a stopped clock", t, func() {
+		defer hystrix.Flush()
+		clock := NewClock(time.Now())
+		hystrix.SetClock(clock)
+		defer hystrix.SetClock(nil)
+
+		hystrix.ConfigureCommand("clocked", hystrix.CommandConfig{SleepWindow: 60000})
+		TripCircuit(t, "clocked")
+
+		Convey("commands short circuit until the sleep window passes", func() {
+			err := hystrix.Do("clocked", func() error { return nil }, nil)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+
+			clock.Advance(61 * time.Second)
+
+			err = hystrix.Do("clocked", func() error { return nil }, nil)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package hystrix
+
+import (
+	"sync"
+	"time"
+)
+
+// liteBuckets is the number of one second buckets liteMetrics keeps, spanning the metricsWindow.
+const liteBuckets = int64(metricsWindow / time.Second)
+
+// liteMetrics counts the requests and errors of a command which DisableMetrics over the
+// metricsWindow, in place of its rolling metrics, so that its circuit can still open.
+type liteMetrics struct {
+	mutex   sync.Mutex
+	buckets [liteBuckets]liteBucket
+}
+
+type liteBucket struct {
+	// second is the Unix time of the second the bucket counts.
+	second   int64
+	requests float64
+	errors   float64
+}
+
+// record counts an execution of the command at now.
+func (m *liteMetrics) record(now time.Time, requests, errors float64) {
+	second := now.Unix()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b := &m.buckets[second%liteBuckets]
+	if b.second != second {
+		*b = liteBucket{second: second}
+	}
+	b.requests += requests
+	b.errors += errors
+}
+
+// counts returns the requests and errors counted within the metricsWindow ending at now.
+func (m *liteMetrics) counts(now time.Time) (requests, errors float64) {
+	second := now.Unix()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, b := range m.buckets {
+		if second-b.second < liteBuckets {
+			requests += b.requests
+			errors += b.errors
+		}
+	}
+	return requests, errors
+}
+
+// errorPercent returns the percentage of requests within the metricsWindow ending at now which were errors.
+func (m *liteMetrics) errorPercent(now time.Time) int {
+	requests, errors := m.counts(now)
+	return ErrorPercentage(requests-errors, errors, 0, 0, 0)
+}
+
+func (m *liteMetrics) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.buckets = [liteBuckets]liteBucket{}
+}
@@ -1,6 +1,8 @@
 package hystrix
 
-type logger interface {
+// Logger receives the messages hystrix logs, such as circuits opening and closing.
+// The standard library's *log.Logger satisfies it, as do most structured loggers' printf adapters.
+type Logger interface {
 	Printf(format string, items ...interface{})
 }
 
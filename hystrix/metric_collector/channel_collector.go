@@ -0,0 +1,109 @@
+package metricCollector
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a single event of a command execution, delivered by a ChannelCollector.
+type Event struct {
+	Command string
+	// Type is the event type, named as in hystrix, such as "success", "timeout" or "fallback-success",
+	// or the type of a custom event.
+	Type string
+	// Timestamp is when the event reached the collector, shortly after the execution finished.
+	Timestamp time.Time
+	// Duration is the run duration of the execution the event belongs to.
+	Duration time.Duration
+}
+
+// ChannelCollector delivers the events of command executions on a channel, for consumers which
+// would rather react to them as they happen than poll the rolling metrics.
+//
+//	events := metricCollector.NewChannelCollector(1000)
+//	metricCollector.Registry.Register(events.Collector)
+//	go func() {
+//		for e := range events.Events() {
+//			// alert on e
+//		}
+//	}()
+//
+// Commands are never held up by a slow consumer: once the channel's buffer is full, further
+// events are dropped and counted instead.
+type ChannelCollector struct {
+	events  chan Event
+	dropped uint64
+}
+
+// NewChannelCollector returns a ChannelCollector whose channel buffers up to size events.
+func NewChannelCollector(size int) *ChannelCollector {
+	return &ChannelCollector{events: make(chan Event, size)}
+}
+
+// Events returns the channel on which events are delivered. It is never closed.
+func (c *ChannelCollector) Events() <-chan Event {
+	return c.events
+}
+
+// Dropped returns the number of events dropped because the channel was full.
+func (c *ChannelCollector) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Collector returns the MetricCollector delivering the named command's events, for registering with
+// the Registry.
+func (c *ChannelCollector) Collector(name string) MetricCollector {
+	return &channelCommandCollector{name: name, parent: c}
+}
+
+func (c *ChannelCollector) send(e Event) {
+	select {
+	case c.events <- e:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// channelCommandCollector delivers the events of a single command to its ChannelCollector.
+type channelCommandCollector struct {
+	name   string
+	parent *ChannelCollector
+}
+
+// Update sends an event for each of the execution's event types.
+func (c *channelCommandCollector) Update(r MetricResult) {
+	now := time.Now()
+	send := func(eventType string, n float64) {
+		for ; n > 0; n-- {
+			c.parent.send(Event{Command: c.name, Type: eventType, Timestamp: now, Duration: r.RunDuration})
+		}
+	}
+
+	send("success", r.Successes)
+	send("failure", r.Failures)
+	send("rejected", r.Rejects)
+	send("short-circuit", r.ShortCircuits)
+	send("timeout", r.Timeouts)
+	send("context_canceled", r.ContextCanceled)
+	send("context_deadline_exceeded", r.ContextDeadlineExceeded)
+	send("fallback-success", r.FallbackSuccesses)
+	send("fallback-failure", r.FallbackFailures)
+	send("fallback-skipped", r.FallbackSkipped)
+	send("fallback-rejected", r.FallbackRejected)
+	send("probe-success", r.ProbeSuccesses)
+	send("probe-failure", r.ProbeFailures)
+
+	// custom events are sent in a stable order
+	custom := make([]string, 0, len(r.CustomEvents))
+	for eventType := range r.CustomEvents {
+		custom = append(custom, eventType)
+	}
+	sort.Strings(custom)
+	for _, eventType := range custom {
+		send(eventType, r.CustomEvents[eventType])
+	}
+}
+
+// Reset does nothing, since events already delivered can't be taken back.
+func (c *channelCommandCollector) Reset() {}
@@ -2,6 +2,7 @@ package metricCollector
 
 import (
 	"sync"
+	"time"
 
 	"github.com/lesha888/hystrix-go/hystrix/rolling"
 )
@@ -13,34 +14,79 @@ import (
 //
 // Metric Collectors do not need Mutexes as they are updated by circuits within a locked context.
 type DefaultMetricCollector struct {
-	mutex *sync.RWMutex
+	mutex   *sync.RWMutex
+	newStat func() RollingStat
 
-	numRequests *rolling.Number
-	errors      *rolling.Number
+	numRequests RollingStat
+	errors      RollingStat
 
-	successes               *rolling.Number
-	failures                *rolling.Number
-	rejects                 *rolling.Number
-	shortCircuits           *rolling.Number
-	timeouts                *rolling.Number
-	contextCanceled         *rolling.Number
-	contextDeadlineExceeded *rolling.Number
+	successes               RollingStat
+	failures                RollingStat
+	rejects                 RollingStat
+	shortCircuits           RollingStat
+	timeouts                RollingStat
+	contextCanceled         RollingStat
+	contextDeadlineExceeded RollingStat
+	draining                RollingStat
 
-	fallbackSuccesses *rolling.Number
-	fallbackFailures  *rolling.Number
+	fallbackSuccesses RollingStat
+	fallbackFailures  RollingStat
+	fallbackSkipped   RollingStat
+	fallbackRejected  RollingStat
+	probeSuccesses    RollingStat
+	probeFailures     RollingStat
 	totalDuration     *rolling.Timing
 	runDuration       *rolling.Timing
+
+	customEventsMutex *sync.RWMutex
+	customEvents      map[string]RollingStat
+}
+
+// RollingStat is a statistic over a rolling window of time, in which the DefaultMetricCollector
+// keeps each of its counts. rolling.Number, which sums fixed one second buckets, is the default;
+// other implementations can aggregate differently, such as with a moving average. They must be
+// safe for concurrent use.
+//
+// Each count has two accessors: one such as NumRequestsStat returns its RollingStat, whatever the
+// implementation, while one such as NumRequests returns it as the default *rolling.Number, or nil
+// when the count is kept in a RollingStat of another kind.
+type RollingStat interface {
+	Increment(i float64)
+	UpdateMax(n float64)
+	Sum(now time.Time) float64
+	Max(now time.Time) float64
+	Avg(now time.Time) float64
 }
 
 func newDefaultMetricCollector(name string) MetricCollector {
-	m := &DefaultMetricCollector{}
+	return NewDefaultMetricCollector(nil)
+}
+
+// NewDefaultMetricCollector returns a DefaultMetricCollector which keeps its counts in the
+// RollingStats made by newStat, or in rolling.Numbers when newStat is nil.
+func NewDefaultMetricCollector(newStat func() RollingStat) *DefaultMetricCollector {
+	if newStat == nil {
+		newStat = newRollingNumber
+	}
+	m := &DefaultMetricCollector{newStat: newStat}
 	m.mutex = &sync.RWMutex{}
+	m.customEventsMutex = &sync.RWMutex{}
 	m.Reset()
 	return m
 }
 
+func newRollingNumber() RollingStat {
+	return rolling.NewNumber()
+}
+
 // NumRequests returns the rolling number of requests
 func (d *DefaultMetricCollector) NumRequests() *rolling.Number {
+	n, _ := d.NumRequestsStat().(*rolling.Number)
+	return n
+}
+
+// NumRequestsStat returns the RollingStat behind NumRequests.
+func (d *DefaultMetricCollector) NumRequestsStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.numRequests
@@ -48,6 +94,12 @@ func (d *DefaultMetricCollector) NumRequests() *rolling.Number {
 
 // Errors returns the rolling number of errors
 func (d *DefaultMetricCollector) Errors() *rolling.Number {
+	n, _ := d.ErrorsStat().(*rolling.Number)
+	return n
+}
+
+// ErrorsStat returns the RollingStat behind Errors.
+func (d *DefaultMetricCollector) ErrorsStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.errors
@@ -55,6 +107,12 @@ func (d *DefaultMetricCollector) Errors() *rolling.Number {
 
 // Successes returns the rolling number of successes
 func (d *DefaultMetricCollector) Successes() *rolling.Number {
+	n, _ := d.SuccessesStat().(*rolling.Number)
+	return n
+}
+
+// SuccessesStat returns the RollingStat behind Successes.
+func (d *DefaultMetricCollector) SuccessesStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.successes
@@ -62,6 +120,12 @@ func (d *DefaultMetricCollector) Successes() *rolling.Number {
 
 // Failures returns the rolling number of failures
 func (d *DefaultMetricCollector) Failures() *rolling.Number {
+	n, _ := d.FailuresStat().(*rolling.Number)
+	return n
+}
+
+// FailuresStat returns the RollingStat behind Failures.
+func (d *DefaultMetricCollector) FailuresStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.failures
@@ -69,6 +133,12 @@ func (d *DefaultMetricCollector) Failures() *rolling.Number {
 
 // Rejects returns the rolling number of rejects
 func (d *DefaultMetricCollector) Rejects() *rolling.Number {
+	n, _ := d.RejectsStat().(*rolling.Number)
+	return n
+}
+
+// RejectsStat returns the RollingStat behind Rejects.
+func (d *DefaultMetricCollector) RejectsStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.rejects
@@ -76,6 +146,12 @@ func (d *DefaultMetricCollector) Rejects() *rolling.Number {
 
 // ShortCircuits returns the rolling number of short circuits
 func (d *DefaultMetricCollector) ShortCircuits() *rolling.Number {
+	n, _ := d.ShortCircuitsStat().(*rolling.Number)
+	return n
+}
+
+// ShortCircuitsStat returns the RollingStat behind ShortCircuits.
+func (d *DefaultMetricCollector) ShortCircuitsStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.shortCircuits
@@ -83,6 +159,12 @@ func (d *DefaultMetricCollector) ShortCircuits() *rolling.Number {
 
 // Timeouts returns the rolling number of timeouts
 func (d *DefaultMetricCollector) Timeouts() *rolling.Number {
+	n, _ := d.TimeoutsStat().(*rolling.Number)
+	return n
+}
+
+// TimeoutsStat returns the RollingStat behind Timeouts.
+func (d *DefaultMetricCollector) TimeoutsStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.timeouts
@@ -90,30 +172,119 @@ func (d *DefaultMetricCollector) Timeouts() *rolling.Number {
 
 // FallbackSuccesses returns the rolling number of fallback successes
 func (d *DefaultMetricCollector) FallbackSuccesses() *rolling.Number {
+	n, _ := d.FallbackSuccessesStat().(*rolling.Number)
+	return n
+}
+
+// FallbackSuccessesStat returns the RollingStat behind FallbackSuccesses.
+func (d *DefaultMetricCollector) FallbackSuccessesStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.fallbackSuccesses
 }
 
 func (d *DefaultMetricCollector) ContextCanceled() *rolling.Number {
+	n, _ := d.ContextCanceledStat().(*rolling.Number)
+	return n
+}
+
+// ContextCanceledStat returns the RollingStat behind ContextCanceled.
+func (d *DefaultMetricCollector) ContextCanceledStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.contextCanceled
 }
 
 func (d *DefaultMetricCollector) ContextDeadlineExceeded() *rolling.Number {
+	n, _ := d.ContextDeadlineExceededStat().(*rolling.Number)
+	return n
+}
+
+// ContextDeadlineExceededStat returns the RollingStat behind ContextDeadlineExceeded.
+func (d *DefaultMetricCollector) ContextDeadlineExceededStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.contextDeadlineExceeded
 }
 
+// Draining returns the rolling number of executions rejected while their command was draining
+func (d *DefaultMetricCollector) Draining() *rolling.Number {
+	n, _ := d.DrainingStat().(*rolling.Number)
+	return n
+}
+
+// DrainingStat returns the RollingStat behind Draining.
+func (d *DefaultMetricCollector) DrainingStat() RollingStat {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.draining
+}
+
 // FallbackFailures returns the rolling number of fallback failures
 func (d *DefaultMetricCollector) FallbackFailures() *rolling.Number {
+	n, _ := d.FallbackFailuresStat().(*rolling.Number)
+	return n
+}
+
+// FallbackFailuresStat returns the RollingStat behind FallbackFailures.
+func (d *DefaultMetricCollector) FallbackFailuresStat() RollingStat {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 	return d.fallbackFailures
 }
 
+// FallbackSkipped returns the rolling number of commands dropped before run without a fallback
+func (d *DefaultMetricCollector) FallbackSkipped() *rolling.Number {
+	n, _ := d.FallbackSkippedStat().(*rolling.Number)
+	return n
+}
+
+// FallbackSkippedStat returns the RollingStat behind FallbackSkipped.
+func (d *DefaultMetricCollector) FallbackSkippedStat() RollingStat {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.fallbackSkipped
+}
+
+// FallbackRejected returns the rolling number of fallbacks rejected for exceeding MaxConcurrentFallbacks
+func (d *DefaultMetricCollector) FallbackRejected() *rolling.Number {
+	n, _ := d.FallbackRejectedStat().(*rolling.Number)
+	return n
+}
+
+// FallbackRejectedStat returns the RollingStat behind FallbackRejected.
+func (d *DefaultMetricCollector) FallbackRejectedStat() RollingStat {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.fallbackRejected
+}
+
+// ProbeSuccesses returns the rolling number of successful probes of an open circuit
+func (d *DefaultMetricCollector) ProbeSuccesses() *rolling.Number {
+	n, _ := d.ProbeSuccessesStat().(*rolling.Number)
+	return n
+}
+
+// ProbeSuccessesStat returns the RollingStat behind ProbeSuccesses.
+func (d *DefaultMetricCollector) ProbeSuccessesStat() RollingStat {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.probeSuccesses
+}
+
+// ProbeFailures returns the rolling number of failed probes of an open circuit
+func (d *DefaultMetricCollector) ProbeFailures() *rolling.Number {
+	n, _ := d.ProbeFailuresStat().(*rolling.Number)
+	return n
+}
+
+// ProbeFailuresStat returns the RollingStat behind ProbeFailures.
+func (d *DefaultMetricCollector) ProbeFailuresStat() RollingStat {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.probeFailures
+}
+
 // TotalDuration returns the rolling total duration
 func (d *DefaultMetricCollector) TotalDuration() *rolling.Timing {
 	d.mutex.RLock()
@@ -128,6 +299,89 @@ func (d *DefaultMetricCollector) RunDuration() *rolling.Timing {
 	return d.runDuration
 }
 
+// RequestCount returns the number of requests in the rolling window ending at now.
+func (d *DefaultMetricCollector) RequestCount(now time.Time) float64 {
+	return d.NumRequestsStat().Sum(now)
+}
+
+// ErrorCount returns the number of errors in the rolling window ending at now.
+func (d *DefaultMetricCollector) ErrorCount(now time.Time) float64 {
+	return d.ErrorsStat().Sum(now)
+}
+
+// SuccessCount returns the number of successes in the rolling window ending at now.
+func (d *DefaultMetricCollector) SuccessCount(now time.Time) float64 {
+	return d.SuccessesStat().Sum(now)
+}
+
+// FailureCount returns the number of failures in the rolling window ending at now.
+func (d *DefaultMetricCollector) FailureCount(now time.Time) float64 {
+	return d.FailuresStat().Sum(now)
+}
+
+// RejectCount returns the number of rejects in the rolling window ending at now.
+func (d *DefaultMetricCollector) RejectCount(now time.Time) float64 {
+	return d.RejectsStat().Sum(now)
+}
+
+// ShortCircuitCount returns the number of short circuits in the rolling window ending at now.
+func (d *DefaultMetricCollector) ShortCircuitCount(now time.Time) float64 {
+	return d.ShortCircuitsStat().Sum(now)
+}
+
+// TimeoutCount returns the number of timeouts in the rolling window ending at now.
+func (d *DefaultMetricCollector) TimeoutCount(now time.Time) float64 {
+	return d.TimeoutsStat().Sum(now)
+}
+
+// FallbackSuccessCount returns the number of fallback successes in the rolling window ending at now.
+func (d *DefaultMetricCollector) FallbackSuccessCount(now time.Time) float64 {
+	return d.FallbackSuccessesStat().Sum(now)
+}
+
+// FallbackFailureCount returns the number of fallback failures in the rolling window ending at now.
+func (d *DefaultMetricCollector) FallbackFailureCount(now time.Time) float64 {
+	return d.FallbackFailuresStat().Sum(now)
+}
+
+// FallbackSkippedCount returns the number of commands dropped before run without a fallback
+// in the rolling window ending at now.
+func (d *DefaultMetricCollector) FallbackSkippedCount(now time.Time) float64 {
+	return d.FallbackSkippedStat().Sum(now)
+}
+
+// FallbackRejectedCount returns the number of fallbacks rejected for exceeding MaxConcurrentFallbacks
+// in the rolling window ending at now.
+func (d *DefaultMetricCollector) FallbackRejectedCount(now time.Time) float64 {
+	return d.FallbackRejectedStat().Sum(now)
+}
+
+// ProbeSuccessCount returns the number of successful probes of an open circuit in the rolling window ending at now.
+func (d *DefaultMetricCollector) ProbeSuccessCount(now time.Time) float64 {
+	return d.ProbeSuccessesStat().Sum(now)
+}
+
+// ProbeFailureCount returns the number of failed probes of an open circuit in the rolling window ending at now.
+func (d *DefaultMetricCollector) ProbeFailureCount(now time.Time) float64 {
+	return d.ProbeFailuresStat().Sum(now)
+}
+
+// ErrorPercentage returns the percentage of requests in the rolling window ending at now
+// which were errors, rounded to the nearest whole percent.
+func (d *DefaultMetricCollector) ErrorPercentage(now time.Time) int {
+	d.mutex.RLock()
+	reqs := d.numRequests.Sum(now)
+	errs := d.errors.Sum(now)
+	d.mutex.RUnlock()
+
+	var errPct float64
+	if reqs > 0 {
+		errPct = (float64(errs) / float64(reqs)) * 100
+	}
+
+	return int(errPct + 0.5)
+}
+
 func (d *DefaultMetricCollector) Update(r MetricResult) {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
@@ -141,11 +395,52 @@ func (d *DefaultMetricCollector) Update(r MetricResult) {
 	d.timeouts.Increment(r.Timeouts)
 	d.fallbackSuccesses.Increment(r.FallbackSuccesses)
 	d.fallbackFailures.Increment(r.FallbackFailures)
+	d.fallbackSkipped.Increment(r.FallbackSkipped)
+	d.fallbackRejected.Increment(r.FallbackRejected)
+	d.probeSuccesses.Increment(r.ProbeSuccesses)
+	d.probeFailures.Increment(r.ProbeFailures)
 	d.contextCanceled.Increment(r.ContextCanceled)
 	d.contextDeadlineExceeded.Increment(r.ContextDeadlineExceeded)
+	d.draining.Increment(r.Draining)
 
 	d.totalDuration.Add(r.TotalDuration)
 	d.runDuration.Add(r.RunDuration)
+
+	for eventType, n := range r.CustomEvents {
+		d.customEvent(eventType).Increment(n)
+	}
+}
+
+// customEvent returns the rolling statistic for a custom event type, creating it on first use.
+func (d *DefaultMetricCollector) customEvent(eventType string) RollingStat {
+	d.customEventsMutex.RLock()
+	n, ok := d.customEvents[eventType]
+	d.customEventsMutex.RUnlock()
+	if ok {
+		return n
+	}
+
+	d.customEventsMutex.Lock()
+	defer d.customEventsMutex.Unlock()
+	if n, ok = d.customEvents[eventType]; !ok {
+		n = d.newStat()
+		d.customEvents[eventType] = n
+	}
+	return n
+}
+
+// CustomEventCount returns how many custom events of the given type were reported in the rolling window ending at now.
+func (d *DefaultMetricCollector) CustomEventCount(eventType string, now time.Time) float64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	d.customEventsMutex.RLock()
+	n, ok := d.customEvents[eventType]
+	d.customEventsMutex.RUnlock()
+	if !ok {
+		return 0
+	}
+	return n.Sum(now)
 }
 
 // Reset resets all metrics in this collector to 0.
@@ -153,17 +448,26 @@ func (d *DefaultMetricCollector) Reset() {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	d.numRequests = rolling.NewNumber()
-	d.errors = rolling.NewNumber()
-	d.successes = rolling.NewNumber()
-	d.rejects = rolling.NewNumber()
-	d.shortCircuits = rolling.NewNumber()
-	d.failures = rolling.NewNumber()
-	d.timeouts = rolling.NewNumber()
-	d.fallbackSuccesses = rolling.NewNumber()
-	d.fallbackFailures = rolling.NewNumber()
-	d.contextCanceled = rolling.NewNumber()
-	d.contextDeadlineExceeded = rolling.NewNumber()
+	d.numRequests = d.newStat()
+	d.errors = d.newStat()
+	d.successes = d.newStat()
+	d.rejects = d.newStat()
+	d.shortCircuits = d.newStat()
+	d.failures = d.newStat()
+	d.timeouts = d.newStat()
+	d.fallbackSuccesses = d.newStat()
+	d.fallbackFailures = d.newStat()
+	d.fallbackSkipped = d.newStat()
+	d.fallbackRejected = d.newStat()
+	d.probeSuccesses = d.newStat()
+	d.probeFailures = d.newStat()
+	d.contextCanceled = d.newStat()
+	d.contextDeadlineExceeded = d.newStat()
+	d.draining = d.newStat()
 	d.totalDuration = rolling.NewTiming()
 	d.runDuration = rolling.NewTiming()
+
+	d.customEventsMutex.Lock()
+	d.customEvents = make(map[string]RollingStat)
+	d.customEventsMutex.Unlock()
 }
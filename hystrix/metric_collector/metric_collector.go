@@ -9,36 +9,66 @@ import (
 // collect statistics about the health of the circuit.
 var Registry = metricCollectorRegistry{
 	lock: &sync.RWMutex{},
-	registry: []func(name string) MetricCollector{
-		newDefaultMetricCollector,
+	registry: []registration{
+		{initialize: newDefaultMetricCollector},
 	},
 }
 
 type metricCollectorRegistry struct {
 	lock     *sync.RWMutex
-	registry []func(name string) MetricCollector
+	registry []registration
 }
 
-// InitializeMetricCollectors runs the registried MetricCollector Initializers to create an array of MetricCollectors.
+// registration is a MetricCollector Initializer, along with the commands it applies to.
+type registration struct {
+	// matches reports whether the collector applies to the named command. Nil matches every command.
+	matches    func(name string) bool
+	initialize func(name string) MetricCollector
+}
+
+// InitializeMetricCollectors runs the registried MetricCollector Initializers which apply to the
+// named command to create an array of MetricCollectors. The DefaultMetricCollector always comes first.
 func (m *metricCollectorRegistry) InitializeMetricCollectors(name string) []MetricCollector {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	metrics := make([]MetricCollector, len(m.registry))
-	for i, metricCollectorInitializer := range m.registry {
-		metrics[i] = metricCollectorInitializer(name)
+	metrics := make([]MetricCollector, 0, len(m.registry))
+	for _, r := range m.registry {
+		if r.matches != nil && !r.matches(name) {
+			continue
+		}
+		metrics = append(metrics, r.initialize(name))
 	}
 	return metrics
 }
 
 // Register places a MetricCollector Initializer in the registry maintained by this metricCollectorRegistry.
 func (m *metricCollectorRegistry) Register(initMetricCollector func(string) MetricCollector) {
+	m.RegisterFor(nil, initMetricCollector)
+}
+
+// RegisterFor places a MetricCollector Initializer in the registry which is only run for commands
+// whose name satisfies predicate, so that an expensive collector can be kept to the commands which
+// need it. A nil predicate matches every command, like Register. Like Register, it applies to
+// circuits created afterwards.
+func (m *metricCollectorRegistry) RegisterFor(predicate func(name string) bool, initMetricCollector func(string) MetricCollector) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	m.registry = append(m.registry, initMetricCollector)
+	m.registry = append(m.registry, registration{matches: predicate, initialize: initMetricCollector})
 }
 
+// MetricResult is the metrics of a command execution. An execution is one attempt, with exactly one
+// outcome: a success, failure, reject, short circuit, timeout, context canceled or deadline
+// exceeded, or rejection while draining. Attempts therefore always equals the sum of those
+// outcomes. An execution reported for a fallback alone, such as that of a coalesced caller, is no
+// attempt and has no outcome.
+//
+// Errors is not simply the attempts which didn't succeed, but what the circuit judges its health
+// by: failures, rejects and short circuits, and timeouts unless the command's TimeoutsCountAsErrors
+// is off, each weighed by the command's ErrorWeight. Attempts canceled by their caller, or rejected
+// because their command was draining, count as neither successes nor errors. A collector exporting
+// unsuccessful attempts should count those as Attempts minus Successes.
 type MetricResult struct {
 	Attempts                float64
 	Errors                  float64
@@ -49,11 +79,24 @@ type MetricResult struct {
 	Timeouts                float64
 	FallbackSuccesses       float64
 	FallbackFailures        float64
+	FallbackSkipped         float64
+	FallbackRejected        float64
+	ProbeSuccesses          float64
+	ProbeFailures           float64
 	ContextCanceled         float64
 	ContextDeadlineExceeded float64
-	TotalDuration           time.Duration
-	RunDuration             time.Duration
-	ConcurrencyInUse        float64
+	// Draining counts executions rejected with hystrix.ErrDraining while their command was draining.
+	Draining float64
+	// CustomEvents counts events reported with hystrix.ReportCustomEvent, by event type. It is nil when there are none.
+	CustomEvents map[string]float64
+	// FallbackQuality is the quality reported with hystrix.ReportFallbackQuality by a successful
+	// fallback. It is empty when none was reported.
+	FallbackQuality  string
+	TotalDuration    time.Duration
+	RunDuration      time.Duration
+	ConcurrencyInUse float64
+	// FallbackDuration is how long the fallback took to return. It is zero when no fallback ran.
+	FallbackDuration time.Duration
 }
 
 // MetricCollector represents the contract that all collectors must fulfill to gather circuit statistics.
@@ -65,3 +108,17 @@ type MetricCollector interface {
 	// Reset resets the internal counters and timers.
 	Reset()
 }
+
+// FallbackQualityCollector is an optional interface for MetricCollectors which count successful
+// fallbacks by the quality reported with hystrix.ReportFallbackQuality, such as "degraded".
+type FallbackQualityCollector interface {
+	// UpdateFallbackQuality is called after Update for each successful fallback which reported a quality.
+	UpdateFallbackQuality(quality string)
+}
+
+// FallbackDurationCollector is an optional interface for MetricCollectors which observe how long
+// fallbacks take, to show whether a fallback becomes the bottleneck while a circuit is open.
+type FallbackDurationCollector interface {
+	// UpdateFallbackDuration is called after Update for each execution whose fallback ran.
+	UpdateFallbackDuration(fallbackDuration time.Duration)
+}
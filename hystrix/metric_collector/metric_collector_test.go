@@ -0,0 +1,103 @@
+package metricCollector
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type namedCollector struct {
+	name string
+}
+
+func (c *namedCollector) Update(MetricResult) {}
+func (c *namedCollector) Reset()              {}
+
+func TestRegisterFor(t *testing.T) {
+	Convey("given a registry with a collector for every command and one for critical commands", t, func() {
+		registry := metricCollectorRegistry{
+			lock: &sync.RWMutex{},
+			registry: []registration{
+				{initialize: newDefaultMetricCollector},
+			},
+		}
+		var initialized []string
+		registry.Register(func(name string) MetricCollector {
+			return &namedCollector{name: "all"}
+		})
+		registry.RegisterFor(func(name string) bool {
+			return strings.HasPrefix(name, "critical.")
+		}, func(name string) MetricCollector {
+			initialized = append(initialized, name)
+			return &namedCollector{name: "critical"}
+		})
+
+		Convey("a critical command gets every collector, the default first", func() {
+			collectors := registry.InitializeMetricCollectors("critical.payments")
+			So(len(collectors), ShouldEqual, 3)
+			So(collectors[0], ShouldHaveSameTypeAs, &DefaultMetricCollector{})
+			So(collectors[2].(*namedCollector).name, ShouldEqual, "critical")
+		})
+
+		Convey("another command doesn't instantiate the critical collector", func() {
+			collectors := registry.InitializeMetricCollectors("search")
+			So(len(collectors), ShouldEqual, 2)
+			So(collectors[1].(*namedCollector).name, ShouldEqual, "all")
+			So(initialized, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestMockCollector(t *testing.T) {
+	Convey("given a mock collector", t, func() {
+		mock := NewMockCollector("mock")
+		var collector MetricCollector = mock
+
+		collector.Update(MetricResult{Attempts: 1, Errors: 1, Failures: 1})
+		collector.Update(MetricResult{Attempts: 1, Errors: 1, Timeouts: 1, CustomEvents: map[string]float64{"cache-miss": 1}})
+		collector.Update(MetricResult{Attempts: 1, Errors: 1, Failures: 1, FallbackSuccesses: 1})
+		collector.Reset()
+
+		Convey("it totals the metrics it was given, through a reset", func() {
+			totals := mock.Totals()
+			So(totals.Attempts, ShouldEqual, 3)
+			So(totals.Failures, ShouldEqual, 2)
+			So(totals.Timeouts, ShouldEqual, 1)
+			So(totals.FallbackSuccesses, ShouldEqual, 1)
+			So(totals.CustomEvents, ShouldResemble, map[string]float64{"cache-miss": 1})
+		})
+
+		Convey("it counts its calls", func() {
+			So(mock.Updates(), ShouldEqual, 3)
+			So(mock.Resets(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestChannelCollector(t *testing.T) {
+	Convey("given a channel collector with room for 3 events", t, func() {
+		events := NewChannelCollector(3)
+		collector := events.Collector("channel")
+
+		collector.Update(MetricResult{Attempts: 1, Errors: 1, Failures: 1, FallbackSuccesses: 1, RunDuration: time.Second})
+
+		Convey("an execution's events are delivered in order", func() {
+			e := <-events.Events()
+			So(e.Command, ShouldEqual, "channel")
+			So(e.Type, ShouldEqual, "failure")
+			So(e.Duration, ShouldEqual, time.Second)
+			So(e.Timestamp.IsZero(), ShouldBeFalse)
+			So((<-events.Events()).Type, ShouldEqual, "fallback-success")
+			So(events.Dropped(), ShouldEqual, 0)
+		})
+
+		Convey("events which don't fit are dropped and counted", func() {
+			collector.Update(MetricResult{Attempts: 1, Successes: 1, CustomEvents: map[string]float64{"cache-miss": 1}})
+			So(len(events.Events()), ShouldEqual, 3)
+			So(events.Dropped(), ShouldEqual, 1)
+		})
+	})
+}
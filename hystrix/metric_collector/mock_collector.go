@@ -0,0 +1,149 @@
+package metricCollector
+
+import (
+	"sync"
+	"time"
+)
+
+// MockCollector is a MetricCollector for tests, which totals the metrics it is given so that tests
+// can check what a command recorded, such as that it had 3 failures and 1 timeout.
+//
+//	var mock *metricCollector.MockCollector
+//	metricCollector.Registry.RegisterFor(func(name string) bool {
+//		return name == "my_command"
+//	}, func(name string) metricCollector.MetricCollector {
+//		mock = metricCollector.NewMockCollector(name)
+//		return mock
+//	})
+//
+// Metrics reach collectors asynchronously, so wait for them to arrive before checking the totals.
+type MockCollector struct {
+	Name string
+
+	mutex             sync.Mutex
+	totals            MetricResult
+	fallbackQualities map[string]float64
+	fallbackDurations []time.Duration
+	updates           int
+	resets            int
+}
+
+// NewMockCollector returns a MockCollector for the named command, with nothing recorded.
+func NewMockCollector(name string) *MockCollector {
+	return &MockCollector{Name: name}
+}
+
+// Update adds r to the totals.
+func (m *MockCollector) Update(r MetricResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.updates++
+	m.totals.Attempts += r.Attempts
+	m.totals.Errors += r.Errors
+	m.totals.Successes += r.Successes
+	m.totals.Failures += r.Failures
+	m.totals.Rejects += r.Rejects
+	m.totals.ShortCircuits += r.ShortCircuits
+	m.totals.Timeouts += r.Timeouts
+	m.totals.FallbackSuccesses += r.FallbackSuccesses
+	m.totals.FallbackFailures += r.FallbackFailures
+	m.totals.FallbackSkipped += r.FallbackSkipped
+	m.totals.FallbackRejected += r.FallbackRejected
+	m.totals.ProbeSuccesses += r.ProbeSuccesses
+	m.totals.ProbeFailures += r.ProbeFailures
+	m.totals.ContextCanceled += r.ContextCanceled
+	m.totals.ContextDeadlineExceeded += r.ContextDeadlineExceeded
+	m.totals.Draining += r.Draining
+	m.totals.TotalDuration += r.TotalDuration
+	m.totals.RunDuration += r.RunDuration
+	m.totals.FallbackDuration += r.FallbackDuration
+	m.totals.ConcurrencyInUse = r.ConcurrencyInUse
+	for eventType, n := range r.CustomEvents {
+		if m.totals.CustomEvents == nil {
+			m.totals.CustomEvents = make(map[string]float64)
+		}
+		m.totals.CustomEvents[eventType] += n
+	}
+}
+
+// UpdateFallbackQuality counts a successful fallback of the given quality.
+func (m *MockCollector) UpdateFallbackQuality(quality string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.fallbackQualities == nil {
+		m.fallbackQualities = make(map[string]float64)
+	}
+	m.fallbackQualities[quality]++
+}
+
+// UpdateFallbackDuration records how long a fallback took.
+func (m *MockCollector) UpdateFallbackDuration(fallbackDuration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.fallbackDurations = append(m.fallbackDurations, fallbackDuration)
+}
+
+// Reset counts the reset. Unlike other collectors, it keeps the totals, so that a reset during a
+// test doesn't hide what was recorded before it.
+func (m *MockCollector) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.resets++
+}
+
+// Totals returns the sum of every MetricResult given to Update. Durations are summed too, while
+// ConcurrencyInUse is the last one given.
+func (m *MockCollector) Totals() MetricResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	totals := m.totals
+	if m.totals.CustomEvents != nil {
+		totals.CustomEvents = make(map[string]float64, len(m.totals.CustomEvents))
+		for eventType, n := range m.totals.CustomEvents {
+			totals.CustomEvents[eventType] = n
+		}
+	}
+	return totals
+}
+
+// FallbackQualities returns the number of successful fallbacks of each quality reported with
+// hystrix.ReportFallbackQuality.
+func (m *MockCollector) FallbackQualities() map[string]float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	qualities := make(map[string]float64, len(m.fallbackQualities))
+	for quality, n := range m.fallbackQualities {
+		qualities[quality] = n
+	}
+	return qualities
+}
+
+// Updates returns the number of times Update was called.
+func (m *MockCollector) Updates() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.updates
+}
+
+// Resets returns the number of times Reset was called.
+func (m *MockCollector) Resets() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.resets
+}
+
+// FallbackDurations returns how long each fallback took, in the order they were recorded.
+func (m *MockCollector) FallbackDurations() []time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]time.Duration(nil), m.fallbackDurations...)
+}
@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
-	"github.com/lesha888/hystrix-go/hystrix/rolling"
 )
 
 type commandExecution struct {
@@ -13,23 +12,49 @@ type commandExecution struct {
 	Start            time.Time     `json:"start_time"`
 	RunDuration      time.Duration `json:"run_duration"`
 	ConcurrencyInUse float64       `json:"concurrency_inuse"`
+	// ErrorWeight is how much an error counts towards the error percentage. Zero counts as 1.
+	ErrorWeight float64 `json:"error_weight"`
+	// FallbackQuality is the quality reported with ReportFallbackQuality by the command's fallback, if any.
+	FallbackQuality string `json:"fallback_quality,omitempty"`
+	// FallbackDuration is how long the command's fallback took, if one ran.
+	FallbackDuration time.Duration `json:"fallback_duration"`
+	// probe is set when the execution was let through as its circuit's probe.
+	probe bool
+	// command is set when a command reports its own execution, so that probe says for certain
+	// whether it was the probe, unlike events reported with ReportEvent.
+	command bool
 }
 
+// metricBatchSize bounds how many queued updates Monitor applies in one pass.
+const metricBatchSize = 128
+
 type metricExchange struct {
-	Name    string
+	Name string
+	// Updates is shared by every execution reporting to the exchange; only Monitor's side of it
+	// is batched.
 	Updates chan *commandExecution
 	Mutex   *sync.RWMutex
 
 	metricCollectors []metricCollector.MetricCollector
+	// onUpdate, if set, is called by Monitor after each batch of updates is applied.
+	onUpdate func()
+	// done is closed to stop Monitor.
+	done chan struct{}
 }
 
-func newMetricExchange(name string) *metricExchange {
+func newMetricExchange(name string, onUpdate func()) *metricExchange {
 	m := &metricExchange{}
 	m.Name = name
+	m.onUpdate = onUpdate
 
 	m.Updates = make(chan *commandExecution, 2000)
+	m.done = make(chan struct{})
 	m.Mutex = &sync.RWMutex{}
 	m.metricCollectors = metricCollector.Registry.InitializeMetricCollectors(name)
+	if newStat := getSettings(name).RollingStat; newStat != nil {
+		// the default collector, by which the circuit's health is judged, always comes first
+		m.metricCollectors[0] = metricCollector.NewDefaultMetricCollector(newStat)
+	}
 	m.Reset()
 
 	go m.Monitor()
@@ -49,28 +74,100 @@ func (m *metricExchange) DefaultCollector() *metricCollector.DefaultMetricCollec
 	return collection
 }
 
+// Monitor applies updates to the metric collectors. Updates which queue up while
+// collectors are busy are applied together, so that bursts cost one pass per collector
+// rather than one per update.
 func (m *metricExchange) Monitor() {
-	for update := range m.Updates {
+	batch := make([]metricCollector.MetricResult, 0, metricBatchSize)
+	for {
+		var update *commandExecution
+		select {
+		case update = <-m.Updates:
+		case <-m.done:
+			return
+		}
+
+		batch = append(batch[:0], m.metricResult(update))
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case update := <-m.Updates:
+				batch = append(batch, m.metricResult(update))
+			default:
+				break drain
+			}
+		}
+
 		// we only grab a read lock to make sure Reset() isn't changing the numbers.
 		m.Mutex.RLock()
+		if len(m.metricCollectors) == 1 {
+			updateCollector(m.metricCollectors[0], batch)
+		} else {
+			wg := &sync.WaitGroup{}
+			for _, collector := range m.metricCollectors {
+				wg.Add(1)
+				go func(collector metricCollector.MetricCollector) {
+					defer wg.Done()
+					updateCollector(collector, batch)
+				}(collector)
+			}
+			wg.Wait()
+		}
+		m.Mutex.RUnlock()
 
-		totalDuration := time.Since(update.Start)
-		wg := &sync.WaitGroup{}
-		for _, collector := range m.metricCollectors {
-			wg.Add(1)
-			go m.IncrementMetrics(wg, collector, update, totalDuration)
+		if m.onUpdate != nil {
+			m.onUpdate()
 		}
-		wg.Wait()
+	}
+}
 
-		m.Mutex.RUnlock()
+// apply records an update in the metric collectors at once, on the caller's goroutine, rather
+// than leaving it to Monitor. Updates applied this way are recorded one at a time, in order.
+func (m *metricExchange) apply(update *commandExecution) {
+	batch := []metricCollector.MetricResult{m.metricResult(update)}
+
+	// unlike Monitor, callers may apply updates at the same time
+	m.Mutex.Lock()
+	for _, collector := range m.metricCollectors {
+		updateCollector(collector, batch)
+	}
+	m.Mutex.Unlock()
+
+	if m.onUpdate != nil {
+		m.onUpdate()
+	}
+}
+
+// Close stops Monitor. Updates sent afterwards are ignored.
+func (m *metricExchange) Close() {
+	close(m.done)
+}
+
+func updateCollector(collector metricCollector.MetricCollector, batch []metricCollector.MetricResult) {
+	qualities, _ := collector.(metricCollector.FallbackQualityCollector)
+	durations, _ := collector.(metricCollector.FallbackDurationCollector)
+	for _, r := range batch {
+		collector.Update(r)
+		if qualities != nil && r.FallbackQuality != "" {
+			qualities.UpdateFallbackQuality(r.FallbackQuality)
+		}
+		if durations != nil && (r.FallbackSuccesses > 0 || r.FallbackFailures > r.FallbackRejected) {
+			// a rejected fallback never ran
+			durations.UpdateFallbackDuration(r.FallbackDuration)
+		}
 	}
 }
 
-func (m *metricExchange) IncrementMetrics(wg *sync.WaitGroup, collector metricCollector.MetricCollector, update *commandExecution, totalDuration time.Duration) {
-	// granular metrics
+// metricResult translates a command execution into the granular metrics given to collectors.
+func (m *metricExchange) metricResult(update *commandExecution) metricCollector.MetricResult {
+	errorWeight := update.ErrorWeight
+	if errorWeight == 0 {
+		errorWeight = 1
+	}
+
 	r := metricCollector.MetricResult{
 		Attempts:         1,
-		TotalDuration:    totalDuration,
+		TotalDuration:    clockNow().Sub(update.Start),
 		RunDuration:      update.RunDuration,
 		ConcurrencyInUse: update.ConcurrencyInUse,
 	}
@@ -80,35 +177,92 @@ func (m *metricExchange) IncrementMetrics(wg *sync.WaitGroup, collector metricCo
 		r.Successes = 1
 	case "failure":
 		r.Failures = 1
-		r.Errors = 1
 	case "rejected":
 		r.Rejects = 1
-		r.Errors = 1
 	case "short-circuit":
 		r.ShortCircuits = 1
-		r.Errors = 1
 	case "timeout":
 		r.Timeouts = 1
-		r.Errors = 1
 	case "context_canceled":
 		r.ContextCanceled = 1
 	case "context_deadline_exceeded":
 		r.ContextDeadlineExceeded = 1
+	case "draining":
+		r.Draining = 1
+	case "fallback-success", "fallback-failure":
+		// a fallback ran without an attempt of its own, such as for a coalesced caller
+		r.Attempts = 0
+	}
+
+	if countsAsError(m.Name, update.Types[0]) {
+		r.Errors = errorWeight
 	}
 
-	if len(update.Types) > 1 {
-		// fallback metrics
-		if update.Types[1] == "fallback-success" {
+	// fallback, probe and custom metrics
+	for _, t := range update.Types {
+		switch {
+		case t == "fallback-success":
 			r.FallbackSuccesses = 1
-		}
-		if update.Types[1] == "fallback-failure" {
+		case t == "fallback-failure":
 			r.FallbackFailures = 1
+		case t == "fallback-skipped":
+			r.FallbackSkipped = 1
+		case t == "fallback-rejected":
+			r.FallbackRejected = 1
+		case t == "probe-success":
+			r.ProbeSuccesses = 1
+		case t == "probe-failure":
+			r.ProbeFailures = 1
+		case !isBuiltinEvent(t):
+			if r.CustomEvents == nil {
+				r.CustomEvents = make(map[string]float64)
+			}
+			r.CustomEvents[t]++
 		}
 	}
 
-	collector.Update(r)
+	if r.FallbackSuccesses > 0 {
+		r.FallbackQuality = update.FallbackQuality
+	}
+	if r.FallbackSuccesses > 0 || r.FallbackFailures > r.FallbackRejected {
+		r.FallbackDuration = update.FallbackDuration
+	}
+
+	return r
+}
+
+// countsAsError reports whether an execution of the named command reported as eventType counts
+// towards its error percentage.
+func countsAsError(name, eventType string) bool {
+	switch eventType {
+	case "failure", "rejected", "short-circuit":
+		return true
+	case "timeout":
+		return getSettings(name).TimeoutsCountAsErrors
+	}
+	return false
+}
 
-	wg.Done()
+// builtinEvents are the event types hystrix reports itself. Any other event type is a custom event.
+var builtinEvents = map[string]bool{
+	"success":                   true,
+	"failure":                   true,
+	"rejected":                  true,
+	"short-circuit":             true,
+	"timeout":                   true,
+	"context_canceled":          true,
+	"context_deadline_exceeded": true,
+	"draining":                  true,
+	"fallback-success":          true,
+	"fallback-failure":          true,
+	"fallback-skipped":          true,
+	"fallback-rejected":         true,
+	"probe-success":             true,
+	"probe-failure":             true,
+}
+
+func isBuiltinEvent(eventType string) bool {
+	return builtinEvents[eventType]
 }
 
 func (m *metricExchange) Reset() {
@@ -120,31 +274,62 @@ func (m *metricExchange) Reset() {
 	}
 }
 
-func (m *metricExchange) Requests() *rolling.Number {
+func (m *metricExchange) Requests() metricCollector.RollingStat {
 	m.Mutex.RLock()
 	defer m.Mutex.RUnlock()
 	return m.requestsLocked()
 }
 
-func (m *metricExchange) requestsLocked() *rolling.Number {
-	return m.DefaultCollector().NumRequests()
+func (m *metricExchange) requestsLocked() metricCollector.RollingStat {
+	return m.DefaultCollector().NumRequestsStat()
 }
 
 func (m *metricExchange) ErrorPercent(now time.Time) int {
 	m.Mutex.RLock()
 	defer m.Mutex.RUnlock()
 
-	var errPct float64
-	reqs := m.requestsLocked().Sum(now)
-	errs := m.DefaultCollector().Errors().Sum(now)
+	collector := m.DefaultCollector()
+	requests, errors := collector.NumRequestsStat().Sum(now), collector.ErrorsStat().Sum(now)
+	return ErrorPercentage(requests-errors, errors, 0, 0, 0)
+}
 
-	if reqs > 0 {
-		errPct = (float64(errs) / float64(reqs)) * 100
+// ErrorPercentage returns the error percentage a circuit judges its health by, given counts of the
+// outcomes of its recent requests. Failures, timeouts, rejections and short-circuits all count
+// as errors: a circuit which is rejecting or short-circuiting requests is still unavailable to
+// its callers. The percentage is of all of the given requests, rounded to the nearest whole
+// percent, and zero when there are none.
+//
+// A circuit takes its percentage with this function, from counts already adjusted by its
+// settings: it passes the errors it counted as failures, and the rest of its requests as
+// successes. Errors count as their ErrorWeight, timeouts are errors only when
+// TimeoutsCountAsErrors, and requests canceled by their callers count as requests but not as
+// errors. To reproduce the percentage of a command whose timeouts aren't errors from raw counts,
+// pass its timeouts as successes.
+func ErrorPercentage(successes, failures, timeouts, rejects, shortCircuits float64) int {
+	errors := failures + timeouts + rejects + shortCircuits
+	requests := successes + errors
+	if requests <= 0 {
+		return 0
 	}
-
-	return int(errPct + 0.5)
+	return int(errors/requests*100 + 0.5)
 }
 
+// IsHealthy reports whether the command's errors are below its ErrorPercentThreshold and,
+// when it has a LatencyThreshold, its run durations are within it.
 func (m *metricExchange) IsHealthy(now time.Time) bool {
-	return m.ErrorPercent(now) < getSettings(m.Name).ErrorPercentThreshold
+	return m.ErrorPercent(now) < getSettings(m.Name).ErrorPercentThreshold && !m.tooSlow()
+}
+
+// tooSlow reports whether the command's run duration at its LatencyPercentile exceeds its LatencyThreshold.
+func (m *metricExchange) tooSlow() bool {
+	settings := getSettings(m.Name)
+	if settings.LatencyThreshold <= 0 {
+		return false
+	}
+
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	p := m.DefaultCollector().RunDuration().Percentile(settings.LatencyPercentile)
+	return time.Duration(p)*time.Millisecond > settings.LatencyThreshold
 }
@@ -1,14 +1,19 @@
 package hystrix
 
 import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 func metricFailingPercent(p int) *metricExchange {
-	m := newMetricExchange("")
+	m := newMetricExchange("", nil)
 	for i := 0; i < 100; i++ {
 		t := "success"
 		if i < p {
@@ -43,3 +48,415 @@ func TestErrorPercent(t *testing.T) {
 		})
 	})
 }
+
+func TestErrorPercentage(t *testing.T) {
+	Convey("the error percentage", t, func() {
+		Convey("of no requests is 0", func() {
+			So(ErrorPercentage(0, 0, 0, 0, 0), ShouldEqual, 0)
+		})
+
+		Convey("of only failures is 100", func() {
+			So(ErrorPercentage(0, 5, 0, 0, 0), ShouldEqual, 100)
+		})
+
+		Convey("counts timeouts, rejections and short-circuits as errors", func() {
+			So(ErrorPercentage(4, 1, 1, 1, 1), ShouldEqual, 50)
+		})
+
+		Convey("is rounded to the nearest percent", func() {
+			So(ErrorPercentage(2, 1, 0, 0, 0), ShouldEqual, 33)
+			So(ErrorPercentage(1, 2, 0, 0, 0), ShouldEqual, 67)
+			So(ErrorPercentage(199, 1, 0, 0, 0), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestTimeoutsCountAsErrors(t *testing.T) {
+	Convey("with a command whose timeouts don't count as errors", t, func() {
+		countTimeouts := false
+		ConfigureCommand("timeouts_not_errors", CommandConfig{TimeoutsCountAsErrors: &countTimeouts})
+		defer ConfigureCommand("timeouts_not_errors", CommandConfig{})
+
+		m := newMetricExchange("timeouts_not_errors", nil)
+		defer m.Close()
+		for _, t := range []string{"timeout", "timeout", "failure", "success"} {
+			m.Updates <- &commandExecution{Types: []string{t}}
+		}
+		time.Sleep(100 * time.Millisecond)
+		now := time.Now()
+
+		Convey("only the failure is in the error percentage", func() {
+			So(m.ErrorPercent(now), ShouldEqual, 25)
+
+			Convey("as ErrorPercentage gives it with the timeouts passed as successes", func() {
+				So(ErrorPercentage(3, 1, 0, 0, 0), ShouldEqual, m.ErrorPercent(now))
+			})
+		})
+
+		Convey("the timeouts are still counted", func() {
+			So(m.DefaultCollector().TimeoutCount(now), ShouldEqual, 2)
+		})
+	})
+
+	Convey("by default, timeouts count as errors", t, func() {
+		So(getSettings("timeouts_are_errors").TimeoutsCountAsErrors, ShouldBeTrue)
+	})
+}
+
+func TestDefaultCollectorQueries(t *testing.T) {
+	Convey("with a circuit which has seen a mix of outcomes", t, func() {
+		defer Flush()
+
+		cb, _, err := GetCircuit("queries")
+		So(err, ShouldBeNil)
+		for _, eventType := range []string{"success", "success", "failure", "timeout"} {
+			So(cb.ReportEvent([]string{eventType}, time.Now(), 0), ShouldBeNil)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("the counts can be read back from its metrics", func() {
+			now := time.Now()
+			So(cb.Metrics().RequestCount(now), ShouldEqual, 4)
+			So(cb.Metrics().SuccessCount(now), ShouldEqual, 2)
+			So(cb.Metrics().FailureCount(now), ShouldEqual, 1)
+			So(cb.Metrics().TimeoutCount(now), ShouldEqual, 1)
+			So(cb.Metrics().ErrorCount(now), ShouldEqual, 2)
+			So(cb.Metrics().ErrorPercentage(now), ShouldEqual, 50)
+		})
+	})
+}
+
+func BenchmarkMetricExchange(b *testing.B) {
+	m := newMetricExchange("bench", nil)
+	defer m.Close()
+	update := &commandExecution{
+		Types:       []string{"success"},
+		Start:       time.Now(),
+		RunDuration: time.Millisecond,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Updates <- update
+		}
+	})
+	for len(m.Updates) > 0 {
+		runtime.Gosched()
+	}
+}
+
+// totalStat is a RollingStat which never forgets, standing in for another way of aggregating.
+type totalStat struct {
+	mutex sync.Mutex
+	total float64
+}
+
+func (s *totalStat) Increment(i float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.total += i
+}
+
+func (s *totalStat) UpdateMax(n float64) {}
+
+func (s *totalStat) Sum(now time.Time) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.total
+}
+
+func (s *totalStat) Max(now time.Time) float64 { return 0 }
+func (s *totalStat) Avg(now time.Time) float64 { return 0 }
+
+func TestRollingStat(t *testing.T) {
+	Convey("with a command configured with its own rolling statistic", t, func() {
+		defer Flush()
+		defer ConfigureCommand("rolling_stat", CommandConfig{})
+		ConfigureCommand("rolling_stat", CommandConfig{
+			RollingStat: func() metricCollector.RollingStat { return &totalStat{} },
+		})
+
+		Do("rolling_stat", func() error { return nil }, nil)
+		Do("rolling_stat", func() error { return fmt.Errorf("failed") }, nil)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("its metrics are kept in that statistic", func() {
+			cb, _, _ := GetCircuit("rolling_stat")
+			So(cb.Metrics().NumRequestsStat(), ShouldHaveSameTypeAs, &totalStat{})
+			So(cb.Metrics().NumRequests(), ShouldBeNil)
+			So(cb.Metrics().RequestCount(time.Now().Add(time.Hour)), ShouldEqual, 2)
+			So(cb.Metrics().ErrorPercentage(time.Now()), ShouldEqual, 50)
+		})
+	})
+}
+
+func TestSyncMetrics(t *testing.T) {
+	Convey("with a command which runs inline and records its metrics synchronously", t, func() {
+		defer Flush()
+		ConfigureCommand("sync_metrics", CommandConfig{SyncMetrics: true, RunInline: true})
+		defer ConfigureCommand("sync_metrics", CommandConfig{})
+		cb, _, _ := GetCircuit("sync_metrics")
+
+		Convey("each execution is in the metrics as soon as DoC returns", func() {
+			for i := 1; i <= 10; i++ {
+				DoC(context.Background(), "sync_metrics", func(ctx context.Context) error {
+					return nil
+				}, nil)
+				DoC(context.Background(), "sync_metrics", func(ctx context.Context) error {
+					return fmt.Errorf("failed")
+				}, nil)
+
+				now := time.Now()
+				So(cb.Metrics().Successes().Sum(now), ShouldEqual, i)
+				So(cb.Metrics().Failures().Sum(now), ShouldEqual, i)
+			}
+			So(len(cb.metrics.Updates), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestFallbackDuration(t *testing.T) {
+	Convey("with a mock collector for a command with slow fallbacks", t, func() {
+		defer Flush()
+		clock := &fakeClock{now: time.Now()}
+		SetClock(clock)
+		defer SetClock(nil)
+		mocks := make(chan *metricCollector.MockCollector, 1)
+		metricCollector.Registry.RegisterFor(func(name string) bool {
+			return name == "fallback_duration"
+		}, func(name string) metricCollector.MetricCollector {
+			mock := metricCollector.NewMockCollector(name)
+			select {
+			case mocks <- mock:
+			default:
+				// a registration left by an earlier run of the test
+			}
+			return mock
+		})
+
+		slowFallback := func(d time.Duration, err error) func(context.Context, error) error {
+			return func(ctx context.Context, runErr error) error {
+				clock.advance(d)
+				return err
+			}
+		}
+		failing := func(ctx context.Context) error { return fmt.Errorf("failed") }
+		So(DoC(context.Background(), "fallback_duration", failing, slowFallback(30*time.Millisecond, nil)), ShouldBeNil)
+		So(DoC(context.Background(), "fallback_duration", failing, slowFallback(10*time.Millisecond, fmt.Errorf("also failed"))), ShouldNotBeNil)
+		So(DoC(context.Background(), "fallback_duration", func(ctx context.Context) error {
+			return nil
+		}, slowFallback(time.Second, nil)), ShouldBeNil)
+		mock := <-mocks
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("the duration of each fallback which ran is observed", func() {
+			So(mock.FallbackDurations(), ShouldResemble, []time.Duration{30 * time.Millisecond, 10 * time.Millisecond})
+			So(mock.Totals().FallbackDuration, ShouldEqual, 40*time.Millisecond)
+		})
+	})
+}
+
+func TestFallbackQuality(t *testing.T) {
+	Convey("with a mock collector for a command whose fallback reports its quality", t, func() {
+		defer Flush()
+		mocks := make(chan *metricCollector.MockCollector, 1)
+		metricCollector.Registry.RegisterFor(func(name string) bool {
+			return name == "fallback_quality"
+		}, func(name string) metricCollector.MetricCollector {
+			mock := metricCollector.NewMockCollector(name)
+			select {
+			case mocks <- mock:
+			default:
+				// a registration left by an earlier run of the test
+			}
+			return mock
+		})
+
+		fallback := func(quality string) func(context.Context, error) error {
+			return func(ctx context.Context, err error) error {
+				return ReportFallbackQuality(ctx, quality)
+			}
+		}
+		failing := func(ctx context.Context) error { return fmt.Errorf("failed") }
+		So(DoC(context.Background(), "fallback_quality", failing, fallback("fresh")), ShouldBeNil)
+		So(DoC(context.Background(), "fallback_quality", failing, fallback("degraded")), ShouldBeNil)
+		So(DoC(context.Background(), "fallback_quality", failing, fallback("degraded")), ShouldBeNil)
+		So(DoC(context.Background(), "fallback_quality", failing, func(ctx context.Context, err error) error {
+			ReportFallbackQuality(ctx, "degraded")
+			return err
+		}), ShouldNotBeNil)
+		mock := <-mocks
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("successful fallbacks are counted by quality", func() {
+			So(mock.FallbackQualities(), ShouldResemble, map[string]float64{"fresh": 1, "degraded": 2})
+			So(mock.Totals().FallbackSuccesses, ShouldEqual, 3)
+		})
+	})
+
+	Convey("an empty quality is refused", t, func() {
+		defer Flush()
+		var reportErr error
+		DoC(context.Background(), "fallback_quality_empty", func(ctx context.Context) error {
+			return fmt.Errorf("failed")
+		}, func(ctx context.Context, err error) error {
+			reportErr = ReportFallbackQuality(ctx, "")
+			return nil
+		})
+		So(reportErr, ShouldNotBeNil)
+	})
+}
+
+func TestAttemptOutcomes(t *testing.T) {
+	failing := func(ctx context.Context) error { return fmt.Errorf("failed") }
+	succeeding := func(ctx context.Context) error { return nil }
+	waiting := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	noTimeoutErrors := false
+
+	outcomes := []struct {
+		name     string
+		config   CommandConfig
+		execute  func(name string)
+		expected metricCollector.MetricResult
+	}{
+		{
+			name:     "a success",
+			execute:  func(name string) { DoC(context.Background(), name, succeeding, nil) },
+			expected: metricCollector.MetricResult{Attempts: 1, Successes: 1},
+		},
+		{
+			name:     "a failure",
+			execute:  func(name string) { DoC(context.Background(), name, failing, nil) },
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, Failures: 1},
+		},
+		{
+			name: "a failure served by its fallback",
+			execute: func(name string) {
+				DoC(context.Background(), name, failing, func(ctx context.Context, err error) error { return nil })
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, Failures: 1, FallbackSuccesses: 1},
+		},
+		{
+			name: "a failure whose fallback fails",
+			execute: func(name string) {
+				DoC(context.Background(), name, failing, func(ctx context.Context, err error) error { return err })
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, Failures: 1, FallbackFailures: 1},
+		},
+		{
+			name:   "a failure weighing 3 errors",
+			config: CommandConfig{ErrorWeight: func(error) float64 { return 3 }},
+			execute: func(name string) {
+				DoC(context.Background(), name, failing, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 3, Failures: 1},
+		},
+		{
+			name:     "a timeout",
+			config:   CommandConfig{Timeout: 10},
+			execute:  func(name string) { DoC(context.Background(), name, waiting, nil) },
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, Timeouts: 1},
+		},
+		{
+			name:     "a timeout which doesn't count as an error",
+			config:   CommandConfig{Timeout: 10, TimeoutsCountAsErrors: &noTimeoutErrors},
+			execute:  func(name string) { DoC(context.Background(), name, waiting, nil) },
+			expected: metricCollector.MetricResult{Attempts: 1, Timeouts: 1},
+		},
+		{
+			name:   "a rejection for want of a ticket",
+			config: CommandConfig{MaxConcurrentRequests: 1},
+			execute: func(name string) {
+				cb, _, _ := GetCircuit(name)
+				ticket := cb.executorPool.tryAcquire()
+				defer cb.executorPool.put(ticket)
+				DoC(context.Background(), name, succeeding, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, Rejects: 1, FallbackSkipped: 1},
+		},
+		{
+			name:   "a success and a rejection by the rate limit",
+			config: CommandConfig{MaxRequestsPerSecond: 0.01},
+			execute: func(name string) {
+				DoC(context.Background(), name, succeeding, nil)
+				DoC(context.Background(), name, succeeding, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 2, Errors: 1, Successes: 1, Rejects: 1, FallbackSkipped: 1},
+		},
+		{
+			name: "a short circuit",
+			execute: func(name string) {
+				cb, _, _ := GetCircuit(name)
+				cb.toggleForceOpen(true)
+				DoC(context.Background(), name, succeeding, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Errors: 1, ShortCircuits: 1, FallbackSkipped: 1},
+		},
+		{
+			name: "a run canceled by its caller",
+			execute: func(name string) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				DoC(ctx, name, waiting, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, ContextCanceled: 1},
+		},
+		{
+			name: "a run whose context's deadline passed",
+			execute: func(name string) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				DoC(ctx, name, waiting, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, ContextDeadlineExceeded: 1},
+		},
+		{
+			name: "a rejection while draining",
+			execute: func(name string) {
+				StartDrainingCommand(name)
+				defer StopDrainingCommand(name)
+				DoC(context.Background(), name, succeeding, nil)
+			},
+			expected: metricCollector.MetricResult{Attempts: 1, Draining: 1, FallbackSkipped: 1},
+		},
+	}
+
+	for i, outcome := range outcomes {
+		Convey("the metrics of "+outcome.name, t, func() {
+			defer Flush()
+			name := fmt.Sprintf("attempt_outcome_%d", i)
+			ConfigureCommand(name, outcome.config)
+			defer ConfigureCommand(name, CommandConfig{})
+			mocks := make(chan *metricCollector.MockCollector, 1)
+			metricCollector.Registry.RegisterFor(func(n string) bool {
+				return n == name
+			}, func(n string) metricCollector.MetricCollector {
+				mock := metricCollector.NewMockCollector(n)
+				select {
+				case mocks <- mock:
+				default:
+					// a registration left by an earlier run of the test
+				}
+				return mock
+			})
+
+			outcome.execute(name)
+			mock := <-mocks
+			time.Sleep(50 * time.Millisecond)
+			totals := mock.Totals()
+			totals.TotalDuration, totals.RunDuration, totals.FallbackDuration, totals.ConcurrencyInUse = 0, 0, 0, 0
+
+			Convey("count each attempt once, by its outcome", func() {
+				So(mock.Updates(), ShouldEqual, int(outcome.expected.Attempts))
+				So(totals, ShouldResemble, outcome.expected)
+				So(totals.Attempts, ShouldEqual, totals.Successes+totals.Failures+totals.Rejects+
+					totals.ShortCircuits+totals.Timeouts+totals.ContextCanceled+totals.ContextDeadlineExceeded+totals.Draining)
+			})
+		})
+	}
+}
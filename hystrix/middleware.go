@@ -0,0 +1,84 @@
+package hystrix
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// RunFunc is a command's run function, as given to GoC and DoC.
+type RunFunc func(context.Context) error
+
+// Middleware wraps a command's run function with behavior of its own, such as logging, tracing or
+// authorization, calling next to run the command. It runs once the command holds a ticket, within
+// its Timeout, so the time it takes counts towards the command's.
+type Middleware func(next RunFunc) RunFunc
+
+var (
+	// middlewareChains holds a *middlewareChain, replaced whenever middleware is added.
+	middlewareChains atomic.Value
+	// middlewareMutex serializes adding middleware.
+	middlewareMutex sync.Mutex
+)
+
+// middlewareChain is the middleware registered for all commands, and for each command by name.
+type middlewareChain struct {
+	global   []Middleware
+	commands map[string][]Middleware
+}
+
+// Use adds middleware around the run function of every command executed with GoC, Go, DoC or Do.
+// The first middleware given is the outermost, and middleware added by earlier calls wraps that
+// added by later ones. Add middleware before executing any commands.
+func Use(middleware ...Middleware) {
+	addMiddleware(func(chain *middlewareChain) {
+		chain.global = append(chain.global[:len(chain.global):len(chain.global)], middleware...)
+	})
+}
+
+// UseForCommand adds middleware around the run function of the named command alone, in the same
+// order as Use. It runs inside the middleware added with Use.
+func UseForCommand(name string, middleware ...Middleware) {
+	name = normalizeCommandName(name)
+	addMiddleware(func(chain *middlewareChain) {
+		existing := chain.commands[name]
+		chain.commands[name] = append(existing[:len(existing):len(existing)], middleware...)
+	})
+}
+
+// addMiddleware replaces the middleware chain with a copy changed by add.
+func addMiddleware(add func(*middlewareChain)) {
+	middlewareMutex.Lock()
+	defer middlewareMutex.Unlock()
+
+	chain := &middlewareChain{commands: make(map[string][]Middleware)}
+	if current, ok := middlewareChains.Load().(*middlewareChain); ok {
+		chain.global = current.global
+		for name, middleware := range current.commands {
+			chain.commands[name] = middleware
+		}
+	}
+	add(chain)
+	middlewareChains.Store(chain)
+}
+
+// applyMiddleware wraps run in the middleware for the named command, outermost first.
+func applyMiddleware(name string, run runFuncC) runFuncC {
+	chain, ok := middlewareChains.Load().(*middlewareChain)
+	if !ok {
+		return run
+	}
+	commandMiddleware := chain.commands[name]
+	if len(chain.global) == 0 && len(commandMiddleware) == 0 {
+		return run
+	}
+
+	wrapped := RunFunc(run)
+	for i := len(commandMiddleware) - 1; i >= 0; i-- {
+		wrapped = commandMiddleware[i](wrapped)
+	}
+	for i := len(chain.global) - 1; i >= 0; i-- {
+		wrapped = chain.global[i](wrapped)
+	}
+	return runFuncC(wrapped)
+}
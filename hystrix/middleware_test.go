@@ -0,0 +1,65 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddleware(t *testing.T) {
+	Convey("with middleware for all commands and for one", t, func() {
+		defer Flush()
+		defer middlewareChains.Store(&middlewareChain{})
+
+		var calls []string
+		record := func(label string) Middleware {
+			return func(next RunFunc) RunFunc {
+				return func(ctx context.Context) error {
+					calls = append(calls, label)
+					return next(ctx)
+				}
+			}
+		}
+		Use(record("outer"), record("inner"))
+		UseForCommand("middleware", record("command"))
+
+		Convey("the command's middleware runs innermost, around run", func() {
+			err := DoC(context.Background(), "middleware", func(ctx context.Context) error {
+				calls = append(calls, "run")
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+			So(calls, ShouldResemble, []string{"outer", "inner", "command", "run"})
+		})
+
+		Convey("other commands run only the global middleware", func() {
+			err := DoC(context.Background(), "other_middleware", func(ctx context.Context) error {
+				calls = append(calls, "run")
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+			So(calls, ShouldResemble, []string{"outer", "inner", "run"})
+		})
+	})
+
+	Convey("middleware runs within the command's timeout", t, func() {
+		defer Flush()
+		defer middlewareChains.Store(&middlewareChain{})
+		ConfigureCommand("slow_middleware", CommandConfig{Timeout: 10})
+		defer ConfigureCommand("slow_middleware", CommandConfig{})
+
+		UseForCommand("slow_middleware", func(next RunFunc) RunFunc {
+			return func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return next(ctx)
+			}
+		})
+		err := DoC(context.Background(), "slow_middleware", func(ctx context.Context) error {
+			return nil
+		}, nil)
+		So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,60 @@
+package hystrix
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var commandNameNormalizer atomic.Value
+
+// commandAliases maps the names of aliased commands to the names they report under.
+var commandAliases sync.Map
+
+// commandNameNormalizerFunc wraps the normalizer, since an atomic.Value can't hold nil.
+type commandNameNormalizerFunc struct {
+	fn func(string) string
+}
+
+// SetCommandNameNormalizer sets a function which maps the command names given to hystrix to the
+// names commands are known by, so that names generated from high-cardinality input, such as the
+// URLs /users/123 and /users/456, can share a single command such as /users/:id. The normalized
+// name is used throughout: for the circuit, its settings, its metrics and the event stream.
+//
+// fn is called on every execution, so it should be quick, and it must give the same answer each
+// time it is given a name, including a name it has already normalized. Set it before executing
+// or configuring any commands. A nil fn leaves names as they are, which is the default.
+func SetCommandNameNormalizer(fn func(string) string) {
+	commandNameNormalizer.Store(commandNameNormalizerFunc{fn: fn})
+}
+
+// AliasCommand makes the command newName an alias of oldName, so that a command can be renamed in
+// code without breaking the dashboards and alerts keyed on its old name. Executions of newName run
+// as oldName: they share its circuit, settings and executor pool, and report their metrics under
+// its name. Aliases are applied after the command name normalizer, and aliasing a name to itself
+// removes its alias. Set aliases before executing or configuring the commands.
+func AliasCommand(newName, oldName string) {
+	newName = applyCommandNameNormalizer(newName)
+	if applyCommandNameNormalizer(oldName) == newName {
+		commandAliases.Delete(newName)
+		return
+	}
+	commandAliases.Store(newName, normalizeCommandName(oldName))
+}
+
+// normalizeCommandName returns the name the command given as name is known by.
+func normalizeCommandName(name string) string {
+	name = applyCommandNameNormalizer(name)
+	if alias, ok := commandAliases.Load(name); ok {
+		return alias.(string)
+	}
+	return name
+}
+
+// applyCommandNameNormalizer returns name as normalized by the command name normalizer, if there is one.
+func applyCommandNameNormalizer(name string) string {
+	normalizer, _ := commandNameNormalizer.Load().(commandNameNormalizerFunc)
+	if normalizer.fn == nil {
+		return name
+	}
+	return normalizer.fn(name)
+}
@@ -0,0 +1,93 @@
+package hystrix
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCommandNameNormalizer(t *testing.T) {
+	Convey("with a normalizer collapsing user IDs", t, func() {
+		defer Flush()
+		SetCommandNameNormalizer(func(name string) string {
+			if strings.HasPrefix(name, "/users/") {
+				return "/users/:id"
+			}
+			return name
+		})
+		defer SetCommandNameNormalizer(nil)
+
+		ConfigureCommand("/users/1", CommandConfig{MaxConcurrentRequests: 3})
+		defer ConfigureCommand("/users/:id", CommandConfig{})
+		var names []string
+		for _, name := range []string{"/users/123", "/users/456"} {
+			DoC(context.Background(), name, func(ctx context.Context) error {
+				n, _ := CommandNameFromContext(ctx)
+				names = append(names, n)
+				return nil
+			}, nil)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("the commands are treated as one", func() {
+			So(CommandNames(), ShouldResemble, []string{"/users/:id"})
+			So(names, ShouldResemble, []string{"/users/:id", "/users/:id"})
+
+			cb, created, _ := GetCircuit("/users/789")
+			So(created, ShouldBeFalse)
+			So(cb.Name, ShouldEqual, "/users/:id")
+			So(cb.executorPool.Max, ShouldEqual, 3)
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 2)
+		})
+
+		Convey("other names are left as they are", func() {
+			Do("other", func() error { return nil }, nil)
+			So(CommandNames(), ShouldResemble, []string{"/users/:id", "other"})
+		})
+	})
+}
+
+func TestAliasCommand(t *testing.T) {
+	Convey("with a command renamed from checkout to place_order", t, func() {
+		defer Flush()
+		AliasCommand("place_order", "checkout")
+		defer AliasCommand("place_order", "place_order")
+		ConfigureCommand("checkout", CommandConfig{MaxConcurrentRequests: 7})
+		defer ConfigureCommand("checkout", CommandConfig{})
+
+		var name string
+		err := DoC(context.Background(), "place_order", func(ctx context.Context) error {
+			name, _ = CommandNameFromContext(ctx)
+			return nil
+		}, nil)
+		So(err, ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("it runs as, and reports under, the old name", func() {
+			So(name, ShouldEqual, "checkout")
+			So(CommandNames(), ShouldResemble, []string{"checkout"})
+
+			cb, _, _ := GetCircuit("checkout")
+			So(cb.executorPool.Max, ShouldEqual, 7)
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("the alias and the old name share a circuit", func() {
+			cb, _, _ := GetCircuit("checkout")
+			cb.setOpen()
+			alias, _, _ := GetCircuit("place_order")
+			So(alias, ShouldEqual, cb)
+			So(alias.IsOpen(), ShouldBeTrue)
+		})
+
+		Convey("aliasing the name to itself removes the alias", func() {
+			AliasCommand("place_order", "place_order")
+			cb, created, _ := GetCircuit("place_order")
+			So(created, ShouldBeTrue)
+			So(cb.Name, ShouldEqual, "place_order")
+		})
+	})
+}
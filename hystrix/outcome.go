@@ -0,0 +1,65 @@
+package hystrix
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CommandOutcome describes how a command execution ended.
+type CommandOutcome struct {
+	Name string
+	// Success is set when run completed without error in time.
+	Success bool
+	// Err is the error which stopped the command succeeding: run's error, or the CircuitError or
+	// context error which kept it from completing. It is nil on success, and kept when a fallback ran.
+	Err error
+	// Duration is the time from the command's start until its outcome was settled, including any fallback.
+	Duration time.Duration
+	// FellBack is set when the fallback ran, whether or not it succeeded.
+	FellBack bool
+	// ShortCircuited is set when the command didn't run because its circuit was open.
+	ShortCircuited bool
+}
+
+var outcomeObserver atomic.Value
+
+// outcomeObserverFunc wraps the observer, since an atomic.Value can't hold nil.
+type outcomeObserverFunc struct {
+	fn func(CommandOutcome)
+}
+
+// SetOutcomeObserver sets a function to be called once with the outcome of every command executed
+// with GoC, Go, DoC or Do, as a lighter alternative to registering a MetricCollector. It is called
+// on the command's goroutine after the caller has been given its result, so it should return
+// quickly. A nil fn removes the observer.
+func SetOutcomeObserver(fn func(CommandOutcome)) {
+	outcomeObserver.Store(outcomeObserverFunc{fn: fn})
+}
+
+// observeOutcome hands the outcome described by c's events to the observer, if there is one.
+func (c *command) observeOutcome() {
+	observer, _ := outcomeObserver.Load().(outcomeObserverFunc)
+	if observer.fn == nil {
+		return
+	}
+
+	outcome := CommandOutcome{
+		Name:     c.circuit.Name,
+		Err:      c.err,
+		Duration: clockNow().Sub(c.start),
+	}
+	for _, eventType := range c.events {
+		switch eventType {
+		case "success":
+			outcome.Success = true
+		case "short-circuit":
+			outcome.ShortCircuited = true
+		case "fallback-success", "fallback-failure":
+			outcome.FellBack = true
+		case "fallback-rejected":
+			// reported after the fallback-failure, since the fallback never ran
+			outcome.FellBack = false
+		}
+	}
+	observer.fn(outcome)
+}
@@ -0,0 +1,60 @@
+package hystrix
+
+import (
+	"context"
+	"time"
+)
+
+// Override holds the settings which a single execution may change, such as a tighter Timeout for
+// one tenant's traffic. Only these may be overridden: the command's concurrency, its circuit and the
+// rest of its settings are shared by every execution. A zero field keeps the command's setting.
+type Override struct {
+	// Timeout replaces the command's Timeout. A TotalTimeout still applies, and an execution timed out by
+	// its context's deadline with DoCContextTimeout ignores both.
+	Timeout time.Duration
+	// MaxQueueWait replaces the command's MaxQueueWait, letting the execution queue for a ticket even
+	// when the command's executions don't.
+	MaxQueueWait time.Duration
+}
+
+type overrideKey struct{}
+
+// WithOverride returns a copy of ctx carrying o, which GoC, DoC and the functions built on them apply
+// to the single execution given it. Overriding a context which carries an override already keeps the
+// fields o leaves zero. The override is not passed on to the run and fallback functions, so commands
+// they execute with their context keep their own settings.
+func WithOverride(ctx context.Context, o Override) context.Context {
+	if parent, ok := overrideFrom(ctx); ok {
+		if o.Timeout == 0 {
+			o.Timeout = parent.Timeout
+		}
+		if o.MaxQueueWait == 0 {
+			o.MaxQueueWait = parent.MaxQueueWait
+		}
+	}
+	return context.WithValue(ctx, overrideKey{}, o)
+}
+
+// overrideFrom returns the override carried by ctx, if there is one.
+func overrideFrom(ctx context.Context) (Override, bool) {
+	o, ok := ctx.Value(overrideKey{}).(Override)
+	return o, ok
+}
+
+// timeout returns how long the command may run before timing out.
+func (c *command) timeout() time.Duration {
+	timeout := getSettings(c.circuit.Name).Timeout
+	if c.override.Timeout > 0 {
+		timeout = c.override.Timeout
+	}
+	return timeout
+}
+
+// maxQueueWait returns how long the command may wait for a ticket.
+func (c *command) maxQueueWait() time.Duration {
+	wait := getSettings(c.circuit.Name).MaxQueueWait
+	if c.override.MaxQueueWait > 0 {
+		wait = c.override.MaxQueueWait
+	}
+	return wait
+}
@@ -0,0 +1,74 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWithOverride(t *testing.T) {
+	Convey("with a command which times out after a second", t, func() {
+		defer Flush()
+		ConfigureCommand("override", CommandConfig{Timeout: 1000, MaxConcurrentRequests: 1})
+		defer ConfigureCommand("override", CommandConfig{})
+		sleep := func(d time.Duration) runFuncC {
+			return func(ctx context.Context) error {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+				}
+				return nil
+			}
+		}
+
+		Convey("an execution given a shorter timeout times out after it", func() {
+			ctx := WithOverride(context.Background(), Override{Timeout: 20 * time.Millisecond})
+			start := time.Now()
+			err := DoC(ctx, "override", sleep(time.Second), nil)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+
+			Convey("while the command's settings and other executions are unchanged", func() {
+				So(getSettings("override").Timeout, ShouldEqual, time.Second)
+				So(DoC(context.Background(), "override", sleep(50*time.Millisecond), nil), ShouldBeNil)
+			})
+		})
+
+		Convey("an execution given a longer queue wait waits for a ticket", func() {
+			cb, _, _ := GetCircuit("override")
+			ticket := cb.executorPool.tryAcquire()
+			time.AfterFunc(20*time.Millisecond, func() { cb.executorPool.put(ticket) })
+
+			ctx := WithOverride(context.Background(), Override{MaxQueueWait: time.Second})
+			So(DoC(ctx, "override", sleep(0), nil), ShouldBeNil)
+
+			Convey("which others don't", func() {
+				ticket := cb.executorPool.tryAcquire()
+				defer cb.executorPool.put(ticket)
+				err := DoC(context.Background(), "override", sleep(0), nil)
+				So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+			})
+		})
+
+		Convey("the override isn't passed on to the run function's context", func() {
+			var overridden bool
+			ctx := WithOverride(context.Background(), Override{Timeout: 500 * time.Millisecond})
+			So(DoC(ctx, "override", func(ctx context.Context) error {
+				_, overridden = overrideFrom(ctx)
+				return nil
+			}, nil), ShouldBeNil)
+			So(overridden, ShouldBeFalse)
+		})
+	})
+
+	Convey("overriding a context with an override keeps the fields left zero", t, func() {
+		ctx := WithOverride(context.Background(), Override{Timeout: time.Second, MaxQueueWait: time.Second})
+		ctx = WithOverride(ctx, Override{Timeout: time.Millisecond})
+		o, ok := overrideFrom(ctx)
+		So(ok, ShouldBeTrue)
+		So(o, ShouldResemble, Override{Timeout: time.Millisecond, MaxQueueWait: time.Second})
+	})
+}
@@ -0,0 +1,53 @@
+package hystrix
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrPanic is matched, with errors.Is, by the error of a run or fallback function which panicked
+// in a command configured with RecoverPanics.
+var ErrPanic = CircuitError{Message: "panic"}
+
+// PanicError is the error a run or fallback function returns in place of panicking, when its
+// command is configured with RecoverPanics.
+type PanicError struct {
+	// Value is the value the function panicked with.
+	Value interface{}
+	// Stack is the stack trace of the goroutine where the panic was recovered.
+	Stack []byte
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("hystrix: panic: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns ErrPanic, so that errors.Is(err, ErrPanic) tells panics apart.
+func (e PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// recoverRun makes run return a PanicError when it panics.
+func recoverRun(run runFuncC) runFuncC {
+	return func(ctx context.Context) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+		return run(ctx)
+	}
+}
+
+// recoverFallback makes fallback return a PanicError when it panics.
+func recoverFallback(fallback fallbackFuncC) fallbackFuncC {
+	return func(ctx context.Context, runErr error) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+		return fallback(ctx, runErr)
+	}
+}
@@ -1,37 +1,277 @@
 package hystrix
 
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type executorPool struct {
 	Name    string
 	Metrics *poolMetrics
+	// mutex guards Max, Tickets, resized and excess, which are replaced when the pool is resized.
+	mutex   sync.RWMutex
 	Max     int
 	Tickets chan *struct{}
+	// excess counts the tickets held beyond Max since the pool shrank below the number held. They
+	// are dropped rather than put back when returned, so that the pool holds Max tickets, free and
+	// held, once they are all back. It is changed atomically by put, under mutex held for reading.
+	excess int64
+	// resized is closed when the pool is resized, waking commands waiting on the old Tickets.
+	resized chan struct{}
+	// boosted is how many tickets BoostConcurrency has added to the pool's configured size for now.
+	// It is guarded by mutex.
+	boosted int
+	// custom, when set, is the TicketPool the pool takes weight from in place of Tickets, weight at a time.
+	custom TicketPool
+	weight int64
 }
 
+// customTicket stands for the weight held in a pool's custom TicketPool.
+var customTicket = &struct{}{}
+
 func newExecutorPool(name string) *executorPool {
 	p := &executorPool{}
 	p.Name = name
 	p.Metrics = newPoolMetrics(name)
 	p.Max = getSettings(name).MaxConcurrentRequests
+	p.custom = getSettings(name).TicketPool
+	p.weight = getSettings(name).TicketWeight
 
 	p.Tickets = make(chan *struct{}, p.Max)
 	for i := 0; i < p.Max; i++ {
 		p.Tickets <- &struct{}{}
 	}
+	p.resized = make(chan struct{})
 
 	return p
 }
 
+// tryAcquire takes a ticket without waiting, returning nil when there is none free.
+func (p *executorPool) tryAcquire() *struct{} {
+	if p.custom != nil {
+		if p.custom.TryAcquire(p.weight) {
+			return customTicket
+		}
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	select {
+	case ticket := <-p.Tickets:
+		return ticket
+	default:
+		return nil
+	}
+}
+
+// acquire takes a ticket, waiting up to wait for one to be returned, or until ctx is done.
+// It returns nil when none was free in time.
+func (p *executorPool) acquire(ctx context.Context, wait time.Duration) *struct{} {
+	if ticket := p.tryAcquire(); ticket != nil || wait <= 0 {
+		return ticket
+	}
+	if p.custom != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		defer cancel()
+		if p.custom.Acquire(waitCtx, p.weight) != nil {
+			return nil
+		}
+		return customTicket
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		p.mutex.RLock()
+		tickets, resized := p.Tickets, p.resized
+		p.mutex.RUnlock()
+
+		select {
+		case ticket := <-tickets:
+			return ticket
+		case <-resized:
+			// wait on the new tickets
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
 func (p *executorPool) Return(ticket *struct{}) {
 	if ticket == nil {
 		return
 	}
 
-	p.Metrics.Updates <- poolMetricsUpdate{
+	select {
+	case p.Metrics.Updates <- poolMetricsUpdate{
 		activeCount: p.ActiveCount(),
+	}:
+	case <-p.Metrics.done:
+	}
+
+	p.put(ticket)
+}
+
+// put returns a ticket to the pool without counting an execution.
+func (p *executorPool) put(ticket *struct{}) {
+	if p.custom != nil {
+		p.custom.Release(p.weight)
+		return
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for {
+		excess := atomic.LoadInt64(&p.excess)
+		if excess == 0 {
+			break
+		}
+		if atomic.CompareAndSwapInt64(&p.excess, excess, excess-1) {
+			// the ticket is one the pool no longer has room for
+			return
+		}
+	}
+	select {
+	case p.Tickets <- ticket:
+	default:
+	}
+}
+
+// held returns the number of tickets held by running commands. It must be called with mutex held.
+func (p *executorPool) held() int {
+	return p.Max + int(atomic.LoadInt64(&p.excess)) - len(p.Tickets)
+}
+
+// resize changes the number of tickets in the pool to max, plus any it has been boosted by. Tickets
+// held by running commands count against the new size, so that no more than max run at once once
+// they have been returned. A custom TicketPool keeps its own size.
+func (p *executorPool) resize(max int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.setSize(max + p.boosted)
+}
+
+// boost adds extra tickets to the pool on top of its configured size, or takes them away again
+// when extra is negative.
+func (p *executorPool) boost(extra int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.boosted += extra
+	p.setSize(p.Max + extra)
+}
+
+// setSize changes the number of tickets in the pool to max, as resize describes. It must be called
+// with mutex held for writing.
+func (p *executorPool) setSize(max int) {
+	if max == p.Max || p.custom != nil {
+		return
+	}
+
+	// Tickets are drained before the held ones are counted, since commands waiting in acquire may
+	// still take them; those they take are held like any other.
+	free := 0
+drain:
+	for {
+		select {
+		case <-p.Tickets:
+			free++
+		default:
+			break drain
+		}
+	}
+
+	held := p.Max + int(atomic.LoadInt64(&p.excess)) - free
+	excess := 0
+	if held > max {
+		excess = held - max
+	}
+	atomic.StoreInt64(&p.excess, int64(excess))
+	p.Tickets = make(chan *struct{}, max)
+	for i := held; i < max; i++ {
+		p.Tickets <- &struct{}{}
 	}
-	p.Tickets <- ticket
+	p.Max = max
+	close(p.resized)
+	p.resized = make(chan struct{})
 }
 
 func (p *executorPool) ActiveCount() int {
-	return p.Max - len(p.Tickets)
+	if p.custom != nil {
+		return int(p.custom.Active())
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.held()
+}
+
+// MaxActive returns the most tickets held at once within the rolling window, as of when they were
+// returned, so that peaks in concurrency show even when they are too brief for ActiveCount to catch.
+func (p *executorPool) MaxActive() int {
+	p.Metrics.Mutex.RLock()
+	defer p.Metrics.Mutex.RUnlock()
+
+	return int(p.Metrics.MaxActiveRequests.Max(clockNow()))
+}
+
+// size returns the number of tickets in the pool.
+func (p *executorPool) size() int {
+	if p.custom != nil {
+		return int(p.custom.Size())
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.Max
+}
+
+// BoostConcurrency raises the named command's MaxConcurrentRequests by extra for d, then lowers it
+// back, for traffic spikes which don't justify the extra concurrency all the time. Boosts which
+// overlap add up, and reconfiguring the command keeps those in force. Once a boost ends, executions
+// holding its tickets run to completion, but no new ones start until the command is back within its
+// MaxConcurrentRequests. Commands sharing a Group share the boost of their pool, while a command
+// with a TicketPool can't be boosted.
+func BoostConcurrency(name string, extra int, d time.Duration) {
+	circuit, _, err := GetCircuit(name)
+	if err != nil || extra <= 0 {
+		return
+	}
+
+	pool := circuit.executorPool
+	pool.boost(extra)
+	time.AfterFunc(d, func() {
+		pool.boost(-extra)
+	})
+}
+
+// canAcquire reports whether tryAcquire would take a ticket now: whether one is free or, with a
+// custom TicketPool, whether the pool has the pool's weight free.
+func (p *executorPool) canAcquire() bool {
+	if p.custom != nil {
+		return int64(p.free()) >= p.weight
+	}
+	return p.free() > 0
+}
+
+// free returns the number of tickets not held by running commands.
+func (p *executorPool) free() int {
+	if p.custom != nil {
+		return int(p.custom.Size() - p.custom.Active())
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.Tickets)
 }
@@ -10,6 +10,9 @@ type poolMetrics struct {
 	Mutex   *sync.RWMutex
 	Updates chan poolMetricsUpdate
 
+	// done is closed to stop Monitor.
+	done chan struct{}
+
 	Name              string
 	MaxActiveRequests *rolling.Number
 	Executed          *rolling.Number
@@ -23,6 +26,7 @@ func newPoolMetrics(name string) *poolMetrics {
 	m := &poolMetrics{}
 	m.Name = name
 	m.Updates = make(chan poolMetricsUpdate)
+	m.done = make(chan struct{})
 	m.Mutex = &sync.RWMutex{}
 
 	m.Reset()
@@ -41,12 +45,22 @@ func (m *poolMetrics) Reset() {
 }
 
 func (m *poolMetrics) Monitor() {
-	for u := range m.Updates {
-		m.Mutex.RLock()
+	for {
+		select {
+		case u := <-m.Updates:
+			m.Mutex.RLock()
 
-		m.Executed.Increment(1)
-		m.MaxActiveRequests.UpdateMax(float64(u.activeCount))
+			m.Executed.Increment(1)
+			m.MaxActiveRequests.UpdateMax(float64(u.activeCount))
 
-		m.Mutex.RUnlock()
+			m.Mutex.RUnlock()
+		case <-m.done:
+			return
+		}
 	}
 }
+
+// Close stops Monitor. Updates sent afterwards are dropped.
+func (m *poolMetrics) Close() {
+	close(m.done)
+}
@@ -1,6 +1,9 @@
 package hystrix
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -40,7 +43,247 @@ func TestActiveCount(t *testing.T) {
 			Convey("max active requests should be 3", func() {
 				time.Sleep(1 * time.Millisecond) // allow poolMetrics to process channel
 				So(pool.Metrics.MaxActiveRequests.Max(time.Now()), ShouldEqual, 3)
+				So(pool.MaxActive(), ShouldEqual, 3)
 			})
 		})
 	})
 }
+
+func TestGroupPool(t *testing.T) {
+	Convey("when two commands with different timeouts share a group of 2 tickets", t, func() {
+		defer Flush()
+
+		ConfigureCommand("backend", CommandConfig{MaxConcurrentRequests: 2})
+		ConfigureCommand("fast", CommandConfig{Group: "backend", Timeout: 20})
+		ConfigureCommand("slow", CommandConfig{Group: "backend", Timeout: 1000})
+
+		fast, _, _ := GetCircuit("fast")
+		slow, _, _ := GetCircuit("slow")
+		So(fast.executorPool, ShouldEqual, slow.executorPool)
+
+		release := make(chan struct{})
+		block := func() error {
+			<-release
+			return nil
+		}
+		fastErr := Go("fast", block, nil)
+		Go("slow", block, nil)
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("a third command in the group is rejected", func() {
+			err := Do("slow", func() error { return nil }, nil)
+			So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+			close(release)
+		})
+
+		Convey("the fast command's timeout frees its ticket for the group", func() {
+			So(errors.Is(<-fastErr, ErrTimeout), ShouldBeTrue)
+			So(slow.executorPool.ActiveCount(), ShouldEqual, 1)
+
+			close(release)
+			time.Sleep(10 * time.Millisecond)
+			So(slow.executorPool.ActiveCount(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestResize(t *testing.T) {
+	Convey("with a pool of 3 tickets, 2 of them held", t, func() {
+		defer Flush()
+		ConfigureCommand("resize", CommandConfig{MaxConcurrentRequests: 3})
+		defer ConfigureCommand("resize", CommandConfig{})
+		cb, _, _ := GetCircuit("resize")
+		pool := cb.executorPool
+		first := pool.tryAcquire()
+		second := pool.tryAcquire()
+
+		Convey("reconfiguring it to 5 tickets frees 3", func() {
+			ConfigureCommand("resize", CommandConfig{MaxConcurrentRequests: 5})
+			So(pool.size(), ShouldEqual, 5)
+			So(pool.free(), ShouldEqual, 3)
+			So(pool.ActiveCount(), ShouldEqual, 2)
+		})
+
+		Convey("reconfiguring it to 1 ticket frees none until both are returned", func() {
+			ConfigureCommand("resize", CommandConfig{MaxConcurrentRequests: 1})
+			So(pool.tryAcquire(), ShouldBeNil)
+
+			pool.Return(first)
+			So(pool.free(), ShouldEqual, 0)
+			pool.Return(second)
+			So(pool.free(), ShouldEqual, 1)
+		})
+
+		Convey("reconfiguring it to 1 ticket then back to 2 frees none while both are held", func() {
+			ConfigureCommand("resize", CommandConfig{MaxConcurrentRequests: 1})
+			So(pool.ActiveCount(), ShouldEqual, 2)
+			ConfigureCommand("resize", CommandConfig{MaxConcurrentRequests: 2})
+			So(pool.free(), ShouldEqual, 0)
+			So(pool.tryAcquire(), ShouldBeNil)
+
+			pool.Return(first)
+			So(pool.free(), ShouldEqual, 1)
+			So(pool.ActiveCount(), ShouldEqual, 1)
+		})
+	})
+
+	Convey("when a command is reconfigured from many goroutines at once", t, func() {
+		defer Flush()
+		defer ConfigureCommand("reconfigure", CommandConfig{})
+		cb, _, _ := GetCircuit("reconfigure")
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 50; i++ {
+			wg.Add(1)
+			go func(max int) {
+				defer wg.Done()
+				ConfigureCommand("reconfigure", CommandConfig{MaxConcurrentRequests: max})
+			}(i)
+		}
+		wg.Wait()
+
+		Convey("the pool matches the settings applied last", func() {
+			max := getSettings("reconfigure").MaxConcurrentRequests
+			So(cb.executorPool.size(), ShouldEqual, max)
+			So(cb.executorPool.free(), ShouldEqual, max)
+		})
+	})
+}
+
+func TestBoostConcurrency(t *testing.T) {
+	Convey("when a pool of 1 ticket is boosted by 2", t, func() {
+		defer Flush()
+		ConfigureCommand("boost", CommandConfig{MaxConcurrentRequests: 1})
+		defer ConfigureCommand("boost", CommandConfig{})
+		cb, _, _ := GetCircuit("boost")
+		pool := cb.executorPool
+		BoostConcurrency("boost", 2, 50*time.Millisecond)
+
+		Convey("3 tickets can be held at once", func() {
+			tickets := []*struct{}{pool.tryAcquire(), pool.tryAcquire(), pool.tryAcquire()}
+			So(tickets, ShouldNotContain, (*struct{})(nil))
+			So(pool.tryAcquire(), ShouldBeNil)
+
+			Convey("and once the boost ends, none are freed until all are returned", func() {
+				time.Sleep(100 * time.Millisecond)
+				So(pool.size(), ShouldEqual, 1)
+				So(pool.free(), ShouldEqual, 0)
+
+				for _, ticket := range tickets {
+					pool.Return(ticket)
+				}
+				So(pool.free(), ShouldEqual, 1)
+				So(pool.ActiveCount(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("reconfiguring the command keeps the boost until it ends", func() {
+			ConfigureCommand("boost", CommandConfig{MaxConcurrentRequests: 4})
+			So(pool.size(), ShouldEqual, 6)
+
+			time.Sleep(100 * time.Millisecond)
+			So(pool.size(), ShouldEqual, 4)
+			So(pool.free(), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestNoTicket(t *testing.T) {
+	Convey("when a command taking no ticket has a pool with none free", t, func() {
+		defer Flush()
+		ConfigureCommand("no_ticket", CommandConfig{MaxConcurrentRequests: 1, NoTicket: true})
+		defer ConfigureCommand("no_ticket", CommandConfig{})
+		cb, _, _ := GetCircuit("no_ticket")
+		ticket := cb.executorPool.tryAcquire()
+		defer cb.executorPool.put(ticket)
+
+		Convey("it still runs, without counting in the pool", func() {
+			var active int
+			err := DoC(context.Background(), "no_ticket", func(ctx context.Context) error {
+				active = cb.executorPool.ActiveCount()
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+			So(active, ShouldEqual, 1)
+			So(cb.executorPool.free(), ShouldEqual, 0)
+
+			time.Sleep(50 * time.Millisecond)
+			So(cb.Metrics().Successes().Sum(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("Try lets it through", func() {
+			ok, err := Try("no_ticket")
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("it is still short-circuited by an open circuit", func() {
+			cb.toggleForceOpen(true)
+			err := DoC(context.Background(), "no_ticket", func(ctx context.Context) error {
+				return nil
+			}, nil)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+		})
+	})
+}
+
+func TestWeightedTicketPool(t *testing.T) {
+	Convey("when a heavy and a light command share a weighted pool of 3", t, func() {
+		defer Flush()
+		shared := NewWeightedTicketPool(3)
+		ConfigureCommand("heavy", CommandConfig{TicketPool: shared, TicketWeight: 2})
+		defer ConfigureCommand("heavy", CommandConfig{})
+		ConfigureCommand("light", CommandConfig{TicketPool: shared})
+		defer ConfigureCommand("light", CommandConfig{})
+
+		release := make(chan struct{})
+		block := func() error {
+			<-release
+			return nil
+		}
+		Go("heavy", block, nil)
+		Go("light", block, nil)
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("the pool's weight is in use, by both commands' counts", func() {
+			So(shared.Active(), ShouldEqual, 3)
+			heavy, _, _ := GetCircuit("heavy")
+			So(heavy.executorPool.ActiveCount(), ShouldEqual, 3)
+			So(heavy.executorPool.size(), ShouldEqual, 3)
+
+			Convey("so another execution of either is rejected", func() {
+				err := Do("light", func() error { return nil }, nil)
+				So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+				close(release)
+			})
+
+			Convey("until the heavy one returns its weight", func() {
+				close(release)
+				time.Sleep(10 * time.Millisecond)
+				So(shared.Active(), ShouldEqual, 0)
+				err := Do("heavy", func() error { return nil }, nil)
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("with 1 of a weighted pool's 3 free", t, func() {
+		defer Flush()
+		shared := NewWeightedTicketPool(3)
+		ConfigureCommand("heavy", CommandConfig{TicketPool: shared, TicketWeight: 2})
+		defer ConfigureCommand("heavy", CommandConfig{})
+		ConfigureCommand("light", CommandConfig{TicketPool: shared})
+		defer ConfigureCommand("light", CommandConfig{})
+		shared.TryAcquire(2)
+		defer shared.Release(2)
+
+		Convey("Try rejects a command of weight 2, but not one of weight 1", func() {
+			ok, err := Try("heavy")
+			So(ok, ShouldBeFalse)
+			So(err, ShouldEqual, ErrMaxConcurrency)
+			ok, err = Try("light")
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package hystrix
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// recorderEventBufferSize is how many events a MetricRecorder holds while its writer catches up.
+// Each publish sends an event for every command and pool at once, so it is far larger than a
+// client's.
+const recorderEventBufferSize = 1024
+
+// NewMetricRecorder returns a MetricRecorder writing the metrics of every command and pool to w
+// once a second.
+func NewMetricRecorder(w io.Writer) *MetricRecorder {
+	return NewMetricRecorderWithInterval(w, DefaultStreamInterval)
+}
+
+// NewMetricRecorderWithInterval returns a MetricRecorder writing every d instead of once a second.
+// Intervals below MinStreamInterval are clamped.
+func NewMetricRecorderWithInterval(w io.Writer, d time.Duration) *MetricRecorder {
+	return &MetricRecorder{handler: NewStreamHandlerWithInterval(d), w: w}
+}
+
+// MetricRecorder writes the metrics a StreamHandler would publish to a writer rather than to HTTP
+// clients, as one JSON object per line like the ndjson stream, so that they can be kept in a file
+// for analysis after an incident or load test without running a dashboard.
+//
+// Each line is written by a single call to Write, so a writer which rotates files never splits one.
+// Write errors are logged and the line dropped, as are lines published while the writer is more than
+// a thousand behind.
+type MetricRecorder struct {
+	handler *StreamHandler
+	w       io.Writer
+
+	// mu guards running and written, which is closed once the writing goroutine has exited.
+	mu      sync.Mutex
+	running bool
+	written chan struct{}
+}
+
+// Start begins recording metrics. Calling it again while the recorder is running does nothing.
+func (mr *MetricRecorder) Start() {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if mr.running {
+		return
+	}
+	mr.handler.Start()
+	stream := &streamRequest{events: make(chan []byte, recorderEventBufferSize), ndjson: true}
+	mr.handler.subscribe(mr, stream)
+	mr.running = true
+	mr.written = make(chan struct{})
+	go mr.write(stream.events, mr.written)
+}
+
+// Stop stops recording metrics, returning once the lines already published have been written.
+// Calling it on a recorder which isn't running does nothing.
+func (mr *MetricRecorder) Stop() {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if !mr.running {
+		return
+	}
+	mr.running = false
+	// closes the stream, once nothing publishes to it any more
+	mr.handler.Stop()
+	<-mr.written
+}
+
+func (mr *MetricRecorder) write(events <-chan []byte, written chan<- struct{}) {
+	defer close(written)
+
+	for event := range events {
+		if _, err := mr.w.Write(event); err != nil {
+			log.Printf("hystrix-go: failed to record metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package hystrix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricRecorder(t *testing.T) {
+	Convey("with a recorder writing to a buffer", t, func() {
+		defer Flush()
+		var buf bytes.Buffer
+		recorder := NewMetricRecorderWithInterval(&buf, MinStreamInterval)
+		recorder.Start()
+		recorder.Start()
+		sleepingCommand(t, "recorded", 1*time.Millisecond)
+		time.Sleep(350 * time.Millisecond)
+		recorder.Stop()
+
+		Convey("each line is the JSON of a command's or pool's metrics", func() {
+			types := make(map[string]int)
+			scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+			for scanner.Scan() {
+				var metric struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				}
+				So(json.Unmarshal(scanner.Bytes(), &metric), ShouldBeNil)
+				So(metric.Name, ShouldEqual, "recorded")
+				types[metric.Type]++
+			}
+			So(types["HystrixCommand"], ShouldBeGreaterThanOrEqualTo, 2)
+			So(types["HystrixThreadPool"], ShouldEqual, types["HystrixCommand"])
+		})
+
+		Convey("nothing more is written once it has stopped", func() {
+			written := buf.Len()
+			recorder.Stop()
+			time.Sleep(250 * time.Millisecond)
+			So(buf.Len(), ShouldEqual, written)
+
+			Convey("until it is started again", func() {
+				recorder.Start()
+				time.Sleep(250 * time.Millisecond)
+				recorder.Stop()
+				So(buf.Len(), ShouldBeGreaterThan, written)
+			})
+		})
+	})
+}
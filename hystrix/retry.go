@@ -0,0 +1,98 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// RetryPolicy says how GoCRetry retries a failing command.
+type RetryPolicy struct {
+	// MaxAttempts is the most times run is executed, including the first. Values below 1 mean 1.
+	MaxAttempts int
+	// Backoff is how long to wait before the second attempt.
+	Backoff time.Duration
+	// Multiplier, when greater than 1, multiplies the wait before each further attempt.
+	Multiplier float64
+	// MaxBackoff, when greater than zero, caps the wait between attempts.
+	MaxBackoff time.Duration
+}
+
+// backoff returns how long to wait before the given attempt, counting the first as 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.Backoff)
+	if p.Multiplier > 1 {
+		wait *= math.Pow(p.Multiplier, float64(attempt-2))
+	}
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(wait)
+}
+
+// GoCRetry runs your function like GoC, executing it again after a failure or timeout until it
+// succeeds or policy's MaxAttempts are used up. Each attempt is a command execution of its own,
+// taking a ticket and recording metrics. Rejections and cancellations aren't retried, and neither
+// are short-circuits: once a failure has opened the circuit, retrying stops straight away rather
+// than waiting out the backoff.
+//
+// The fallback runs once, with the last attempt's error, when no attempt succeeded and the
+// attempts weren't canceled, nor short-circuited by a command which skips its fallback while its
+// circuit is open. Like GoCDedup, the returned channel always receives exactly one value: nil on
+// success, or the error on failure.
+func GoCRetry(ctx context.Context, name string, run runFuncC, fallback fallbackFuncC, policy RetryPolicy) chan error {
+	name = normalizeCommandName(name)
+	errChan := make(chan error, 1)
+
+	go func() {
+		err := retry(ctx, name, run, policy)
+		if err == nil || fallback == nil || errors.Is(err, context.Canceled) ||
+			(err == ErrCircuitOpen && getSettings(name).SkipFallbackOnOpen) {
+			errChan <- err
+			return
+		}
+
+		errChan <- detachedFallback(ctx, name, fallback, err)
+	}()
+
+	return errChan
+}
+
+// retry executes run until it succeeds, fails in a way which isn't worth retrying, or has been
+// attempted as often as policy allows, returning the last error.
+func retry(ctx context.Context, name string, run runFuncC, policy RetryPolicy) error {
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		err := doC(ctx, name, run, nil, execOptions{detached: true})
+		if ce, ok := err.(CommandError); ok {
+			// hand callers and their fallbacks the same errors GoC would
+			err = ce.RunErr
+		}
+		if err == ErrCircuitOpen && lastErr != nil {
+			// an earlier attempt's failure opened the circuit, and is the more useful error
+			return lastErr
+		}
+		lastErr = err
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+		if cb, _, cbErr := GetCircuit(name); cbErr == nil && cb.IsOpen() {
+			return err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt + 1))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// retryable reports whether a command which failed with err is worth executing again: a failure
+// of run, or a timeout, rather than a rejection, short-circuit or cancellation.
+func retryable(err error) bool {
+	return err == ErrTimeout || newCommandError(err).Type == "run"
+}
@@ -0,0 +1,129 @@
+package hystrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGoCRetry(t *testing.T) {
+	Convey("with a retry policy of 3 attempts", t, func() {
+		defer Flush()
+
+		policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+		var runs int32
+		failFirst := func(n int32) runFuncC {
+			return func(ctx context.Context) error {
+				if atomic.AddInt32(&runs, 1) <= n {
+					return fmt.Errorf("attempt failed")
+				}
+				return nil
+			}
+		}
+		var fallbackErr error
+		fallback := func(ctx context.Context, err error) error {
+			fallbackErr = err
+			return nil
+		}
+
+		Convey("a command which fails twice then succeeds isn't fallen back", func() {
+			So(<-GoCRetry(context.Background(), "retry", failFirst(2), fallback, policy), ShouldBeNil)
+			So(atomic.LoadInt32(&runs), ShouldEqual, 3)
+			So(fallbackErr, ShouldBeNil)
+
+			Convey("and each attempt is recorded", func() {
+				time.Sleep(50 * time.Millisecond)
+				cb, _, _ := GetCircuit("retry")
+				So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 2)
+				So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("a command which always fails falls back once, with the last error", func() {
+			So(<-GoCRetry(context.Background(), "retry", failFirst(10), fallback, policy), ShouldBeNil)
+			So(atomic.LoadInt32(&runs), ShouldEqual, 3)
+			So(fallbackErr.Error(), ShouldEqual, "attempt failed")
+		})
+
+		Convey("an open circuit fails fast without running", func() {
+			cb, _, _ := GetCircuit("retry")
+			cb.setOpen()
+
+			So(<-GoCRetry(context.Background(), "retry", failFirst(0), nil, policy), ShouldEqual, ErrCircuitOpen)
+			So(atomic.LoadInt32(&runs), ShouldEqual, 0)
+		})
+
+		Convey("an open circuit of a command which skips its fallback doesn't fall back", func() {
+			ConfigureCommand("retry", CommandConfig{SkipFallbackOnOpen: true})
+			defer ConfigureCommand("retry", CommandConfig{})
+			cb, _, _ := GetCircuit("retry")
+			cb.setOpen()
+
+			So(<-GoCRetry(context.Background(), "retry", failFirst(0), fallback, policy), ShouldEqual, ErrCircuitOpen)
+			So(fallbackErr, ShouldBeNil)
+		})
+
+		Convey("retrying stops once a failure opens the circuit", func() {
+			ConfigureCommand("retry", CommandConfig{ConsecutiveFailureThreshold: 1})
+			defer ConfigureCommand("retry", CommandConfig{})
+
+			err := <-GoCRetry(context.Background(), "retry", failFirst(10), nil, policy)
+			So(err.Error(), ShouldEqual, "attempt failed")
+			So(atomic.LoadInt32(&runs), ShouldEqual, 1)
+		})
+
+		Convey("a command which requires a fallback still runs its attempts", func() {
+			ConfigureCommand("retry", CommandConfig{RequireFallback: true})
+			defer ConfigureCommand("retry", CommandConfig{})
+
+			So(<-GoCRetry(context.Background(), "retry", failFirst(1), fallback, policy), ShouldBeNil)
+			So(atomic.LoadInt32(&runs), ShouldEqual, 2)
+			So(fallbackErr, ShouldBeNil)
+		})
+
+		Convey("canceled attempts aren't fallen back", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := <-GoCRetry(ctx, "retry", func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}, fallback, policy)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+			So(fallbackErr, ShouldBeNil)
+		})
+	})
+
+	Convey("with an alias of a command which recovers panics", t, func() {
+		defer Flush()
+		AliasCommand("retry_alias", "retry_panics")
+		defer AliasCommand("retry_alias", "retry_alias")
+		ConfigureCommand("retry_panics", CommandConfig{RecoverPanics: true})
+		defer ConfigureCommand("retry_panics", CommandConfig{})
+
+		Convey("a fallback which panics fails as the command's would", func() {
+			err := <-GoCRetry(context.Background(), "retry_alias", func(ctx context.Context) error {
+				return fmt.Errorf("failed")
+			}, func(ctx context.Context, err error) error {
+				panic("fallback boom")
+			}, RetryPolicy{MaxAttempts: 1})
+			So(errors.Is(err.(CommandError).FallbackErr, ErrPanic), ShouldBeTrue)
+
+			settingsMutex.RLock()
+			_, stray := circuitSettings["retry_alias"]
+			settingsMutex.RUnlock()
+			So(stray, ShouldBeFalse)
+		})
+	})
+
+	Convey("a backoff with a multiplier grows up to its cap", t, func() {
+		policy := RetryPolicy{Backoff: 100 * time.Millisecond, Multiplier: 2, MaxBackoff: 300 * time.Millisecond}
+		So(policy.backoff(2), ShouldEqual, 100*time.Millisecond)
+		So(policy.backoff(3), ShouldEqual, 200*time.Millisecond)
+		So(policy.backoff(4), ShouldEqual, 300*time.Millisecond)
+	})
+}
@@ -0,0 +1,39 @@
+package rolling
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time used to place values in buckets and to age buckets out.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type clockHolder struct {
+	Clock
+}
+
+var clock atomic.Value
+
+func init() {
+	clock.Store(clockHolder{realClock{}})
+}
+
+// SetClock replaces the clock read by every Number and Timing. It exists so that tests can
+// move time forward without sleeping; a nil Clock restores the real time.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clock.Store(clockHolder{c})
+}
+
+// Now returns the current time according to the clock set with SetClock.
+func Now() time.Time {
+	return clock.Load().(clockHolder).Now()
+}
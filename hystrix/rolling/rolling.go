@@ -1,6 +1,7 @@
 package rolling
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,6 +17,13 @@ type numberBucket struct {
 	Value float64
 }
 
+// Bucket is the value of one of a Number's one second buckets.
+type Bucket struct {
+	// Time is the start of the bucket's second.
+	Time  time.Time
+	Value float64
+}
+
 // NewNumber initializes a RollingNumber struct.
 func NewNumber() *Number {
 	r := &Number{
@@ -26,11 +34,13 @@ func NewNumber() *Number {
 }
 
 func (r *Number) getCurrentBucket() *numberBucket {
-	now := time.Now().Unix()
+	now := Now().Unix()
 	var bucket *numberBucket
 	var ok bool
 
 	if bucket, ok = r.Buckets[now]; !ok {
+		// buckets only age out once a second, so only look for them when one begins
+		r.removeOldBuckets()
 		bucket = &numberBucket{}
 		r.Buckets[now] = bucket
 	}
@@ -39,7 +49,7 @@ func (r *Number) getCurrentBucket() *numberBucket {
 }
 
 func (r *Number) removeOldBuckets() {
-	now := time.Now().Unix() - 10
+	now := Now().Unix() - 10
 
 	for timestamp := range r.Buckets {
 		// TODO: configurable rolling window
@@ -60,7 +70,6 @@ func (r *Number) Increment(i float64) {
 
 	b := r.getCurrentBucket()
 	b.Value += i
-	r.removeOldBuckets()
 }
 
 // UpdateMax updates the maximum value in the current bucket.
@@ -72,7 +81,6 @@ func (r *Number) UpdateMax(n float64) {
 	if n > b.Value {
 		b.Value = n
 	}
-	r.removeOldBuckets()
 }
 
 // Sum sums the values over the buckets in the last 10 seconds.
@@ -111,6 +119,24 @@ func (r *Number) Max(now time.Time) float64 {
 	return max
 }
 
+// WindowBuckets returns the buckets summed by Sum, oldest first, for seeing how the values in
+// the last 10 seconds were spread over them. Seconds without a bucket are left out.
+func (r *Number) WindowBuckets(now time.Time) []Bucket {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	buckets := make([]Bucket, 0, len(r.Buckets))
+	for timestamp, bucket := range r.Buckets {
+		if timestamp >= now.Unix()-10 {
+			buckets = append(buckets, Bucket{Time: time.Unix(timestamp, 0), Value: bucket.Value})
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Time.Before(buckets[j].Time)
+	})
+	return buckets
+}
+
 func (r *Number) Avg(now time.Time) float64 {
 	return r.Sum(now) / 10
 }
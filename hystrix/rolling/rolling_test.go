@@ -7,31 +7,93 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// fakeClock only moves when advanced, so that tests need not sleep through bucket boundaries.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func useFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Unix(1000000, 0)}
+	SetClock(c)
+	return c
+}
+
 func TestMax(t *testing.T) {
 
 	Convey("when adding values to a rolling number", t, func() {
+		clock := useFakeClock()
+		defer SetClock(nil)
+
 		n := NewNumber()
 		for _, x := range []float64{10, 11, 9} {
 			n.UpdateMax(x)
-			time.Sleep(1 * time.Second)
+			clock.now = clock.now.Add(1 * time.Second)
 		}
 
 		Convey("it should know the maximum", func() {
-			So(n.Max(time.Now()), ShouldEqual, 11)
+			So(n.Max(Now()), ShouldEqual, 11)
 		})
 	})
 }
 
 func TestAvg(t *testing.T) {
 	Convey("when adding values to a rolling number", t, func() {
+		clock := useFakeClock()
+		defer SetClock(nil)
+
 		n := NewNumber()
 		for _, x := range []float64{0.5, 1.5, 2.5, 3.5, 4.5} {
 			n.Increment(x)
-			time.Sleep(1 * time.Second)
+			clock.now = clock.now.Add(1 * time.Second)
 		}
 
 		Convey("it should calculate the average over the number of configured buckets", func() {
-			So(n.Avg(time.Now()), ShouldEqual, 1.25)
+			So(n.Avg(Now()), ShouldEqual, 1.25)
+		})
+	})
+}
+
+func TestWindowBuckets(t *testing.T) {
+	Convey("when values were added over 12 seconds", t, func() {
+		clock := useFakeClock()
+		defer SetClock(nil)
+		start := clock.now
+
+		n := NewNumber()
+		for i := 1; i <= 12; i++ {
+			n.Increment(float64(i))
+			clock.now = clock.now.Add(1 * time.Second)
+		}
+		clock.now = clock.now.Add(-1 * time.Second)
+
+		Convey("the buckets in the window are returned oldest first", func() {
+			buckets := n.WindowBuckets(Now())
+			So(len(buckets), ShouldEqual, 10)
+			So(buckets[0], ShouldResemble, Bucket{Time: start.Add(2 * time.Second), Value: 3})
+			So(buckets[9], ShouldResemble, Bucket{Time: start.Add(11 * time.Second), Value: 12})
+		})
+	})
+}
+
+func TestRollover(t *testing.T) {
+	Convey("when values were added more than 10 seconds ago", t, func() {
+		clock := useFakeClock()
+		defer SetClock(nil)
+
+		n := NewNumber()
+		n.Increment(5)
+		clock.now = clock.now.Add(11 * time.Second)
+
+		Convey("they no longer count", func() {
+			So(n.Sum(Now()), ShouldEqual, 0)
+		})
+
+		Convey("and their bucket is removed once a new one begins", func() {
+			n.Increment(1)
+			So(len(n.Buckets), ShouldEqual, 1)
+			So(n.Sum(Now()), ShouldEqual, 1)
 		})
 	})
 }
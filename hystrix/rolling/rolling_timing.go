@@ -45,13 +45,13 @@ func (r *Timing) SortedDurations() []time.Duration {
 	cachedDurations := r.CachedSortedDurations
 	r.Mutex.RUnlock()
 
-	if t+time.Duration(1*time.Second).Nanoseconds() > time.Now().UnixNano() {
+	if t+time.Duration(1*time.Second).Nanoseconds() > Now().UnixNano() {
 		// don't recalculate if current cache is still fresh
 		return cachedDurations
 	}
 
 	var durations byDuration
-	now := time.Now()
+	now := Now()
 
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
@@ -68,14 +68,14 @@ func (r *Timing) SortedDurations() []time.Duration {
 	sort.Sort(durations)
 
 	r.CachedSortedDurations = durations
-	r.LastCachedTime = time.Now().UnixNano()
+	r.LastCachedTime = Now().UnixNano()
 
 	return r.CachedSortedDurations
 }
 
 func (r *Timing) getCurrentBucket() *timingBucket {
 	r.Mutex.RLock()
-	now := time.Now()
+	now := Now()
 	bucket, exists := r.Buckets[now.Unix()]
 	r.Mutex.RUnlock()
 
@@ -83,15 +83,20 @@ func (r *Timing) getCurrentBucket() *timingBucket {
 		r.Mutex.Lock()
 		defer r.Mutex.Unlock()
 
-		r.Buckets[now.Unix()] = &timingBucket{}
-		bucket = r.Buckets[now.Unix()]
+		// another goroutine may have begun the bucket since we checked
+		if bucket, exists = r.Buckets[now.Unix()]; !exists {
+			// buckets only age out once a second, so only look for them when one begins
+			r.removeOldBuckets()
+			bucket = &timingBucket{}
+			r.Buckets[now.Unix()] = bucket
+		}
 	}
 
 	return bucket
 }
 
 func (r *Timing) removeOldBuckets() {
-	now := time.Now()
+	now := Now()
 
 	for timestamp := range r.Buckets {
 		// TODO: configurable rolling window
@@ -109,7 +114,6 @@ func (r *Timing) Add(duration time.Duration) {
 	defer r.Mutex.Unlock()
 
 	b.Durations = append(b.Durations, duration)
-	r.removeOldBuckets()
 }
 
 // Percentile computes the percentile given with a linear interpolation.
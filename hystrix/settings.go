@@ -1,8 +1,12 @@
 package hystrix
 
 import (
+	"math"
+	"reflect"
 	"sync"
 	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
 )
 
 var (
@@ -14,8 +18,12 @@ var (
 	DefaultVolumeThreshold = 20
 	// DefaultSleepWindow is how long, in milliseconds, to wait after a circuit opens before testing for recovery
 	DefaultSleepWindow = 5000
+	// DefaultSleepWindowGrowth is how much the sleep window grows with each failed test, up to a MaxSleepWindow
+	DefaultSleepWindowGrowth = 2
 	// DefaultErrorPercentThreshold causes circuits to open once the rolling measure of errors exceeds this percent of requests
 	DefaultErrorPercentThreshold = 50
+	// DefaultLatencyPercentile is the percentile of run durations held to a command's LatencyThreshold unless configured otherwise
+	DefaultLatencyPercentile = 99.0
 	// DefaultLogger is the default logger that will be used in the Hystrix package. By default prints nothing.
 	DefaultLogger = NoopLogger{}
 )
@@ -27,6 +35,74 @@ type Settings struct {
 	RequestVolumeThreshold uint64
 	SleepWindow            time.Duration
 	ErrorPercentThreshold  int
+	// ConsecutiveFailureThreshold opens the circuit after this many failures in a row, regardless of volume. Zero disables it.
+	ConsecutiveFailureThreshold int
+	// MaxRequestsPerSecond caps how often the command may start. Zero means unlimited.
+	MaxRequestsPerSecond float64
+	// RequireFallback rejects executions which do not provide a fallback.
+	RequireFallback bool
+	// SleepWindowJitter varies SleepWindow by up to this fraction either way, rolled each time the circuit opens.
+	SleepWindowJitter float64
+	// CancelOnOpen cancels the context of in-flight executions when the circuit opens.
+	CancelOnOpen bool
+	// MetricsResetInterval is how often the circuit's rolling metrics are discarded. Zero disables it.
+	MetricsResetInterval time.Duration
+	// ErrorWeight weighs each error towards the error percentage. Nil weighs every error as 1.
+	ErrorWeight func(error) float64 `json:"-"`
+	// Group names the concurrency pool shared with other commands. Empty gives the command a pool of its own.
+	Group string
+	// WarmupDuration is how long after its creation the circuit can't be tripped.
+	WarmupDuration time.Duration
+	// MinRequestRate is the minimum requests per second over the rolling window before the circuit can trip. Zero disables it.
+	MinRequestRate float64
+	// RollingStat makes the statistics the circuit's metrics are kept in. Nil uses rolling.Number.
+	RollingStat func() metricCollector.RollingStat `json:"-"`
+	// MaxConcurrentFallbacks caps how many of the command's fallbacks may run at once. Zero means unlimited.
+	MaxConcurrentFallbacks int
+	// RecoverPanics turns panics in run and fallback functions into a PanicError.
+	RecoverPanics bool
+	// TimeoutsCountAsErrors counts timeouts towards the error percentage.
+	TimeoutsCountAsErrors bool
+	// DecisionCacheTTL is how long AllowRequest reuses its judgement of the circuit's health. Zero disables it.
+	DecisionCacheTTL time.Duration
+	// LatencyThreshold opens the circuit when the run duration at LatencyPercentile exceeds it. Zero disables it.
+	LatencyThreshold  time.Duration
+	LatencyPercentile float64
+	// MaxQueueWait is how long an execution waits for a free ticket before it is rejected. Zero rejects it at once.
+	MaxQueueWait time.Duration
+	// RunInline runs synchronous executions on the caller's goroutine, without enforcing Timeout.
+	RunInline bool
+	// RequiredSuccessesToClose is how many probes in a row must succeed before the circuit closes. It is at least 1.
+	RequiredSuccessesToClose int
+	// SkipFallbackOnOpen fails short-circuited executions with ErrCircuitOpen without running the fallback.
+	SkipFallbackOnOpen bool
+	// DisableMetrics keeps only the request and error counts the circuit needs, rather than full metrics.
+	DisableMetrics bool
+	// MaxSleepWindow caps the SleepWindow grown by SleepWindowGrowth after failed tests. It is at least SleepWindow.
+	MaxSleepWindow    time.Duration
+	SleepWindowGrowth float64
+	// TotalTimeout bounds the run function and the fallback together. Zero leaves them unbounded but for Timeout.
+	TotalTimeout time.Duration
+	// SyncMetrics records each execution's metrics on the caller's goroutine, in the order they are reported.
+	SyncMetrics bool
+	// TicketPool, if set, is what executions take TicketWeight from in place of MaxConcurrentRequests tickets.
+	TicketPool   TicketPool `json:"-"`
+	TicketWeight int64
+	// NoTicket runs executions without taking a ticket from the executor pool.
+	NoTicket bool
+}
+
+// metricsWindow is the span of the rolling metrics the circuit's health is judged over.
+const metricsWindow = 10 * time.Second
+
+// VolumeThreshold is the number of requests within the rolling window needed before the circuit
+// can trip: the higher of RequestVolumeThreshold and MinRequestRate over the window.
+func (s *Settings) VolumeThreshold() uint64 {
+	volume := s.RequestVolumeThreshold
+	if byRate := uint64(math.Ceil(s.MinRequestRate * metricsWindow.Seconds())); byRate > volume {
+		volume = byRate
+	}
+	return volume
 }
 
 // CommandConfig is used to tune circuit settings at runtime
@@ -36,11 +112,154 @@ type CommandConfig struct {
 	RequestVolumeThreshold int `json:"request_volume_threshold"`
 	SleepWindow            int `json:"sleep_window"`
 	ErrorPercentThreshold  int `json:"error_percent_threshold"`
+	// ConsecutiveFailureThreshold, when greater than zero, opens the circuit after this many
+	// executions in a row which count as errors towards ErrorPercentThreshold, so timeouts only
+	// count while TimeoutsCountAsErrors. It applies alongside ErrorPercentThreshold; whichever
+	// trips first wins.
+	ConsecutiveFailureThreshold int `json:"consecutive_failure_threshold"`
+	// MaxRequestsPerSecond, when greater than zero, rejects executions beyond this rate
+	// before they take a concurrency ticket.
+	MaxRequestsPerSecond float64 `json:"max_requests_per_second"`
+	// RequireFallback, when true, makes executions of the command without a fallback fail
+	// immediately with ErrFallbackRequired instead of running.
+	RequireFallback bool `json:"require_fallback"`
+	// SleepWindowJitter, between 0 and 1, randomly lengthens or shortens the sleep window by up
+	// to this fraction each time the circuit opens, so that many instances which opened together
+	// do not all test for recovery at the same moment.
+	SleepWindowJitter float64 `json:"sleep_window_jitter"`
+	// CancelOnOpen, when true, cancels the context given to run for executions still in flight
+	// when the circuit opens. They are reported as short-circuits and their fallbacks receive ErrCircuitOpen.
+	CancelOnOpen bool `json:"cancel_on_open"`
+	// MetricsResetInterval, in milliseconds, when greater than zero discards the circuit's rolling
+	// metrics this often, whatever the rolling window. Resetting never opens or closes the circuit.
+	// It applies to circuits created after the command is configured.
+	MetricsResetInterval int `json:"metrics_reset_interval"`
+	// ErrorWeight, when set, decides how much each error counts towards ErrorPercentThreshold,
+	// so that a 500 from the backend can count for more than a client-side timeout. It is given
+	// the error passed to the fallback. Weights of zero or less count as 1.
+	ErrorWeight func(error) float64 `json:"-"`
+	// Group, when set, makes the command take tickets from a concurrency pool shared by all commands
+	// of the same group, so that together they can't overwhelm the backend they share. The pool holds
+	// the MaxConcurrentRequests configured for a command named after the group. Metrics and other
+	// settings, including timeouts, stay per command. It applies to circuits created after the command is configured.
+	Group string `json:"group"`
+	// WarmupDuration, in milliseconds, keeps the circuit from tripping for this long after it is
+	// created, however many errors occur, so that failures while connections warm up don't open it.
+	// Metrics are still recorded, and count once the warmup is over.
+	WarmupDuration int `json:"warmup_duration"`
+	// MinRequestRate, when greater than zero, is the minimum number of requests per second, averaged
+	// over the rolling window, needed before the circuit can trip, so the threshold follows traffic
+	// rather than needing retuning as it changes. When RequestVolumeThreshold is also set, the higher
+	// of the two thresholds applies; when it isn't, the default volume threshold is not applied.
+	MinRequestRate float64 `json:"min_request_rate"`
+	// RollingStat, when set, makes the statistics which the circuit's request, error and other counts
+	// are kept in, replacing the fixed one second buckets of rolling.Number with another way of
+	// aggregating them, such as an exponentially weighted moving average. It applies to circuits
+	// created after the command is configured. The counts are then read through the collector's
+	// Stat accessors, such as NumRequestsStat, as those returning *rolling.Number return nil.
+	RollingStat func() metricCollector.RollingStat `json:"-"`
+	// MaxConcurrentFallbacks, when greater than zero, is how many of the command's fallbacks may run
+	// at once, so that a slow fallback can't pile up goroutines while the circuit is open. Fallbacks
+	// over the limit aren't run, and fail with ErrMaxFallbackConcurrency.
+	MaxConcurrentFallbacks int `json:"max_concurrent_fallbacks"`
+	// RecoverPanics, when true, recovers panics in the command's run and fallback functions, which
+	// would otherwise crash the process. A run which panics fails with a PanicError, which is given
+	// to the fallback, and a fallback which panics fails with one. It is off by default, so that
+	// panics aren't masked without the command opting in.
+	RecoverPanics bool `json:"recover_panics"`
+	// TimeoutsCountAsErrors, when set to false, leaves timeouts out of the errors which the error
+	// percentage is judged on, for commands whose timeouts are more often down to a tight Timeout
+	// than to a failing backend. Timeouts are still counted as timeouts. Nil counts them as errors.
+	TimeoutsCountAsErrors *bool `json:"timeouts_count_as_errors"`
+	// DecisionCacheTTL, in milliseconds, lets AllowRequest reuse its judgement of whether the
+	// circuit's metrics are healthy for this long, rather than summing them on every request, for
+	// commands executed so often that the sums show up in profiles. The circuit then trips up to
+	// this much later. Recovery tests of an open circuit are still let through on time.
+	DecisionCacheTTL int `json:"decision_cache_ttl"`
+	// LatencyThreshold, in milliseconds, opens the circuit when the LatencyPercentile of the
+	// command's run durations exceeds it, even without errors, so that a slow backend can't tie
+	// up the command's concurrency. Run durations are kept for the last 60 seconds, and need the
+	// volume of requests which the error percentage needs. It is judged independently of the
+	// error percentage; either opens the circuit.
+	LatencyThreshold int `json:"latency_threshold"`
+	// LatencyPercentile is the percentile of run durations held to LatencyThreshold, between 0
+	// and 100. It defaults to DefaultLatencyPercentile.
+	LatencyPercentile float64 `json:"latency_percentile"`
+	// MaxQueueWait, in milliseconds, lets an execution which finds all MaxConcurrentRequests in use
+	// wait this long for one to finish, rather than being rejected at once, for commands which
+	// would rather be a little late than fail. It is only rejected once the wait is over, and stops
+	// waiting if its context is done. Waiting counts towards the command's Timeout, so keep it shorter.
+	MaxQueueWait int `json:"max_queue_wait"`
+	// RunInline, when true, runs Do, DoC and DoCContextTimeout executions on the caller's goroutine
+	// rather than on goroutines of their own, which spares their cost for cheap run functions.
+	// There is then nothing to give up on run while it runs: Timeout isn't enforced, and the
+	// command only stops early if run honors its context. It is ignored when CancelOnOpen is set.
+	RunInline bool `json:"run_inline"`
+	// RequiredSuccessesToClose keeps a recovering circuit half-open until this many probes in a
+	// row have succeeded, so that a single lucky probe doesn't let a burst of traffic back onto a
+	// backend which is still struggling. After each successful probe the next is let through at
+	// once, while a failed one leaves the circuit open for another SleepWindow and starts the count
+	// again. Only probes count towards it. It defaults to 1, which closes the circuit on the first
+	// success.
+	RequiredSuccessesToClose int `json:"required_successes_to_close"`
+	// SkipFallbackOnOpen, when true, fails executions short-circuited by an open circuit with
+	// ErrCircuitOpen at once, without running the fallback, for commands whose callers would
+	// rather handle the error than wait for a fallback. They are recorded as short-circuits with
+	// the fallback skipped. Fallbacks still run for other errors.
+	SkipFallbackOnOpen bool `json:"skip_fallback_on_open"`
+	// DisableMetrics, when true, skips the command's rolling metrics and metric collectors, for
+	// commands run so often that their metrics aren't worth the overhead. The circuit still opens
+	// and closes, judged by a cheap count of recent requests and errors, but LatencyThreshold
+	// can't be applied, and the dashboard, metric collectors such as Prometheus and the rolling
+	// metrics see nothing of the command's executions.
+	DisableMetrics bool `json:"disable_metrics"`
+	// MaxSleepWindow, in milliseconds, when greater than SleepWindow lets the sleep window grow
+	// while the backend stays down, so that a circuit which keeps failing its tests is tested less
+	// and less often. Each failed test in a row multiplies the sleep window by SleepWindowGrowth,
+	// which defaults to 2, up to MaxSleepWindow; the first successful test brings it back to
+	// SleepWindow. SleepWindowJitter applies to the grown window too. By default MaxSleepWindow is
+	// SleepWindow, which keeps the sleep window constant.
+	MaxSleepWindow    int     `json:"max_sleep_window"`
+	SleepWindowGrowth float64 `json:"sleep_window_growth"`
+	// TotalTimeout, in milliseconds, when greater than zero bounds the whole command, its run
+	// function and any fallback together, for callers with a latency budget which a slow fallback
+	// mustn't blow. Run times out after Timeout or TotalTimeout, whichever is shorter, and the
+	// fallback is given what is left of TotalTimeout: its context is canceled when that runs out,
+	// and the command fails with ErrTimeout as its fallback error without waiting for it to return.
+	// The total is measured from the command's start, like its total duration.
+	TotalTimeout int `json:"total_timeout"`
+	// SyncMetrics, when true, records the metrics of each execution before the command finishes,
+	// on the goroutine which reports them, rather than handing them to the goroutine which gathers
+	// the command's metrics in the background, so that executions are recorded in the order they
+	// finish, as tests reconciling the metrics need. Together with RunInline, Do and DoC have
+	// recorded the execution by the time they return. Recording takes a lock shared by all of the
+	// command's executions, and metric collectors such as StatsD are called on the execution's
+	// goroutine, so it costs busy commands some of their throughput.
+	SyncMetrics bool `json:"sync_metrics"`
+	// TicketPool, when set, limits the command's concurrency in place of MaxConcurrentRequests:
+	// each execution takes TicketWeight, which defaults to 1, from the pool while it runs, and is
+	// rejected with ErrMaxConcurrency when there isn't enough free, or waits for it up to
+	// MaxQueueWait. Giving one pool, such as a NewWeightedTicketPool, to several commands makes
+	// them share its capacity, each according to its weight. Resizing doesn't apply to the pool,
+	// and the concurrency reported for the command is the pool's weight in use. Like Group, it
+	// applies to circuits created after the command is configured.
+	TicketPool   TicketPool `json:"-"`
+	TicketWeight int64      `json:"ticket_weight"`
+	// NoTicket, when true, runs the command's executions without taking a ticket from its executor
+	// pool, for commands such as local computations which are run as commands for their metrics and
+	// circuit, and mustn't use up the concurrency meant for network calls. They still time out, are
+	// recorded in the metrics and are short-circuited by an open circuit, but are never rejected
+	// for want of a ticket, and don't count towards the pool's ActiveCount or the concurrency
+	// reported for the command. MaxConcurrentRequests and MaxQueueWait don't apply to them.
+	NoTicket bool `json:"no_ticket"`
 }
 
 var circuitSettings map[string]*Settings
 var settingsMutex *sync.RWMutex
-var log logger
+
+// configureMutexes holds a *sync.Mutex for each command, serializing its reconfiguration.
+var configureMutexes sync.Map
+var log Logger
 
 func init() {
 	circuitSettings = make(map[string]*Settings)
@@ -55,11 +274,46 @@ func Configure(cmds map[string]CommandConfig) {
 	}
 }
 
-// ConfigureCommand applies settings for a circuit
+// ConfigureCommand applies settings for a circuit. When the command's executor pool has already
+// been created, it is resized to the new MaxConcurrentRequests. Concurrent calls for the same
+// command are applied one at a time, so the last to be applied wins, settings and pool alike.
 func ConfigureCommand(name string, config CommandConfig) {
+	configureCommand(name, config, false)
+}
+
+// ConfigureCommandIfChanged applies settings for a circuit like ConfigureCommand, unless they are
+// the same as the command's current settings, in which case it leaves the command alone. It
+// reports whether the settings changed, so that a loop reloading configuration can call it for
+// every command on every reload without disturbing them. Settings given as functions, such as
+// ErrorWeight, can't be compared, so a config with any of them always counts as a change.
+func ConfigureCommandIfChanged(name string, config CommandConfig) bool {
+	return configureCommand(name, config, true)
+}
+
+// configureCommand applies config to the named command, unless onlyIfChanged is set and the
+// command's settings would stay the same. It reports whether config was applied.
+func configureCommand(name string, config CommandConfig, onlyIfChanged bool) bool {
+	name = normalizeCommandName(name)
+	mutex, _ := configureMutexes.LoadOrStore(name, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	settings := newSettings(config)
+	if onlyIfChanged && reflect.DeepEqual(settings, getSettings(name)) {
+		return false
+	}
+
 	settingsMutex.Lock()
-	defer settingsMutex.Unlock()
+	circuitSettings[name] = settings
+	settingsMutex.Unlock()
 
+	resizeExecutorPool(name, settings.MaxConcurrentRequests)
+	forgetHealth(name)
+	return true
+}
+
+// newSettings applies the defaults to config.
+func newSettings(config CommandConfig) *Settings {
 	timeout := DefaultTimeout
 	if config.Timeout != 0 {
 		timeout = config.Timeout
@@ -73,6 +327,8 @@ func ConfigureCommand(name string, config CommandConfig) {
 	volume := DefaultVolumeThreshold
 	if config.RequestVolumeThreshold != 0 {
 		volume = config.RequestVolumeThreshold
+	} else if config.MinRequestRate > 0 {
+		volume = 0
 	}
 
 	sleep := DefaultSleepWindow
@@ -80,17 +336,72 @@ func ConfigureCommand(name string, config CommandConfig) {
 		sleep = config.SleepWindow
 	}
 
+	maxSleep := sleep
+	if config.MaxSleepWindow > sleep {
+		maxSleep = config.MaxSleepWindow
+	}
+
+	growth := float64(DefaultSleepWindowGrowth)
+	if config.SleepWindowGrowth != 0 {
+		growth = math.Max(1, config.SleepWindowGrowth)
+	}
+
 	errorPercent := DefaultErrorPercentThreshold
 	if config.ErrorPercentThreshold != 0 {
 		errorPercent = config.ErrorPercentThreshold
 	}
 
-	circuitSettings[name] = &Settings{
+	latencyPercentile := DefaultLatencyPercentile
+	if config.LatencyPercentile != 0 {
+		latencyPercentile = math.Max(0, math.Min(100, config.LatencyPercentile))
+	}
+
+	requiredSuccesses := 1
+	if config.RequiredSuccessesToClose > 1 {
+		requiredSuccesses = config.RequiredSuccessesToClose
+	}
+
+	ticketWeight := int64(1)
+	if config.TicketWeight > 1 {
+		ticketWeight = config.TicketWeight
+	}
+
+	return &Settings{
 		Timeout:                time.Duration(timeout) * time.Millisecond,
 		MaxConcurrentRequests:  max,
 		RequestVolumeThreshold: uint64(volume),
 		SleepWindow:            time.Duration(sleep) * time.Millisecond,
 		ErrorPercentThreshold:  errorPercent,
+
+		ConsecutiveFailureThreshold: config.ConsecutiveFailureThreshold,
+		MaxRequestsPerSecond:        config.MaxRequestsPerSecond,
+		RequireFallback:             config.RequireFallback,
+		SleepWindowJitter:           math.Max(0, math.Min(1, config.SleepWindowJitter)),
+		CancelOnOpen:                config.CancelOnOpen,
+		MetricsResetInterval:        time.Duration(config.MetricsResetInterval) * time.Millisecond,
+		ErrorWeight:                 config.ErrorWeight,
+		Group:                       config.Group,
+		WarmupDuration:              time.Duration(config.WarmupDuration) * time.Millisecond,
+		MinRequestRate:              config.MinRequestRate,
+		RollingStat:                 config.RollingStat,
+		MaxConcurrentFallbacks:      config.MaxConcurrentFallbacks,
+		RecoverPanics:               config.RecoverPanics,
+		TimeoutsCountAsErrors:       config.TimeoutsCountAsErrors == nil || *config.TimeoutsCountAsErrors,
+		DecisionCacheTTL:            time.Duration(config.DecisionCacheTTL) * time.Millisecond,
+		LatencyThreshold:            time.Duration(config.LatencyThreshold) * time.Millisecond,
+		LatencyPercentile:           latencyPercentile,
+		MaxQueueWait:                time.Duration(config.MaxQueueWait) * time.Millisecond,
+		RunInline:                   config.RunInline,
+		RequiredSuccessesToClose:    requiredSuccesses,
+		SkipFallbackOnOpen:          config.SkipFallbackOnOpen,
+		DisableMetrics:              config.DisableMetrics,
+		MaxSleepWindow:              time.Duration(maxSleep) * time.Millisecond,
+		SleepWindowGrowth:           growth,
+		TotalTimeout:                time.Duration(config.TotalTimeout) * time.Millisecond,
+		SyncMetrics:                 config.SyncMetrics,
+		TicketPool:                  config.TicketPool,
+		TicketWeight:                ticketWeight,
+		NoTicket:                    config.NoTicket,
 	}
 }
 
@@ -100,8 +411,13 @@ func getSettings(name string) *Settings {
 	settingsMutex.RUnlock()
 
 	if !exists {
-		ConfigureCommand(name, CommandConfig{})
-		s = getSettings(name)
+		// the defaults are stored without resizing the pool, since this may be creating it
+		settingsMutex.Lock()
+		if s, exists = circuitSettings[name]; !exists {
+			s = newSettings(CommandConfig{})
+			circuitSettings[name] = s
+		}
+		settingsMutex.Unlock()
 	}
 
 	return s
@@ -121,6 +437,6 @@ func GetCircuitSettings() map[string]*Settings {
 }
 
 // SetLogger configures the logger that will be used. This only applies to the hystrix package.
-func SetLogger(l logger) {
+func SetLogger(l Logger) {
 	log = l
 }
@@ -1,6 +1,8 @@
 package hystrix
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,6 +39,34 @@ func TestConfigureRVT(t *testing.T) {
 	})
 }
 
+func TestMinRequestRate(t *testing.T) {
+	Convey("given a command configured with a minimum request rate of 5 per second", t, func() {
+		ConfigureCommand("", CommandConfig{MinRequestRate: 5})
+
+		Convey("the volume threshold is the rate over the rolling window", func() {
+			So(getSettings("").VolumeThreshold(), ShouldEqual, uint64(50))
+		})
+	})
+
+	Convey("given both a request volume and a rate", t, func() {
+		Convey("the higher threshold wins", func() {
+			ConfigureCommand("", CommandConfig{RequestVolumeThreshold: 80, MinRequestRate: 5})
+			So(getSettings("").VolumeThreshold(), ShouldEqual, uint64(80))
+
+			ConfigureCommand("", CommandConfig{RequestVolumeThreshold: 30, MinRequestRate: 5})
+			So(getSettings("").VolumeThreshold(), ShouldEqual, uint64(50))
+		})
+	})
+
+	Convey("given neither", t, func() {
+		ConfigureCommand("", CommandConfig{})
+
+		Convey("the default volume threshold applies", func() {
+			So(getSettings("").VolumeThreshold(), ShouldEqual, uint64(DefaultVolumeThreshold))
+		})
+	})
+}
+
 func TestSleepWindowDefault(t *testing.T) {
 	Convey("given default settings", t, func() {
 		ConfigureCommand("", CommandConfig{})
@@ -57,3 +87,56 @@ func TestGetCircuitSettings(t *testing.T) {
 		})
 	})
 }
+
+func TestConfigureCommandIfChanged(t *testing.T) {
+	Convey("given a configured command", t, func() {
+		ConfigureCommand("reload", CommandConfig{Timeout: 2000, MaxConcurrentRequests: 5})
+		defer ConfigureCommand("reload", CommandConfig{})
+		settings := getSettings("reload")
+
+		Convey("the same config leaves its settings alone", func() {
+			So(ConfigureCommandIfChanged("reload", CommandConfig{Timeout: 2000, MaxConcurrentRequests: 5}), ShouldBeFalse)
+			So(getSettings("reload"), ShouldEqual, settings)
+		})
+
+		Convey("a different config is applied", func() {
+			So(ConfigureCommandIfChanged("reload", CommandConfig{Timeout: 3000, MaxConcurrentRequests: 5}), ShouldBeTrue)
+			So(getSettings("reload").Timeout, ShouldEqual, 3*time.Second)
+		})
+
+		Convey("a config with a function always counts as a change", func() {
+			weigh := func(error) float64 { return 1 }
+			So(ConfigureCommandIfChanged("reload", CommandConfig{Timeout: 2000, MaxConcurrentRequests: 5, ErrorWeight: weigh}), ShouldBeTrue)
+			So(ConfigureCommandIfChanged("reload", CommandConfig{Timeout: 2000, MaxConcurrentRequests: 5, ErrorWeight: weigh}), ShouldBeTrue)
+		})
+	})
+}
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, items ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, items...))
+}
+
+func TestSetLogger(t *testing.T) {
+	Convey("given a custom logger", t, func() {
+		defer Flush()
+		l := &recordingLogger{}
+		SetLogger(l)
+		defer SetLogger(DefaultLogger)
+
+		Convey("opening a circuit is logged to it", func() {
+			cb, _, _ := GetCircuit("logged")
+			cb.setOpen()
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			So(l.messages, ShouldResemble, []string{"hystrix-go: opening circuit logged"})
+		})
+	})
+}
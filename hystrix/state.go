@@ -0,0 +1,71 @@
+package hystrix
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// circuitState is the portion of a circuit's health carried across process restarts.
+type circuitState struct {
+	Name                   string  `json:"name"`
+	Open                   bool    `json:"open"`
+	OpenedOrLastTestedTime int64   `json:"opened_or_last_tested_time"`
+	Requests               float64 `json:"requests"`
+	Errors                 float64 `json:"errors"`
+}
+
+// ExportState serializes whether each known circuit is open, when it opened, and its
+// recent request and error counts, so that a replacement process can resume with
+// ImportState instead of starting every circuit closed.
+func ExportState() []byte {
+	now := clockNow()
+
+	circuitBreakersMutex.RLock()
+	states := make([]circuitState, 0, len(circuitBreakers))
+	for name, cb := range circuitBreakers {
+		cb.mutex.RLock()
+		open := cb.open
+		openedOrLastTestedTime := atomic.LoadInt64(&cb.openedOrLastTestedTime)
+		cb.mutex.RUnlock()
+
+		states = append(states, circuitState{
+			Name:                   name,
+			Open:                   open,
+			OpenedOrLastTestedTime: openedOrLastTestedTime,
+			Requests:               cb.metrics.DefaultCollector().RequestCount(now),
+			Errors:                 cb.metrics.DefaultCollector().ErrorCount(now),
+		})
+	}
+	circuitBreakersMutex.RUnlock()
+
+	// a slice of plain structs always marshals
+	data, _ := json.Marshal(states)
+	return data
+}
+
+// ImportState restores circuits from the output of ExportState. Restored request and
+// error counts age out of the rolling window as usual. Circuits which were open come
+// back open with their original open time, so they stay rejecting until their sleep
+// window elapses and then allow a single test request, just as they would have.
+func ImportState(data []byte) error {
+	var states []circuitState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		cb, _, err := GetCircuit(state.Name)
+		if err != nil {
+			return err
+		}
+
+		cb.metrics.DefaultCollector().NumRequestsStat().Increment(state.Requests)
+		cb.metrics.DefaultCollector().ErrorsStat().Increment(state.Errors)
+
+		if state.Open {
+			cb.restoreOpen(state.OpenedOrLastTestedTime)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package hystrix
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExportImportState(t *testing.T) {
+	Convey("with an open circuit and a closed circuit with recent errors", t, func() {
+		defer Flush()
+
+		ConfigureCommand("state_open", CommandConfig{SleepWindow: 60000})
+		open, _, _ := GetCircuit("state_open")
+		open.setOpen()
+
+		closed, _, _ := GetCircuit("state_closed")
+		closed.ReportEvent([]string{"success"}, time.Now(), 0)
+		closed.ReportEvent([]string{"failure"}, time.Now(), 0)
+		time.Sleep(10 * time.Millisecond)
+
+		data := ExportState()
+
+		Convey("after restarting and importing the exported state", func() {
+			Flush()
+			So(ImportState(data), ShouldBeNil)
+
+			Convey("the open circuit is still open and rejects requests within its sleep window", func() {
+				cb, created, _ := GetCircuit("state_open")
+				So(created, ShouldBeFalse)
+				So(cb.IsOpen(), ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeFalse)
+			})
+
+			Convey("the open circuit's opening is counted as a transition", func() {
+				cb, _, _ := GetCircuit("state_open")
+				So(cb.LifetimeCounts().Transitions, ShouldEqual, 1)
+			})
+
+			Convey("the closed circuit is closed and keeps its counts", func() {
+				cb, _, _ := GetCircuit("state_closed")
+				So(cb.IsOpen(), ShouldBeFalse)
+				So(cb.Metrics().RequestCount(time.Now()), ShouldEqual, 2)
+				So(cb.Metrics().ErrorCount(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("importing malformed state fails", func() {
+			So(ImportState([]byte("not json")), ShouldNotBeNil)
+		})
+	})
+}
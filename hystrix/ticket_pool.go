@@ -0,0 +1,68 @@
+package hystrix
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// TicketPool limits how much of a shared capacity the executions of commands take at once. Each
+// execution of a command configured with a TicketPool takes the command's TicketWeight from it
+// while it runs, in place of a ticket from the command's own pool of MaxConcurrentRequests
+// tickets, which is the default.
+type TicketPool interface {
+	// TryAcquire takes weight from the pool without waiting, reporting whether there was enough free.
+	TryAcquire(weight int64) bool
+	// Acquire takes weight from the pool, waiting until there is enough free or ctx is done, in
+	// which case it returns ctx's error.
+	Acquire(ctx context.Context, weight int64) error
+	// Release returns weight taken by TryAcquire or Acquire.
+	Release(weight int64)
+	// Active returns the weight taken and not yet released.
+	Active() int64
+	// Size returns the total weight the pool holds.
+	Size() int64
+}
+
+// NewWeightedTicketPool returns a TicketPool of size backed by a weighted semaphore, for bulkheads
+// in which an expensive command takes more of the capacity shared with other commands than a cheap
+// one. Give the same pool to each command sharing it, with their TicketWeights.
+func NewWeightedTicketPool(size int64) TicketPool {
+	return &weightedTicketPool{sem: semaphore.NewWeighted(size), size: size}
+}
+
+type weightedTicketPool struct {
+	sem    *semaphore.Weighted
+	size   int64
+	active int64
+}
+
+func (p *weightedTicketPool) TryAcquire(weight int64) bool {
+	if !p.sem.TryAcquire(weight) {
+		return false
+	}
+	atomic.AddInt64(&p.active, weight)
+	return true
+}
+
+func (p *weightedTicketPool) Acquire(ctx context.Context, weight int64) error {
+	if err := p.sem.Acquire(ctx, weight); err != nil {
+		return err
+	}
+	atomic.AddInt64(&p.active, weight)
+	return nil
+}
+
+func (p *weightedTicketPool) Release(weight int64) {
+	atomic.AddInt64(&p.active, -weight)
+	p.sem.Release(weight)
+}
+
+func (p *weightedTicketPool) Active() int64 {
+	return atomic.LoadInt64(&p.active)
+}
+
+func (p *weightedTicketPool) Size() int64 {
+	return p.size
+}
@@ -114,12 +114,27 @@ func NewDatadogCollectorWithClient(client DatadogClient) func(string) metricColl
 	}
 }
 
+// NewDatadogCollectorWithTags is like NewDatadogCollectorWithClient, but tags each circuit's metrics
+// "command:<name>" rather than "hystrixcircuit:<name>", followed by the given tags, such as
+// "service:checkout" or "env:prod", on every metric.
+func NewDatadogCollectorWithTags(client DatadogClient, tags ...string) func(string) metricCollector.MetricCollector {
+	return func(name string) metricCollector.MetricCollector {
+		circuitTags := make([]string, 0, len(tags)+1)
+		circuitTags = append(circuitTags, "command:"+name)
+		return &DatadogCollector{
+			client: client,
+			tags:   append(circuitTags, tags...),
+		}
+	}
+}
+
 func (dc *DatadogCollector) Update(r metricCollector.MetricResult) {
 	if r.Attempts > 0 {
 		dc.client.Count(DM_Attempts, int64(r.Attempts), dc.tags, 1.0)
 	}
-	if r.Errors > 0 {
-		dc.client.Count(DM_Errors, int64(r.Errors), dc.tags, 1.0)
+	if r.Attempts > r.Successes {
+		// r.Errors is weighted, and would be truncated, so each unsuccessful attempt is one error
+		dc.client.Count(DM_Errors, 1, dc.tags, 1.0)
 	}
 	if r.Successes > 0 {
 		dc.client.Gauge(DM_CircuitOpen, 0, dc.tags, 1.0)
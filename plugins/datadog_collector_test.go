@@ -0,0 +1,47 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type recordingDatadogClient struct {
+	counts map[string][]string
+	totals map[string]int64
+}
+
+func (c *recordingDatadogClient) Count(name string, value int64, tags []string, rate float64) error {
+	c.counts[name] = tags
+	c.totals[name] += value
+	return nil
+}
+
+func (c *recordingDatadogClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func (c *recordingDatadogClient) TimeInMilliseconds(name string, value float64, tags []string, rate float64) error {
+	return nil
+}
+
+func TestDatadogCollectorWithTags(t *testing.T) {
+	Convey("a collector made with tags", t, func() {
+		client := &recordingDatadogClient{counts: make(map[string][]string), totals: make(map[string]int64)}
+		collector := NewDatadogCollectorWithTags(client, "service:checkout", "env:prod")("payments")
+
+		Convey("tags every metric with the command and the given tags", func() {
+			collector.Update(metricCollector.MetricResult{Attempts: 1, Successes: 1})
+			So(client.counts[DM_Attempts], ShouldResemble, []string{"command:payments", "service:checkout", "env:prod"})
+			So(client.counts[DM_Successes], ShouldResemble, []string{"command:payments", "service:checkout", "env:prod"})
+		})
+
+		Convey("counts one error per unsuccessful attempt, whatever its weight", func() {
+			collector.Update(metricCollector.MetricResult{Attempts: 1, Failures: 1, Errors: 0.5})
+			collector.Update(metricCollector.MetricResult{Attempts: 1, Timeouts: 1})
+			collector.Update(metricCollector.MetricResult{Attempts: 1, Successes: 1})
+			So(client.totals[DM_Errors], ShouldEqual, 2)
+		})
+	})
+}
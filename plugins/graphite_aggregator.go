@@ -93,7 +93,10 @@ func (g *GraphiteCollector) updateTimerMetric(prefix string, dur time.Duration)
 
 func (g *GraphiteCollector) Update(r metricCollector.MetricResult) {
 	g.incrementCounterMetric(g.attemptsPrefix, r.Attempts)
-	g.incrementCounterMetric(g.errorsPrefix, r.Errors)
+	if r.Attempts > r.Successes {
+		// one error per unsuccessful attempt, as the other collectors count them
+		g.incrementCounterMetric(g.errorsPrefix, 1)
+	}
 	g.incrementCounterMetric(g.successesPrefix, r.Successes)
 	g.incrementCounterMetric(g.failuresPrefix, r.Failures)
 	g.incrementCounterMetric(g.rejectsPrefix, r.Rejects)
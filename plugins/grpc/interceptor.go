@@ -0,0 +1,255 @@
+// Package hystrixgrpc provides gRPC client interceptors which run each call as a hystrix command.
+//
+// Example use
+//
+//	conn, err := grpc.Dial(addr,
+//		grpc.WithUnaryInterceptor(hystrixgrpc.UnaryClientInterceptor(func(method string) string {
+//			return "users"
+//		}, hystrixgrpc.WithIgnoredCodes(codes.NotFound))),
+//	)
+package hystrixgrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryFallback is called when a unary call fails or is not attempted. It may fill in reply
+// and return nil to recover, or return an error for the caller.
+type UnaryFallback func(ctx context.Context, method string, req, reply interface{}, err error) error
+
+// StreamFallback is called when a stream can't be opened or is not attempted. It may return
+// a stream of its own to recover, or an error for the caller.
+type StreamFallback func(ctx context.Context, desc *grpc.StreamDesc, method string, err error) (grpc.ClientStream, error)
+
+// Option configures an interceptor.
+type Option func(*options)
+
+type options struct {
+	ignoredCodes   map[codes.Code]bool
+	unaryFallback  UnaryFallback
+	streamFallback StreamFallback
+}
+
+// WithIgnoredCodes sets status codes which are returned to the caller without counting as
+// failures of the command, such as NotFound for lookups of records which may not exist.
+func WithIgnoredCodes(ignored ...codes.Code) Option {
+	return func(o *options) {
+		for _, code := range ignored {
+			o.ignoredCodes[code] = true
+		}
+	}
+}
+
+// WithUnaryFallback sets the fallback of commands run by UnaryClientInterceptor.
+func WithUnaryFallback(fallback UnaryFallback) Option {
+	return func(o *options) {
+		o.unaryFallback = fallback
+	}
+}
+
+// WithStreamFallback sets the fallback of commands run by StreamClientInterceptor.
+func WithStreamFallback(fallback StreamFallback) Option {
+	return func(o *options) {
+		o.streamFallback = fallback
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{ignoredCodes: make(map[codes.Code]bool)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// UnaryClientInterceptor runs each unary call as the hystrix command named by commandNameFn.
+// Calls ending with a status code other than OK, or one set with WithIgnoredCodes, count as failures.
+func UnaryClientInterceptor(commandNameFn func(method string) string, opts ...Option) grpc.UnaryClientInterceptor {
+	o := newOptions(opts)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		// ignoredErr is only read once the run function has returned
+		var ignoredErr error
+		var fallbackRan bool
+
+		// hystrix doesn't cancel a call which timed out, so the command is given a context of
+		// its own to abandon the call with
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		c := &call{cancel: cancel, done: make(chan struct{})}
+
+		run := func(ctx context.Context) error {
+			if !c.start() {
+				return context.Canceled
+			}
+			defer close(c.done)
+
+			err := invoker(ctx, method, req, reply, cc, callOpts...)
+			if o.ignoredCodes[status.Code(err)] {
+				ignoredErr = err
+				return nil
+			}
+			return err
+		}
+
+		var fallback func(context.Context, error) error
+		if o.unaryFallback != nil {
+			fallback = func(ctx context.Context, err error) error {
+				// the call may still be unmarshalling into reply
+				c.abandon()
+				fallbackRan = true
+				return o.unaryFallback(ctx, method, req, reply, toStatus(err))
+			}
+		}
+
+		err := hystrix.DoC(ctx, commandNameFn(method), run, fallback)
+		if err != nil {
+			c.abandon()
+			return commandStatus(err)
+		}
+		if fallbackRan {
+			return nil
+		}
+		return ignoredErr
+	}
+}
+
+// StreamClientInterceptor runs the opening of each stream as the hystrix command named by
+// commandNameFn. Messages sent and received once the stream is open are not tracked.
+func StreamClientInterceptor(commandNameFn func(method string) string, opts ...Option) grpc.StreamClientInterceptor {
+	o := newOptions(opts)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// run's results are only read once it has returned, and fallback's once it has returned,
+		// as a call which timed out may still be running alongside the fallback.
+		var runStream, fallbackStream grpc.ClientStream
+		var ignoredErr error
+		var fallbackRan bool
+
+		// The stream outlives the command, so it is opened with a context of the caller's rather
+		// than the command's. It is canceled when the command fails, closing a stream which
+		// opened too late to be used, and otherwise once the stream has ended.
+		streamCtx, cancelStream := context.WithCancel(ctx)
+
+		run := func(_ context.Context) error {
+			s, err := streamer(streamCtx, desc, cc, method, callOpts...)
+			if o.ignoredCodes[status.Code(err)] {
+				ignoredErr = err
+				return nil
+			}
+			runStream = s
+			return err
+		}
+
+		var fallback func(context.Context, error) error
+		if o.streamFallback != nil {
+			fallback = func(ctx context.Context, err error) error {
+				fallbackRan = true
+				s, fallbackErr := o.streamFallback(ctx, desc, method, toStatus(err))
+				fallbackStream = s
+				return fallbackErr
+			}
+		}
+
+		err := hystrix.DoC(ctx, commandNameFn(method), run, fallback)
+		if err != nil {
+			cancelStream()
+			return nil, commandStatus(err)
+		}
+		if fallbackRan {
+			cancelStream()
+			return fallbackStream, nil
+		}
+		if ignoredErr != nil {
+			cancelStream()
+			return nil, ignoredErr
+		}
+		return &cancelingStream{ClientStream: runStream, cancel: cancelStream}, nil
+	}
+}
+
+// cancelingStream is a stream opened with a context of the interceptor's, which it cancels once
+// the stream has ended, as grpc does with the context of a stream it has ended itself.
+type cancelingStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (s *cancelingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.cancel()
+	}
+	return err
+}
+
+// call is a unary call made by a command's run function, which may be abandoned once the command
+// has failed. An abandoned call is canceled and waited for, if it has started, and otherwise never
+// starts, so that nothing else writes into its reply meanwhile.
+type call struct {
+	mutex     sync.Mutex
+	cancel    context.CancelFunc
+	started   bool
+	abandoned bool
+	// done is closed once a call which started has returned.
+	done chan struct{}
+}
+
+// start reports whether the call may start, marking it started if so.
+func (c *call) start() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.abandoned {
+		return false
+	}
+	c.started = true
+	return true
+}
+
+// abandon cancels the call, returning once it is sure not to be running.
+func (c *call) abandon() {
+	c.mutex.Lock()
+	c.abandoned = true
+	started := c.started
+	c.mutex.Unlock()
+
+	c.cancel()
+	if started {
+		<-c.done
+	}
+}
+
+// commandStatus converts the error returned by hystrix.DoC into the error returned to the caller.
+func commandStatus(err error) error {
+	var ce hystrix.CommandError
+	if errors.As(err, &ce) && ce.FallbackErr != nil {
+		return ce.FallbackErr
+	}
+	return toStatus(err)
+}
+
+// toStatus gives hystrix's own errors a status code, and unwraps errors returned by the call.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, hystrix.ErrCircuitOpen):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, hystrix.ErrMaxConcurrency), errors.Is(err, hystrix.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, hystrix.ErrTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	var ce hystrix.CommandError
+	if errors.As(err, &ce) {
+		return ce.RunErr
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package hystrixgrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+	"github.com/lesha888/hystrix-go/hystrix/hystrixtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func invokerReturning(err error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return err
+	}
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	Convey("with a unary interceptor ignoring NotFound", t, func() {
+		defer hystrix.Flush()
+
+		interceptor := UnaryClientInterceptor(func(method string) string { return "grpc" }, WithIgnoredCodes(codes.NotFound))
+
+		Convey("a successful call succeeds", func() {
+			err := interceptor(context.Background(), "/svc/Get", nil, nil, nil, invokerReturning(nil))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("a failing call returns its status", func() {
+			err := interceptor(context.Background(), "/svc/Get", nil, nil, nil, invokerReturning(status.Error(codes.Internal, "boom")))
+			So(status.Code(err), ShouldEqual, codes.Internal)
+		})
+
+		Convey("an ignored code is returned without counting as a failure", func() {
+			err := interceptor(context.Background(), "/svc/Get", nil, nil, nil, invokerReturning(status.Error(codes.NotFound, "missing")))
+			So(status.Code(err), ShouldEqual, codes.NotFound)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := hystrix.GetCircuit("grpc")
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 0)
+		})
+
+		Convey("an open circuit returns Unavailable without calling", func() {
+			hystrixtest.TripCircuit(t, "grpc")
+
+			called := false
+			err := interceptor(context.Background(), "/svc/Get", nil, nil, nil, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				called = true
+				return nil
+			})
+			So(status.Code(err), ShouldEqual, codes.Unavailable)
+			So(called, ShouldBeFalse)
+		})
+	})
+
+	Convey("with a unary interceptor with a fallback", t, func() {
+		defer hystrix.Flush()
+
+		var fallbackErr error
+		interceptor := UnaryClientInterceptor(func(method string) string { return "grpc_fallback" },
+			WithUnaryFallback(func(ctx context.Context, method string, req, reply interface{}, err error) error {
+				fallbackErr = err
+				return nil
+			}))
+
+		Convey("a failing call is recovered by the fallback", func() {
+			err := interceptor(context.Background(), "/svc/Get", nil, nil, nil, invokerReturning(status.Error(codes.Internal, "boom")))
+			So(err, ShouldBeNil)
+			So(status.Code(fallbackErr), ShouldEqual, codes.Internal)
+		})
+
+		Convey("a call which times out is canceled before the fallback fills in its reply", func() {
+			hystrix.ConfigureCommand("grpc_fallback", hystrix.CommandConfig{Timeout: 10})
+			defer hystrix.ConfigureCommand("grpc_fallback", hystrix.CommandConfig{})
+			interceptor := UnaryClientInterceptor(func(method string) string { return "grpc_fallback" },
+				WithUnaryFallback(func(ctx context.Context, method string, req, reply interface{}, err error) error {
+					*reply.(*string) = "fallback"
+					return nil
+				}))
+
+			var reply string
+			err := interceptor(context.Background(), "/svc/Get", nil, &reply, nil, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				<-ctx.Done()
+				*reply.(*string) = "partial"
+				return ctx.Err()
+			})
+			So(err, ShouldBeNil)
+			So(reply, ShouldEqual, "fallback")
+		})
+	})
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+}
+
+func TestStreamClientInterceptor(t *testing.T) {
+	Convey("with a stream interceptor", t, func() {
+		defer hystrix.Flush()
+
+		interceptor := StreamClientInterceptor(func(method string) string { return "grpc_stream" })
+		desc := &grpc.StreamDesc{StreamName: "Watch"}
+
+		Convey("an opened stream is returned", func() {
+			opened := &fakeStream{}
+			stream, err := interceptor(context.Background(), desc, nil, "/svc/Watch", func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return opened, nil
+			})
+			So(err, ShouldBeNil)
+			So(stream.(*cancelingStream).ClientStream, ShouldEqual, opened)
+		})
+
+		Convey("a stream which can't be opened returns its status", func() {
+			_, err := interceptor(context.Background(), desc, nil, "/svc/Watch", func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return nil, status.Error(codes.Unavailable, "down")
+			})
+			So(status.Code(err), ShouldEqual, codes.Unavailable)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeFalse)
+		})
+
+		Convey("a stream opened after the command timed out is closed", func() {
+			hystrix.ConfigureCommand("grpc_stream", hystrix.CommandConfig{Timeout: 10})
+			defer hystrix.ConfigureCommand("grpc_stream", hystrix.CommandConfig{})
+
+			streamCtx := make(chan context.Context, 1)
+			_, err := interceptor(context.Background(), desc, nil, "/svc/Watch", func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				time.Sleep(30 * time.Millisecond)
+				streamCtx <- ctx
+				return &fakeStream{}, nil
+			})
+			So(status.Code(err), ShouldEqual, codes.DeadlineExceeded)
+			So((<-streamCtx).Err(), ShouldEqual, context.Canceled)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+// Package hystrixhttp provides an http.RoundTripper which runs outbound requests as hystrix commands.
+//
+// Example use
+//
+//	client := &http.Client{
+//		Transport: hystrixhttp.NewRoundTripper(http.DefaultTransport, func(req *http.Request) string {
+//			return req.URL.Host
+//		}),
+//	}
+package hystrixhttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+)
+
+// Classifier reports whether the outcome of a request counts as a failure of its command.
+type Classifier func(*http.Response, error) bool
+
+// DefaultClassifier counts transport errors and responses other than 2xx as failures.
+func DefaultClassifier(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode < 200 || resp.StatusCode > 299
+}
+
+// Option configures a round tripper.
+type Option func(*roundTripper)
+
+// WithClassifier replaces DefaultClassifier in deciding which requests count as failures.
+func WithClassifier(isFailure Classifier) Option {
+	return func(rt *roundTripper) {
+		rt.isFailure = isFailure
+	}
+}
+
+type roundTripper struct {
+	base          http.RoundTripper
+	commandNameFn func(*http.Request) string
+	isFailure     Classifier
+}
+
+// NewRoundTripper returns a RoundTripper which sends each request through base as the hystrix
+// command named by commandNameFn. Responses counted as failures are still returned to the caller.
+// When the circuit is open, the request is rejected or it times out, the round trip fails with the
+// hystrix error and no response. The command runs with the request's context, so canceling
+// the request cancels the command.
+func NewRoundTripper(base http.RoundTripper, commandNameFn func(*http.Request) string, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	rt := &roundTripper{
+		base:          base,
+		commandNameFn: commandNameFn,
+		isFailure:     DefaultClassifier,
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+// roundTrip holds the outcome of a request, which may arrive after its command has given up on it.
+type roundTrip struct {
+	mutex     sync.Mutex
+	resp      *http.Response
+	err       error
+	abandoned bool
+	// cancel cancels the context the request was sent with.
+	cancel context.CancelFunc
+}
+
+// finish records the outcome of the request, closing the response if its command already gave up.
+func (t *roundTrip) finish(resp *http.Response, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.abandoned {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	t.resp, t.err = resp, err
+}
+
+// abandon gives up on the request, canceling it and closing any response it received.
+func (t *roundTrip) abandon() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.cancel()
+	t.abandoned = true
+	if t.resp != nil {
+		t.resp.Body.Close()
+		t.resp = nil
+	}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The response body is read after the command finishes, so the request is sent with a context
+	// of its own rather than the command's. It is canceled when the command gives up on the
+	// request, and otherwise once the response body is closed.
+	ctx, cancel := context.WithCancel(req.Context())
+	t := &roundTrip{cancel: cancel}
+	errFailed := &failedError{}
+
+	err := hystrix.DoC(req.Context(), rt.commandNameFn(req), func(_ context.Context) error {
+		resp, err := rt.base.RoundTrip(req.WithContext(ctx))
+		t.finish(resp, err)
+		if rt.isFailure(resp, err) {
+			return errFailed
+		}
+		return nil
+	}, nil)
+
+	if err != nil && !errors.Is(err, errFailed) {
+		t.abandon()
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.resp == nil {
+		cancel()
+		return nil, t.err
+	}
+	t.resp.Body = &cancelingBody{ReadCloser: t.resp.Body, cancel: cancel}
+	return t.resp, t.err
+}
+
+// cancelingBody is a response body which cancels the context its request was sent with once closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// failedError marks a request counted as a failure, whose outcome is returned to the caller as it is.
+type failedError struct{}
+
+func (*failedError) Error() string { return "request counted as a failure" }
@@ -0,0 +1,126 @@
+package hystrixhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix"
+	"github.com/lesha888/hystrix-go/hystrix/hystrixtest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRoundTripper(t *testing.T) {
+	Convey("with a client whose transport runs requests as commands", t, func() {
+		defer hystrix.Flush()
+
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			switch r.URL.Path {
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+			case "/slow":
+				time.Sleep(100 * time.Millisecond)
+			}
+		}))
+		defer server.Close()
+
+		hystrix.ConfigureCommand("http", hystrix.CommandConfig{Timeout: 1000})
+		commandName := func(*http.Request) string { return "http" }
+		client := &http.Client{Transport: NewRoundTripper(nil, commandName)}
+
+		Convey("a successful request succeeds", func() {
+			resp, err := client.Get(server.URL)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("a non-2xx response is returned and counted as a failure", func() {
+			resp, err := client.Get(server.URL + "/missing")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := hystrix.GetCircuit("http")
+			So(cb.Metrics().FailureCount(time.Now()), ShouldEqual, 1)
+		})
+
+		Convey("an open circuit fails without making the request", func() {
+			hystrixtest.TripCircuit(t, "http")
+
+			_, err := client.Get(server.URL)
+			So(errors.Is(err, hystrix.ErrCircuitOpen), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 0)
+		})
+
+		Convey("a request which takes too long times out", func() {
+			hystrix.ConfigureCommand("http", hystrix.CommandConfig{Timeout: 10})
+
+			_, err := client.Get(server.URL + "/slow")
+			So(errors.Is(err, hystrix.ErrTimeout), ShouldBeTrue)
+		})
+
+		Convey("a request which times out is canceled", func() {
+			hystrix.ConfigureCommand("http", hystrix.CommandConfig{Timeout: 10})
+			canceled := make(chan error, 1)
+			client := &http.Client{Transport: NewRoundTripper(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				<-req.Context().Done()
+				canceled <- req.Context().Err()
+				return nil, req.Context().Err()
+			}), commandName)}
+
+			_, err := client.Get(server.URL)
+			So(errors.Is(err, hystrix.ErrTimeout), ShouldBeTrue)
+			select {
+			case err := <-canceled:
+				So(err, ShouldEqual, context.Canceled)
+			case <-time.After(time.Second):
+				t.Fatal("the request wasn't canceled")
+			}
+		})
+
+		Convey("a canceled request cancels its command", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			req, _ := http.NewRequest("GET", server.URL+"/slow", nil)
+
+			_, err := client.Do(req.WithContext(ctx))
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+
+	Convey("with a classifier which accepts 404s", t, func() {
+		defer hystrix.Flush()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: NewRoundTripper(nil, func(*http.Request) string { return "http_404" },
+			WithClassifier(func(resp *http.Response, err error) bool {
+				return err != nil || resp.StatusCode >= 500
+			}))}
+
+		Convey("404s count as successes", func() {
+			resp, err := client.Get(server.URL)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			time.Sleep(50 * time.Millisecond)
+			cb, _, _ := hystrix.GetCircuit("http_404")
+			So(cb.Metrics().SuccessCount(time.Now()), ShouldEqual, 1)
+		})
+	})
+}
@@ -1,8 +1,12 @@
 package plugins
 
 import (
+	"errors"
+	"github.com/lesha888/hystrix-go/hystrix"
 	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
 	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,10 +16,13 @@ const PROMETHEUS_NAMESPACE = "hystrix_go"
 // This struct contains the metrics for prometheus. The handling of the values is completely done by the prometheus client library.
 // The function `Collector` can be registered to the metricsCollector.Registry.
 // If one want to use a custom registry it can be given via the reg parameter. If reg is nil, the prometheus default
-// registry is used.
+// registry is used. AlsoRegister exports the same metrics from further registries.
 // The RunDuration is observed via a prometheus histogram ( https://prometheus.io/docs/concepts/metric_types/#histogram ).
 // If the duration_buckets slice is nil, the "github.com/prometheus/client_golang/prometheus".DefBuckets  are used. As stated by the prometheus documentation, one should
 // tailor the buckets to the response times of your application.
+// Alternatively, WithRunDurationSummary observes the RunDuration via a summary with quantile objectives, which
+// tracks each instance's latency distribution more accurately but, unlike a histogram, can't be aggregated
+// across instances. WithConstLabels adds labels of your own, such as the service, to every metric.
 //
 //
 // Example use
@@ -40,105 +47,479 @@ type PrometheusCollector struct {
 	timeouts          *prometheus.CounterVec
 	fallbackSuccesses *prometheus.CounterVec
 	fallbackFailures  *prometheus.CounterVec
+	fallbackSkipped   *prometheus.CounterVec
+	fallbackRejected  *prometheus.CounterVec
+	probeSuccesses    *prometheus.CounterVec
+	probeFailures     *prometheus.CounterVec
+	customEvents      *prometheus.CounterVec
+	fallbackQuality   *prometheus.CounterVec
 	totalDuration     *prometheus.GaugeVec
-	runDuration       *prometheus.HistogramVec
+	runDuration       prometheus.ObserverVec
+	fallbackDuration  *prometheus.HistogramVec
+	openSeconds       *circuitCollector
+	droppedUpdates    *circuitCollector
+	maxActive         *circuitCollector
+	transitions       *circuitCollector
+	state             *circuitStateCollector
+	expiry            *seriesExpiry
 }
 
-func NewPrometheusCollector(reg prometheus.Registerer, duration_buckets []float64) PrometheusCollector {
+// PrometheusCollectorOption configures a PrometheusCollector.
+type PrometheusCollectorOption func(*prometheusCollectorOptions)
+
+type prometheusCollectorOptions struct {
+	summaryObjectives map[float64]float64
+	constLabels       prometheus.Labels
+}
+
+// DefaultSummaryObjectives are the quantiles, with their allowed errors, which WithRunDurationSummary uses when given none.
+var DefaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// WithRunDurationSummary observes the RunDuration via a prometheus summary with the given quantile objectives
+// ( https://prometheus.io/docs/concepts/metric_types/#summary ) instead of a histogram. If objectives is nil,
+// DefaultSummaryObjectives are used.
+func WithRunDurationSummary(objectives map[float64]float64) PrometheusCollectorOption {
+	return func(o *prometheusCollectorOptions) {
+		if objectives == nil {
+			objectives = DefaultSummaryObjectives
+		}
+		o.summaryObjectives = objectives
+	}
+}
+
+// WithConstLabels adds labels with fixed values, such as the service and environment, to every
+// metric alongside the command label, so that each series can be told apart once the metrics of
+// many services are gathered together.
+func WithConstLabels(labels prometheus.Labels) PrometheusCollectorOption {
+	return func(o *prometheusCollectorOptions) {
+		o.constLabels = labels
+	}
+}
+
+func NewPrometheusCollector(reg prometheus.Registerer, duration_buckets []float64, opts ...PrometheusCollectorOption) PrometheusCollector {
 	if duration_buckets == nil {
 		duration_buckets = prometheus.DefBuckets
 	}
+	o := &prometheusCollectorOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var runDuration prometheus.ObserverVec
+	if o.summaryObjectives != nil {
+		runDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "run_duration_seconds",
+			Help:        "Runtime of the Hystrix command.",
+			Objectives:  o.summaryObjectives,
+		}, []string{"command"})
+	} else {
+		runDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "run_duration_seconds",
+			Help:        "Runtime of the Hystrix command.",
+			Buckets:     duration_buckets,
+		}, []string{"command"})
+	}
+
 	hm := PrometheusCollector{
 		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "attempts",
-			Help:      "The number of updates.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "attempts",
+			Help:        "The number of executions. Each is counted by one of successes, failures, rejects, short_circuits and timeouts, unless it was canceled, its context's deadline passed, or it was rejected while draining.",
 		}, []string{"command"}),
 		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "errors",
-			Help:      "The number of unsuccessful attempts. Attempts minus Errors will equal successes within a time range. Errors are any result from an attempt that is not a success.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "errors",
+			Help:        "The number of unsuccessful attempts. Attempts minus Errors will equal successes within a time range. Errors are any result from an attempt that is not a success, including those which don't count towards the circuit's error percentage.",
 		}, []string{"command"}),
 		successes: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "successes",
-			Help:      "The number of requests that succeed.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "successes",
+			Help:        "The number of requests that succeed.",
 		}, []string{"command"}),
 		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "failures",
-			Help:      "The number of requests that fail.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "failures",
+			Help:        "The number of requests that fail.",
 		}, []string{"command"}),
 		rejects: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "rejects",
-			Help:      "The number of requests that are rejected.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "rejects",
+			Help:        "The number of requests that are rejected.",
 		}, []string{"command"}),
 		shortCircuits: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "short_circuits",
-			Help:      "The number of requests that short circuited due to the circuit being open.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "short_circuits",
+			Help:        "The number of requests that short circuited due to the circuit being open.",
 		}, []string{"command"}),
 		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "timeouts",
-			Help:      "The number of requests that are timeouted in the circuit breaker.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "timeouts",
+			Help:        "The number of requests that are timeouted in the circuit breaker.",
 		}, []string{"command"}),
 		fallbackSuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "fallback_successes",
-			Help:      "The number of successes that occurred during the execution of the fallback function.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_successes",
+			Help:        "The number of successes that occurred during the execution of the fallback function.",
 		}, []string{"command"}),
 		fallbackFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "fallback_failures",
-			Help:      "The number of failures that occurred during the execution of the fallback function.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_failures",
+			Help:        "The number of failures that occurred during the execution of the fallback function.",
+		}, []string{"command"}),
+		fallbackSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_skipped",
+			Help:        "The number of requests without a fallback that were short-circuited or rejected before running.",
+		}, []string{"command"}),
+		fallbackRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_rejections",
+			Help:        "The number of fallback failures caused by exceeding the command's maximum concurrent fallbacks.",
 		}, []string{"command"}),
+		probeSuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "probe_successes",
+			Help:        "The number of requests let through an open circuit after its sleep window which succeeded.",
+		}, []string{"command"}),
+		probeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "probe_failures",
+			Help:        "The number of requests let through an open circuit after its sleep window which failed.",
+		}, []string{"command"}),
+		customEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "custom_events",
+			Help:        "The number of custom events reported by run and fallback functions, by event type.",
+		}, []string{"command", "event"}),
+		fallbackQuality: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_quality",
+			Help:        "The number of successful fallbacks by the quality they reported, such as degraded.",
+		}, []string{"command", "quality"}),
 		totalDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "total_duration_seconds",
-			Help:      "The total runtime of this command in seconds.",
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "total_duration_seconds",
+			Help:        "The total runtime of this command in seconds.",
 		}, []string{"command"}),
-		runDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
-			Namespace: PROMETHEUS_NAMESPACE,
-			Name:      "run_duration_seconds",
-			Help:      "Runtime of the Hystrix command.",
-			Buckets:   duration_buckets,
+		runDuration: runDuration,
+		fallbackDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   PROMETHEUS_NAMESPACE,
+			ConstLabels: o.constLabels,
+			Name:        "fallback_duration_seconds",
+			Help:        "Runtime of the Hystrix command's fallback.",
+			Buckets:     duration_buckets,
 		}, []string{"command"}),
+		openSeconds: &circuitCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "open_seconds_total"),
+				"The total time the circuit breaker has spent open, in seconds.",
+				[]string{"command"}, o.constLabels,
+			),
+			valueType: prometheus.CounterValue,
+			value: func(cb *hystrix.CircuitBreaker) float64 {
+				return cb.OpenDuration().Seconds()
+			},
+		},
+		droppedUpdates: &circuitCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "metric_updates_dropped_total"),
+				"The number of executions whose metrics were dropped because the metric exchange couldn't keep up.",
+				[]string{"command"}, o.constLabels,
+			),
+			valueType: prometheus.CounterValue,
+			value: func(cb *hystrix.CircuitBreaker) float64 {
+				return float64(cb.DroppedMetricUpdates())
+			},
+		},
+		maxActive: &circuitCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "max_concurrent_executions"),
+				"The most executions running at once within the rolling window.",
+				[]string{"command"}, o.constLabels,
+			),
+			valueType: prometheus.GaugeValue,
+			value: func(cb *hystrix.CircuitBreaker) float64 {
+				return float64(cb.MaxActive())
+			},
+		},
+		transitions: &circuitCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "state_transitions_total"),
+				"The number of times the circuit breaker has opened or closed. A high rate means it is flapping.",
+				[]string{"command"}, o.constLabels,
+			),
+			valueType: prometheus.CounterValue,
+			value: func(cb *hystrix.CircuitBreaker) float64 {
+				return float64(cb.LifetimeCounts().Transitions)
+			},
+		},
+		state: &circuitStateCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(PROMETHEUS_NAMESPACE, "", "circuit_state"),
+				"Whether the circuit breaker is in each state: closed, open, or half-open and probing. 1 for its current state, 0 for the others.",
+				[]string{"command", "state"}, o.constLabels,
+			),
+		},
 	}
+	hm.expiry = newSeriesExpiry(hm.deleteSeries)
 	if reg != nil {
-		reg.MustRegister(
-			hm.attempts,
-			hm.errors,
-			hm.failures,
-			hm.rejects,
-			hm.shortCircuits,
-			hm.timeouts,
-			hm.fallbackSuccesses,
-			hm.fallbackFailures,
-			hm.totalDuration,
-			hm.runDuration,
-		)
+		reg.MustRegister(hm.collectors()...)
 	} else {
-		prometheus.MustRegister(
-			hm.attempts,
-			hm.errors,
-			hm.failures,
-			hm.rejects,
-			hm.shortCircuits,
-			hm.timeouts,
-			hm.fallbackSuccesses,
-			hm.fallbackFailures,
-			hm.totalDuration,
-			hm.runDuration,
-		)
+		prometheus.MustRegister(hm.collectors()...)
 	}
 	return hm
 }
 
+// AlsoRegister registers the same metrics with reg as well, so that they can be exported from more
+// than one registry. Metrics already registered with reg are left as they are, rather than
+// causing an error.
+func (hm *PrometheusCollector) AlsoRegister(reg prometheus.Registerer) error {
+	for _, c := range hm.collectors() {
+		if err := reg.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (hm *PrometheusCollector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		hm.attempts,
+		hm.errors,
+		hm.successes,
+		hm.failures,
+		hm.rejects,
+		hm.shortCircuits,
+		hm.timeouts,
+		hm.fallbackSuccesses,
+		hm.fallbackFailures,
+		hm.fallbackSkipped,
+		hm.fallbackRejected,
+		hm.probeSuccesses,
+		hm.probeFailures,
+		hm.customEvents,
+		hm.fallbackQuality,
+		hm.totalDuration,
+		hm.runDuration,
+		hm.fallbackDuration,
+		hm.openSeconds,
+		hm.droppedUpdates,
+		hm.maxActive,
+		hm.transitions,
+		hm.state,
+	}
+}
+
+// SetIdleExpiry deletes the series of commands which have had no executions for d, so that
+// commands which are no longer used disappear from scrapes rather than reporting their last values
+// forever. A command which runs again starts new series, from zero. The series read from the
+// circuits themselves, such as open_seconds_total, are left to the circuits. Idle series are looked
+// for in the background every d/2. A d of zero or less stops looking, which is the default.
+func (hm *PrometheusCollector) SetIdleExpiry(d time.Duration) {
+	hm.expiry.setIdle(d)
+}
+
+// deleteSeries deletes every series of the named command from the metrics reported by Update.
+func (hm *PrometheusCollector) deleteSeries(name string) {
+	labels := prometheus.Labels{"command": name}
+	vecs := []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{
+		hm.attempts,
+		hm.errors,
+		hm.successes,
+		hm.failures,
+		hm.rejects,
+		hm.shortCircuits,
+		hm.timeouts,
+		hm.fallbackSuccesses,
+		hm.fallbackFailures,
+		hm.fallbackSkipped,
+		hm.fallbackRejected,
+		hm.probeSuccesses,
+		hm.probeFailures,
+		hm.customEvents,
+		hm.fallbackQuality,
+		hm.totalDuration,
+		hm.fallbackDuration,
+	}
+	for _, vec := range vecs {
+		vec.DeletePartialMatch(labels)
+	}
+	// a histogram or a summary, both of which can be deleted from
+	if vec, ok := hm.runDuration.(interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}); ok {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// seriesExpiry tracks when each command last had an execution, and deletes the series of those
+// idle for too long.
+type seriesExpiry struct {
+	// mutex is held for reading while a command's metrics are updated, and for writing while idle
+	// series are deleted, so that a command which becomes active again never loses an update.
+	mutex sync.RWMutex
+	// lastActive holds when each command was last active, in Unix nanoseconds, or 0 once its
+	// series have been deleted. Entries are added with mutex held for writing.
+	lastActive   map[string]*int64
+	deleteSeries func(name string)
+	idle         time.Duration
+	// stop is closed to stop the sweeper, if one is running.
+	stop chan struct{}
+}
+
+func newSeriesExpiry(deleteSeries func(name string)) *seriesExpiry {
+	return &seriesExpiry{
+		lastActive:   make(map[string]*int64),
+		deleteSeries: deleteSeries,
+	}
+}
+
+// register returns where the named command's last activity is kept, counting it as active now.
+func (e *seriesExpiry) register(name string) *int64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	lastActive, ok := e.lastActive[name]
+	if !ok {
+		lastActive = new(int64)
+		e.lastActive[name] = lastActive
+	}
+	atomic.StoreInt64(lastActive, time.Now().UnixNano())
+	return lastActive
+}
+
+// setIdle replaces the sweeper with one deleting the series idle for d, if d is positive.
+func (e *seriesExpiry) setIdle(d time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+	e.idle = d
+	if d <= 0 {
+		return
+	}
+	e.stop = make(chan struct{})
+	go e.sweepEvery(d/2, e.stop)
+}
+
+func (e *seriesExpiry) sweepEvery(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			e.sweep(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep deletes the series of commands which have been idle since before now less the idle expiry.
+func (e *seriesExpiry) sweep(now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.idle <= 0 {
+		return
+	}
+	for name, lastActive := range e.lastActive {
+		last := atomic.LoadInt64(lastActive)
+		if last != 0 && now.Sub(time.Unix(0, last)) >= e.idle {
+			e.deleteSeries(name)
+			atomic.StoreInt64(lastActive, 0)
+		}
+	}
+}
+
+// circuitCollector reports a value of each circuit when scraped, for values kept by the circuit
+// itself rather than passed to metric collectors, such as its OpenDuration, since time spent open
+// accrues between command executions as well as during them.
+type circuitCollector struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(cb *hystrix.CircuitBreaker) float64
+}
+
+func (c *circuitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *circuitCollector) Collect(ch chan<- prometheus.Metric) {
+	var metrics []prometheus.Metric
+	hystrix.ForEachCircuit(func(name string, cb *hystrix.CircuitBreaker) {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.desc, c.valueType, c.value(cb), name))
+	})
+	// sending may block on the registry, which mustn't happen while walking the circuits
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// circuitStateCollector reports the State of each circuit when scraped, as a series for each state
+// which is 1 for the current one, so that graphs show when circuits were half-open.
+type circuitStateCollector struct {
+	desc *prometheus.Desc
+}
+
+var circuitStates = []hystrix.CircuitState{hystrix.CircuitClosed, hystrix.CircuitOpen, hystrix.CircuitHalfOpen}
+
+func (c *circuitStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *circuitStateCollector) Collect(ch chan<- prometheus.Metric) {
+	var metrics []prometheus.Metric
+	hystrix.ForEachCircuit(func(name string, cb *hystrix.CircuitBreaker) {
+		current := cb.State()
+		for _, state := range circuitStates {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			metrics = append(metrics, prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, name, state.String()))
+		}
+	})
+	// sending may block on the registry, which mustn't happen while walking the circuits
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
 type cmdCollector struct {
 	commandName string
 	metrics     *PrometheusCollector
+	// lastActive is when the command last had an execution, for its PrometheusCollector's seriesExpiry.
+	lastActive *int64
 }
 
 func (hc *cmdCollector) initCounters() {
@@ -151,6 +532,10 @@ func (hc *cmdCollector) initCounters() {
 	hc.metrics.timeouts.WithLabelValues(hc.commandName).Add(0.0)
 	hc.metrics.fallbackSuccesses.WithLabelValues(hc.commandName).Add(0.0)
 	hc.metrics.fallbackFailures.WithLabelValues(hc.commandName).Add(0.0)
+	hc.metrics.fallbackSkipped.WithLabelValues(hc.commandName).Add(0.0)
+	hc.metrics.fallbackRejected.WithLabelValues(hc.commandName).Add(0.0)
+	hc.metrics.probeSuccesses.WithLabelValues(hc.commandName).Add(0.0)
+	hc.metrics.probeFailures.WithLabelValues(hc.commandName).Add(0.0)
 	hc.metrics.totalDuration.WithLabelValues(hc.commandName).Set(0.0)
 }
 
@@ -158,12 +543,13 @@ func (hm *PrometheusCollector) Collector(name string) metricCollector.MetricColl
 	hc := &cmdCollector{
 		commandName: name,
 		metrics:     hm,
+		lastActive:  hm.expiry.register(name),
 	}
 	hc.initCounters()
 	return hc
 }
 
-// IncrementAttempts increments the number of updates.
+// IncrementAttempts increments the number of executions.
 func (hc *cmdCollector) IncrementAttempts() {
 	hc.metrics.attempts.WithLabelValues(hc.commandName).Inc()
 }
@@ -210,6 +596,45 @@ func (hc *cmdCollector) IncrementFallbackFailures() {
 	hc.metrics.fallbackFailures.WithLabelValues(hc.commandName).Inc()
 }
 
+// IncrementFallbackSkipped increments the number of requests dropped without a fallback before running.
+func (hc *cmdCollector) IncrementFallbackSkipped() {
+	hc.metrics.fallbackSkipped.WithLabelValues(hc.commandName).Inc()
+}
+
+// IncrementFallbackRejected increments the number of fallbacks rejected for exceeding the maximum concurrent fallbacks.
+func (hc *cmdCollector) IncrementFallbackRejected() {
+	hc.metrics.fallbackRejected.WithLabelValues(hc.commandName).Inc()
+}
+
+// IncrementProbeSuccess increments the number of successful probes of an open circuit.
+func (hc *cmdCollector) IncrementProbeSuccess() {
+	hc.metrics.probeSuccesses.WithLabelValues(hc.commandName).Inc()
+}
+
+// IncrementProbeFailure increments the number of failed probes of an open circuit.
+func (hc *cmdCollector) IncrementProbeFailure() {
+	hc.metrics.probeFailures.WithLabelValues(hc.commandName).Inc()
+}
+
+// IncrementCustomEvents increments the number of custom events of the given type.
+func (hc *cmdCollector) IncrementCustomEvents(eventType string, n float64) {
+	hc.metrics.customEvents.WithLabelValues(hc.commandName, eventType).Add(n)
+}
+
+// active counts the command as active now, and keeps its series from being deleted as idle
+// until the returned function is called.
+func (hc *cmdCollector) active() (done func()) {
+	hc.metrics.expiry.mutex.RLock()
+	atomic.StoreInt64(hc.lastActive, time.Now().UnixNano())
+	return hc.metrics.expiry.mutex.RUnlock
+}
+
+// UpdateFallbackQuality increments the number of successful fallbacks of the given quality.
+func (hc *cmdCollector) UpdateFallbackQuality(quality string) {
+	defer hc.active()()
+	hc.metrics.fallbackQuality.WithLabelValues(hc.commandName, quality).Inc()
+}
+
 // UpdateTotalDuration updates the internal counter of how long we've run for.
 func (hc *cmdCollector) UpdateTotalDuration(timeSinceStart time.Duration) {
 	hc.metrics.totalDuration.WithLabelValues(hc.commandName).Set(timeSinceStart.Seconds())
@@ -220,6 +645,65 @@ func (hc *cmdCollector) UpdateRunDuration(runDuration time.Duration) {
 	hc.metrics.runDuration.WithLabelValues(hc.commandName).Observe(runDuration.Seconds())
 }
 
+// UpdateFallbackDuration observes how long a fallback took.
+func (hc *cmdCollector) UpdateFallbackDuration(fallbackDuration time.Duration) {
+	defer hc.active()()
+	hc.metrics.fallbackDuration.WithLabelValues(hc.commandName).Observe(fallbackDuration.Seconds())
+}
+
+// Update records the metrics of a command execution.
+func (hc *cmdCollector) Update(r metricCollector.MetricResult) {
+	defer hc.active()()
+
+	if r.Attempts > 0 {
+		hc.IncrementAttempts()
+	}
+	if r.Attempts > r.Successes {
+		// every unsuccessful attempt, once, rather than r.Errors, which is weighted and leaves out
+		// what doesn't count towards the error percentage
+		hc.IncrementErrors()
+	}
+	if r.Successes > 0 {
+		hc.IncrementSuccesses()
+	}
+	if r.Failures > 0 {
+		hc.IncrementFailures()
+	}
+	if r.Rejects > 0 {
+		hc.IncrementRejects()
+	}
+	if r.ShortCircuits > 0 {
+		hc.IncrementShortCircuits()
+	}
+	if r.Timeouts > 0 {
+		hc.IncrementTimeouts()
+	}
+	if r.FallbackSuccesses > 0 {
+		hc.IncrementFallbackSuccesses()
+	}
+	if r.FallbackFailures > 0 {
+		hc.IncrementFallbackFailures()
+	}
+	if r.FallbackSkipped > 0 {
+		hc.IncrementFallbackSkipped()
+	}
+	if r.FallbackRejected > 0 {
+		hc.IncrementFallbackRejected()
+	}
+	if r.ProbeSuccesses > 0 {
+		hc.IncrementProbeSuccess()
+	}
+	if r.ProbeFailures > 0 {
+		hc.IncrementProbeFailure()
+	}
+	for eventType, n := range r.CustomEvents {
+		hc.IncrementCustomEvents(eventType, n)
+	}
+
+	hc.UpdateTotalDuration(r.TotalDuration)
+	hc.UpdateRunDuration(r.RunDuration)
+}
+
 // Reset resets the internal counters and timers.
 func (hc *cmdCollector) Reset() {
 
@@ -0,0 +1,85 @@
+package plugins
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lesha888/hystrix-go/hystrix/metric_collector"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusCollectorRegistration(t *testing.T) {
+	Convey("with a command's successes collected into a registry", t, func() {
+		reg := prometheus.NewRegistry()
+		collector := NewPrometheusCollector(reg, nil)
+		c := collector.Collector("prometheus_successes")
+		c.Update(metricCollector.MetricResult{Attempts: 1, Successes: 1})
+
+		Convey("gathering the registry includes the successes", func() {
+			families, err := reg.Gather()
+			So(err, ShouldBeNil)
+			var successes float64
+			for _, family := range families {
+				if family.GetName() == PROMETHEUS_NAMESPACE+"_successes" {
+					successes = family.GetMetric()[0].GetCounter().GetValue()
+				}
+			}
+			So(successes, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestSeriesExpiry(t *testing.T) {
+	Convey("with series expiring after a minute idle", t, func() {
+		var deleted []string
+		expiry := newSeriesExpiry(func(name string) {
+			deleted = append(deleted, name)
+		})
+		expiry.idle = time.Minute
+		busy := expiry.register("busy")
+		expiry.register("idle")
+		now := time.Now()
+
+		Convey("nothing is deleted within the minute", func() {
+			expiry.sweep(now.Add(30 * time.Second))
+			So(deleted, ShouldBeEmpty)
+		})
+
+		Convey("only the idle command's series are deleted after it, once", func() {
+			atomic.StoreInt64(busy, now.Add(45*time.Second).UnixNano())
+			expiry.sweep(now.Add(90 * time.Second))
+			expiry.sweep(now.Add(95 * time.Second))
+			So(deleted, ShouldResemble, []string{"idle"})
+
+			Convey("and again once it has been idle after becoming active", func() {
+				So(expiry.register("idle"), ShouldNotBeNil)
+				expiry.sweep(time.Now().Add(2 * time.Minute))
+				So(len(deleted), ShouldEqual, 3)
+			})
+		})
+
+		Convey("a zero expiry deletes nothing", func() {
+			expiry.setIdle(0)
+			expiry.sweep(now.Add(time.Hour))
+			So(deleted, ShouldBeEmpty)
+		})
+	})
+
+	Convey("the sweeper deletes idle series in the background until stopped", t, func() {
+		var deletions int32
+		expiry := newSeriesExpiry(func(name string) {
+			atomic.AddInt32(&deletions, 1)
+		})
+		expiry.register("idle")
+		expiry.setIdle(10 * time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&deletions), ShouldEqual, 1)
+
+		expiry.setIdle(0)
+		expiry.register("idle")
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&deletions), ShouldEqual, 1)
+	})
+}
@@ -154,7 +154,10 @@ func (g *StatsdCollector) Update(r metricCollector.MetricResult) {
 	}
 
 	g.incrementCounterMetric(g.attemptsPrefix, r.Attempts)
-	g.incrementCounterMetric(g.errorsPrefix, r.Errors)
+	if r.Attempts > r.Successes {
+		// an attempt which didn't succeed is one error, however much it weighs
+		g.incrementCounterMetric(g.errorsPrefix, 1)
+	}
 	g.incrementCounterMetric(g.successesPrefix, r.Successes)
 	g.incrementCounterMetric(g.failuresPrefix, r.Failures)
 	g.incrementCounterMetric(g.rejectsPrefix, r.Rejects)
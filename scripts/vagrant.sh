@@ -18,6 +18,9 @@ go get github.com/smartystreets/goconvey/convey
 go get github.com/cactus/go-statsd-client/statsd
 go get github.com/rcrowley/go-metrics
 go get github.com/DataDog/datadog-go/statsd
+go get golang.org/x/sync/singleflight
+go get golang.org/x/time/rate
+go get google.golang.org/grpc
 
 chown -R vagrant:vagrant /go
 